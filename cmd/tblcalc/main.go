@@ -3,14 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/johnkerl/miller/v6/pkg/climain"
 	"github.com/knaka/tblcalc"
+	"github.com/knaka/tblcalc/mlr"
+	"github.com/knaka/tblcalc/tblfm"
 	"github.com/spf13/pflag"
 	"golang.org/x/term"
 
@@ -36,6 +46,45 @@ type tblcalcParams struct {
 	inPlace               bool
 	optForcedInputFormat  *tblcalc.InputFormat
 	optForcedOutputFormat *tblcalc.OutputFormat
+	iterate               int
+	decimal               bool
+	unsafeLua             bool
+	timeout               time.Duration
+	empty                 string
+	nilResult             string
+	labelColumn           int
+	createColumns         bool
+	noHeader              bool
+	optHeaderRows         *int // Number of header rows given by --header-rows
+	trace                 bool
+	traceFormulas         []int    // Formulas to trace (1-based)
+	traceCells            []string // Target cells to trace, like "@2$3"
+}
+
+// traceCellPat matches a target cell given to --trace-cell, like "@2$3".
+var traceCellPat = regexp.MustCompile(`^@(\d+)\$(\d+)$`)
+
+// traceFilter returns the trace filter that passes the evaluations of the given formulas (1-based)
+// at the given target cells. An empty list does not restrict, and nil is returned if both are empty.
+func traceFilter(formulas []int, cells []string) (func(index, row, col int) bool, error) {
+	if len(formulas) == 0 && len(cells) == 0 {
+		return nil, nil
+	}
+	type cellPos struct{ row, col int }
+	var positions []cellPos
+	for _, cell := range cells {
+		match := traceCellPat.FindStringSubmatch(cell)
+		if match == nil {
+			return nil, fmt.Errorf("invalid trace cell %q: must be like @2$3", cell)
+		}
+		row, _ := strconv.Atoi(match[1])
+		col, _ := strconv.Atoi(match[2])
+		positions = append(positions, cellPos{row, col})
+	}
+	return func(index, row, col int) bool {
+		return (len(formulas) == 0 || slices.Contains(formulas, index+1)) &&
+			(len(positions) == 0 || slices.Contains(positions, cellPos{row, col}))
+	}, nil
 }
 
 // stdinFileName is a special name for standard input.
@@ -51,6 +100,57 @@ func tblcalcEntry(params *tblcalcParams) (err error) {
 	if len(params.args) == 0 {
 		params.args = append(params.args, stdinFileName)
 	}
+	var opts tblcalc.Options
+	if params.iterate > 0 {
+		opts = append(opts, tblcalc.WithIterate(params.iterate))
+	}
+	if params.decimal {
+		opts = append(opts, tblcalc.WithDecimal(true))
+	}
+	if params.unsafeLua {
+		opts = append(opts, tblcalc.WithUnsafeLua(true))
+	}
+	if params.timeout > 0 {
+		opts = append(opts, tblcalc.WithTimeout(params.timeout))
+	}
+	if params.empty != "" {
+		mode, err := tblfm.ParseEmptyMode(params.empty)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, tblcalc.WithEmpty(mode))
+	}
+	if params.nilResult != "" {
+		mode, err := tblfm.ParseNilResultMode(params.nilResult)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, tblcalc.WithNilResult(mode))
+	}
+	if params.labelColumn > 0 {
+		opts = append(opts, tblcalc.WithLabelColumn(params.labelColumn))
+	}
+	if params.createColumns {
+		opts = append(opts, tblcalc.WithCreateColumns(true))
+	}
+	if params.optHeaderRows != nil && *params.optHeaderRows < 0 {
+		return fmt.Errorf("invalid number of header rows: %d", *params.optHeaderRows)
+	}
+	if params.noHeader {
+		if params.optHeaderRows != nil && *params.optHeaderRows != 0 {
+			return fmt.Errorf("--no-header conflicts with --header-rows %d", *params.optHeaderRows)
+		}
+		opts = append(opts, tblcalc.WithHeaderRows(0))
+	} else if params.optHeaderRows != nil {
+		opts = append(opts, tblcalc.WithHeaderRows(*params.optHeaderRows))
+	}
+	if params.trace {
+		filter, err := traceFilter(params.traceFormulas, params.traceCells)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, tblcalc.WithTrace(params.stderr), tblcalc.WithTraceFilter(filter))
+	}
 	for _, inPath := range params.args {
 		// Standard input
 		if inPath == stdinFileName {
@@ -77,6 +177,7 @@ func tblcalcEntry(params *tblcalcParams) (err error) {
 				inputFormat,
 				params.stdout,
 				outputFormat,
+				opts...,
 			)
 			if err != nil {
 				return
@@ -113,6 +214,7 @@ func tblcalcEntry(params *tblcalcParams) (err error) {
 					inputFormat,
 					params.stdout,
 					outputFormat,
+					opts...,
 				)
 				if err != nil {
 					return
@@ -134,9 +236,10 @@ func tblcalcEntry(params *tblcalcParams) (err error) {
 						inputFormat,
 						outFile,
 						outputFormat,
+						opts...,
 					)
 					if err2 != nil {
-						return
+						return err2
 					}
 					name := outFile.Name()
 					Must(outFile.Close())
@@ -218,7 +321,66 @@ func filesEqual(file1, file2 string) (bool, error) {
 	}
 }
 
+// mlrCheckArg is the first argument of the subprocess started by checkMlrCommandLine.
+const mlrCheckArg = "__tblcalc-mlr-check"
+
+// mlrCheckDone is written by the subprocess when the command line is parsed,
+// which tells it apart from an exit inside Miller's parser, like that of -h.
+const mlrCheckDone = "tblcalc: mlr command line parsed\n"
+
+// runMlrCheck parses the Miller command line args and exits. It runs in the subprocess
+// started by checkMlrCommandLine, as Miller's parser exits the process on errors.
+func runMlrCheck(args []string) {
+	if _, _, err := climain.ParseCommandLine(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(mlrCheckDone)
+	os.Exit(0)
+}
+
+// checkMlrCommandLine checks the Miller command line args by parsing it in a subprocess
+// running this executable. It is installed by mlr.SetCommandLineChecker.
+func checkMlrCommandLine(ctx context.Context, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to check the Miller command line: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, exe, append([]string{mlrCheckArg}, args...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("miller processing stopped: %w", ctxErr)
+	}
+	if runErr == nil && stdout.String() == mlrCheckDone {
+		return nil
+	}
+	if _, ok := runErr.(*exec.ExitError); runErr != nil && !ok {
+		return fmt.Errorf("failed to check the Miller command line: %w", runErr)
+	}
+	return &mlr.CommandLineError{Message: mlrCheckMessage(stderr.String())}
+}
+
+// mlrCheckMessage returns the message of the error Miller writes to stderr in one line,
+// without the usage text.
+func mlrCheckMessage(stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	switch {
+	case lines[0] == "":
+		return "flags that print or exit while parsing are not allowed"
+	case strings.HasPrefix(lines[0], "Usage: "):
+		return "invalid arguments; " + strings.ToLower(lines[0][:1]) + lines[0][1:]
+	}
+	return strings.Join(lines, " ")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == mlrCheckArg {
+		runMlrCheck(os.Args[2:])
+	}
+	mlr.SetCommandLineChecker(checkMlrCommandLine)
 	params := tblcalcParams{
 		exeName: appID,
 		stdin:   os.Stdin,
@@ -238,6 +400,21 @@ func main() {
 
 	pflag.BoolVarP(&params.inPlace, "in-place", "i", false, "edit file(s) in place")
 
+	pflag.IntVarP(&params.iterate, "iterate", "", 0, "Recalculate up to N times until the table stops changing")
+	pflag.BoolVarP(&params.decimal, "decimal", "", false, "Calculate with exact decimals instead of floats")
+	pflag.BoolVarP(&params.unsafeLua, "unsafe-lua", "", false, "Allow formulas to use all Lua libraries, including io and os")
+	pflag.StringVarP(&params.empty, "empty", "", "", "Value of empty fields in formulas: string, nil or zero (default string)")
+	pflag.StringVarP(&params.nilResult, "nil-result", "", "", "What a nil formula result does to the cell: clear or keep (default clear)")
+	pflag.IntVarP(&params.labelColumn, "label-column", "", 0, "Column N holding the row labels referenced by @{label} (default 1)")
+	pflag.BoolVarP(&params.createColumns, "create-columns", "", false, "Create target columns given by header names that are not in the table")
+	pflag.BoolVarP(&params.noHeader, "no-header", "", false, "Treat the table as having no header row (same as --header-rows 0)")
+	var headerRows int
+	pflag.IntVarP(&headerRows, "header-rows", "", 1, "Number of header rows at the top of the table")
+	pflag.BoolVarP(&params.trace, "trace", "", false, "Log each formula evaluation to standard error")
+	pflag.IntSliceVarP(&params.traceFormulas, "trace-formula", "", nil, "Trace only the Nth formula of each file (repeatable)")
+	pflag.StringSliceVarP(&params.traceCells, "trace-cell", "", nil, "Trace only the evaluations of target cell like @2$3 (repeatable)")
+	pflag.DurationVarP(&params.timeout, "timeout", "", 10*time.Second, "Abort formula evaluation of a file after this duration (0 for no limit)")
+
 	var inputCSVForced bool
 	pflag.BoolVarP(&inputCSVForced, "icsv", "", false, "Force CSV for input format")
 	var inputTSVForced bool
@@ -254,6 +431,9 @@ func main() {
 		pflag.Usage()
 		return
 	}
+	if pflag.CommandLine.Changed("header-rows") {
+		params.optHeaderRows = &headerRows
+	}
 	if inputCSVForced {
 		params.optForcedInputFormat = Ptr(tblcalc.InputFormatCSV)
 	}
@@ -268,6 +448,12 @@ func main() {
 	}
 	err := tblcalcEntry(&params)
 	if err != nil {
+		// Errors in directives are shown as "file:line: message" for editors to jump to
+		var directiveErr *tblcalc.DirectiveError
+		if errors.As(err, &directiveErr) {
+			fmt.Fprintln(os.Stderr, directiveErr)
+			os.Exit(1)
+		}
 		log.Fatalf("%s: %v\n", appID, err)
 	}
 }
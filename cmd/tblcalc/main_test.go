@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/knaka/tblcalc"
+	"github.com/knaka/tblcalc/mlr"
 	"github.com/knaka/tblcalc/testdata"
 
 	//lint:ignore ST1001
@@ -18,6 +19,16 @@ import (
 
 var projectTopDirPath = filepath.Join("..", "..")
 
+// TestMain runs the Miller command-line check when the test binary is started as its subprocess,
+// and installs the check like main does.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == mlrCheckArg {
+		runMlrCheck(os.Args[2:])
+	}
+	mlr.SetCommandLineChecker(checkMlrCommandLine)
+	os.Exit(m.Run())
+}
+
 func TestTblcalcEntry_WithCSVFile(t *testing.T) {
 	// Setup params with testdata/test1.csv as argument
 	var stdout bytes.Buffer
@@ -253,3 +264,188 @@ func TestTblcalcEntry_NonExistentFile(t *testing.T) {
 		t.Errorf("Expected error message to contain 'failed to open input file', got: %s", errMsg)
 	}
 }
+
+func TestTblcalcEntry_Iterate(t *testing.T) {
+	input := `#+TBLFM: @2$2=@3$2/2;%.2f
+#+TBLFM: @3$2=10-@2$2;%.2f
+Name,Value
+x,0
+y,0
+`
+	expected := `#+TBLFM: @2$2=@3$2/2;%.2f
+#+TBLFM: @3$2=10-@2$2;%.2f
+Name,Value
+x,3.33
+y,6.67
+`
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	inputFormat := tblcalc.InputFormatCSV
+	params := &tblcalcParams{
+		exeName:              "tblcalc",
+		stdin:                strings.NewReader(input),
+		stdout:               &stdout,
+		stderr:               &stderr,
+		args:                 []string{stdinFileName},
+		optForcedInputFormat: &inputFormat,
+		iterate:              20,
+	}
+
+	err := tblcalcEntry(params)
+	if err != nil {
+		t.Fatalf("tblcalcEntry failed: %v", err)
+	}
+
+	if stdout.String() != expected {
+		t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", stdout.String(), expected)
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	filter, err := traceFilter([]int{2}, []string{"@2$3", "@3$3"})
+	if err != nil {
+		t.Fatalf("traceFilter failed: %v", err)
+	}
+	tests := []struct {
+		index, row, col int
+		expected        bool
+	}{
+		{1, 2, 3, true},
+		{1, 3, 3, true},
+		{0, 2, 3, false},
+		{1, 4, 3, false},
+	}
+	for _, tt := range tests {
+		if got := filter(tt.index, tt.row, tt.col); got != tt.expected {
+			t.Errorf("filter(%d, %d, %d) = %v, want %v", tt.index, tt.row, tt.col, got, tt.expected)
+		}
+	}
+	if filter, _ := traceFilter(nil, nil); filter != nil {
+		t.Errorf("traceFilter(nil, nil) should return nil")
+	}
+	if _, err := traceFilter(nil, []string{"B3"}); err == nil {
+		t.Errorf("traceFilter should fail for an invalid cell")
+	}
+}
+
+func TestTblcalcEntry_HeaderRows(t *testing.T) {
+	const input = "#+TBLFM: $3=$1*$2\n2,3,\n4,5,\n"
+	tests := []struct {
+		name          string
+		noHeader      bool
+		optHeaderRows *int
+		expected      string
+		errorSubstr   string
+	}{
+		{
+			name:     "no header",
+			noHeader: true,
+			expected: "#+TBLFM: $3=$1*$2\n2,3,6\n4,5,20\n",
+		},
+		{
+			name:          "header rows",
+			optHeaderRows: Ptr(1),
+			expected:      "#+TBLFM: $3=$1*$2\n2,3,\n4,5,20\n",
+		},
+		{
+			name:          "conflicting flags",
+			noHeader:      true,
+			optHeaderRows: Ptr(2),
+			errorSubstr:   "--no-header conflicts with --header-rows 2",
+		},
+		{
+			name:          "negative header rows",
+			optHeaderRows: Ptr(-1),
+			errorSubstr:   "invalid number of header rows: -1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			var stderr bytes.Buffer
+			inputFormat := tblcalc.InputFormatCSV
+			params := &tblcalcParams{
+				exeName:              "tblcalc",
+				stdin:                strings.NewReader(input),
+				stdout:               &stdout,
+				stderr:               &stderr,
+				args:                 []string{stdinFileName},
+				optForcedInputFormat: &inputFormat,
+				noHeader:             tt.noHeader,
+				optHeaderRows:        tt.optHeaderRows,
+			}
+			err := tblcalcEntry(params)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tblcalcEntry failed: %v", err)
+			}
+			if stdout.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", stdout.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestTblcalcEntry_MlrVerbFlags(t *testing.T) {
+	const table = "Item,Qty\nOrange,3\nApple,5\n"
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		errorSubstr string
+	}{
+		{
+			name:     "valid flags",
+			input:    "#+MLR-VERB: sort -nr Qty then head -n 1\n" + table,
+			expected: "#+MLR-VERB: sort -nr Qty then head -n 1\nItem,Qty\nApple,5\n",
+		},
+		{
+			name:        "invalid flag",
+			input:       "# Comment\n#+MLR-VERB: sort -f Item then head -Z 3\n" + table,
+			errorSubstr: "<stdin>:2: invalid directive \"#+MLR-VERB: sort -f Item then head -Z 3\": invalid arguments; usage: mlr head [options]",
+		},
+		{
+			name:        "missing argument",
+			input:       "#+MLR-VERB: sort -f\n" + table,
+			errorSubstr: `<stdin>:1: invalid directive "#+MLR-VERB: sort -f": mlr sort: option "-f" missing argument(s).`,
+		},
+		{
+			name:        "invalid number",
+			input:       "#+MLR-VERB: head -n abc\n" + table,
+			errorSubstr: `could not scan flag "abc"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			var stderr bytes.Buffer
+			inputFormat := tblcalc.InputFormatCSV
+			params := &tblcalcParams{
+				exeName:              "tblcalc",
+				stdin:                strings.NewReader(tt.input),
+				stdout:               &stdout,
+				stderr:               &stderr,
+				args:                 []string{stdinFileName},
+				optForcedInputFormat: &inputFormat,
+			}
+			err := tblcalcEntry(params)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tblcalcEntry failed: %v", err)
+			}
+			if stdout.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", stdout.String(), tt.expected)
+			}
+		})
+	}
+}
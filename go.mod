@@ -3,6 +3,7 @@ module github.com/knaka/tblcalc
 go 1.25
 
 require (
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	github.com/spf13/pflag v1.0.10
 	github.com/yuin/gopher-lua v1.1.1
 	golang.org/x/term v0.39.0
@@ -13,7 +14,6 @@ require (
 	github.com/friendsofgo/errors v0.9.2 // indirect
 	github.com/golang/snappy v1.0.0 // indirect
 	github.com/johnkerl/lumin v1.0.0 // indirect
-	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/klauspost/compress v1.18.2 // indirect
 	github.com/kshedden/dstream v0.0.0-20190512025041-c4c410631beb // indirect
 	github.com/kshedden/statmodel v0.0.0-20210519035403-ee97d3e48df1 // indirect
@@ -0,0 +1,161 @@
+package mlr
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/johnkerl/miller/v6/pkg/cli"
+	"github.com/johnkerl/miller/v6/pkg/dsl"
+	"github.com/johnkerl/miller/v6/pkg/dsl/cst"
+	"github.com/johnkerl/miller/v6/pkg/parsing/lexer"
+	"github.com/johnkerl/miller/v6/pkg/parsing/parser"
+	"github.com/johnkerl/miller/v6/pkg/transformers"
+)
+
+// CommandLineError is an error in a Miller command line, such as an unknown flag of a verb
+// or a syntax error of a put script.
+type CommandLineError struct {
+	Message string
+}
+
+// Error returns the message.
+func (e *CommandLineError) Error() string {
+	return e.Message
+}
+
+// commandLineChecker is the function installed by SetCommandLineChecker.
+var commandLineChecker func(ctx context.Context, args []string) error
+
+// SetCommandLineChecker installs a function that checks a Miller command line, such as
+// []string{"mlr", "-n", "head", "-n", "1"}, after the checks done in-process and before Miller
+// parses it. Miller's parser exits the process on an invalid flag of a verb, which cannot be
+// checked in-process, so a program can install a checker that parses the command line in a
+// subprocess, as cmd/tblcalc does. The checker returns a *CommandLineError for a command line
+// that Miller rejects. It is not safe to call SetCommandLineChecker concurrently with Miller runs.
+func SetCommandLineChecker(checker func(ctx context.Context, args []string) error) {
+	commandLineChecker = checker
+}
+
+// exitFlags are the flags on which Miller's verb parsers print text and exit the process.
+var exitFlags = []string{"-h", "--help", "--version"}
+
+// checkCommandLine checks the verbs of the Miller command line args, whose chain of verbs is
+// verbChain: the verbs must exist, flags like -h are rejected, and the DSL expressions of put
+// and filter must parse. Then it runs the installed checker, if any.
+func checkCommandLine(ctx context.Context, args []string, verbChain []string) error {
+	for i := 0; i < len(verbChain); i++ {
+		n, err := checkVerb(verbChain[i:])
+		if err != nil {
+			return err
+		}
+		// Skip the arguments left to the next verb, which Miller takes as file names
+		for i += n; i < len(verbChain) && verbChain[i] != "then"; i++ {
+		}
+	}
+	if commandLineChecker == nil {
+		return nil
+	}
+	return commandLineChecker(ctx, args)
+}
+
+// checkVerb checks the verb at the start of args and returns the number of arguments it takes.
+func checkVerb(args []string) (int, error) {
+	verb := args[0]
+	if transformers.LookUp(verb) == nil {
+		return 0, &CommandLineError{Message: fmt.Sprintf("unknown verb %q", verb)}
+	}
+	if verb == "put" || verb == "filter" {
+		return checkPutOrFilter(args)
+	}
+	n := 1
+	for ; n < len(args) && args[n] != "then"; n++ {
+		if slices.Contains(exitFlags, args[n]) {
+			return n, exitFlagError(verb, args[n])
+		}
+	}
+	return n, nil
+}
+
+// checkPutOrFilter checks the flags of a put or filter verb at the start of args and parses its
+// DSL expressions, like Miller does before running them. It returns the number of arguments taken.
+// After a flag that it does not know, such as a main flag for the output, the rest is left to Miller.
+func checkPutOrFilter(args []string) (int, error) {
+	verb := args[0]
+	var dslStrings []string
+	haveDSLStrings := false
+	n := 1
+	for ; n < len(args) && strings.HasPrefix(args[n], "-") && args[n] != "--"; n++ {
+		switch opt := args[n]; opt {
+		case "-h", "--help", "--version", "-X":
+			return n, exitFlagError(verb, opt)
+		case "-e", "-f", "-s":
+			n++
+			if n >= len(args) {
+				return n, &CommandLineError{Message: fmt.Sprintf("mlr %s: option %q missing argument(s).", verb, opt)}
+			}
+			if opt == "-e" {
+				dslStrings = append(dslStrings, args[n])
+			}
+			haveDSLStrings = haveDSLStrings || opt != "-s"
+		case "-x", "-q", "-E", "-p", "-v", "-d", "-D", "-w", "-z", "-W", "-S", "-F":
+		default:
+			return n, nil
+		}
+	}
+	if !haveDSLStrings {
+		if n >= len(args) {
+			return n, &CommandLineError{Message: fmt.Sprintf("mlr %s: -f/-e requires a filename as argument.", verb)}
+		}
+		dslStrings = append(dslStrings, args[n])
+		n++
+	}
+	var instanceType cst.DSLInstanceType = cst.DSLInstanceTypePut
+	if verb == "filter" {
+		instanceType = cst.DSLInstanceTypeFilter
+	}
+	root := cst.NewEmptyRoot(&cli.DefaultOptions().WriterOptions, instanceType)
+	for _, dslString := range dslStrings {
+		ast, err := parseDSL(dslString)
+		if err != nil {
+			return n, &CommandLineError{Message: "mlr: cannot parse DSL expression. " + parseErrorMessage(err)}
+		}
+		if _, err := root.IngestAST(ast, false, false); err != nil {
+			return n, &CommandLineError{Message: err.Error()}
+		}
+	}
+	// Functions and subroutines are resolved after all the expressions are ingested
+	if err := root.Resolve(); err != nil {
+		return n, &CommandLineError{Message: err.Error()}
+	}
+	return n, nil
+}
+
+// parseDSL parses a DSL expression like Miller does, without writing the error to stderr.
+func parseDSL(dslString string) (*dsl.AST, error) {
+	// A comment at the end of the expression is stripped only up to a newline
+	if !strings.HasSuffix(dslString, "\n") {
+		dslString += "\n"
+	}
+	ast, err := parser.NewParser().Parse(lexer.NewLexer([]byte(dslString)))
+	if err != nil {
+		return nil, err
+	}
+	return ast.(*dsl.AST), nil
+}
+
+// parseErrorMessage returns the message of a DSL parse error in one line,
+// without the list of the tokens expected by the parser.
+func parseErrorMessage(err error) string {
+	lines := strings.Split(strings.TrimSpace(err.Error()), "\n")
+	if i := slices.Index(lines, "Expected one of:"); i >= 0 {
+		lines = lines[:i]
+	}
+	return strings.Join(lines, " ")
+}
+
+// exitFlagError returns the error for a flag on which Miller would exit the process.
+func exitFlagError(verb, flag string) error {
+	return &CommandLineError{Message: fmt.Sprintf("mlr %s: flags that print or exit, like %s, are not allowed", verb, flag)}
+}
@@ -1,14 +1,22 @@
 package mlr
 
 import (
+	"container/list"
+	"context"
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/johnkerl/miller/v6/pkg/climain"
 	"github.com/johnkerl/miller/v6/pkg/stream"
+	"github.com/johnkerl/miller/v6/pkg/transformers"
+	"github.com/johnkerl/miller/v6/pkg/types"
+	"github.com/kballard/go-shellquote"
 )
 
 // Put runs Miller with the specified file and scripts.
 // hasHeader indicates whether the first row should be treated as a header.
+// Without a header, the fields are referred to by position like $1, and no header is written.
 func Put(
 	files []string,
 	scripts []string,
@@ -18,6 +26,97 @@ func Put(
 	writeCloser io.WriteCloser,
 ) (
 	err error,
+) {
+	return PutContext(context.Background(), files, scripts, hasHeader, inputFormat, outputFormat, writeCloser)
+}
+
+// PutContext is like Put but stops reading records when ctx is done.
+// The records read after that are dropped, and the returned error wraps ctx.Err().
+func PutContext(
+	ctx context.Context,
+	files []string,
+	scripts []string,
+	hasHeader bool,
+	inputFormat string,
+	outputFormat string,
+	writeCloser io.WriteCloser,
+) (
+	err error,
+) {
+	return RunContext(ctx, files, PutVerb(scripts), hasHeader, inputFormat, outputFormat, writeCloser)
+}
+
+// PutVerb returns the arguments of the put verb that runs scripts, like
+// []string{"put", "-e", "$z = $x + $y"}. The scripts form a single DSL program.
+func PutVerb(scripts []string) []string {
+	// List of verbs - Miller Documentation https://miller.readthedocs.io/en/latest/reference-verbs/#put
+	verb := []string{"put"}
+	for _, script := range scripts {
+		verb = append(verb, "-e", script)
+	}
+	return verb
+}
+
+// ParseVerbChain splits a chain of Miller verbs like "sort -f Date then fill-down -f Category"
+// into arguments, with shell-like quoting. It is an error if the chain starts with a flag,
+// which Miller would take as a main flag, or if a verb is unknown. The verbs are checked by
+// CheckVerbChain, and their errors are *CommandLineError values.
+func ParseVerbChain(chain string) ([]string, error) {
+	args, err := shellquote.Split(chain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verb chain %q: %w", chain, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty verb chain")
+	}
+	if strings.HasPrefix(args[0], "-") {
+		return nil, fmt.Errorf("verb chain %q must start with a verb", chain)
+	}
+	// Check the first verb and the verbs after "then"
+	for i := 0; i < len(args); i++ {
+		if i > 0 {
+			if args[i] != "then" {
+				continue
+			}
+			i++
+			if i >= len(args) {
+				return nil, fmt.Errorf("verb chain %q must have a verb after \"then\"", chain)
+			}
+		}
+		if transformers.LookUp(args[i]) == nil {
+			return nil, fmt.Errorf("unknown verb %q", args[i])
+		}
+	}
+	if err := CheckVerbChain(context.Background(), args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// CheckVerbChain checks a chain of verbs, given as arguments like those of RunContext, without
+// running it. Flags that make Miller print text and exit, like -h, are rejected, and the DSL
+// expressions of put and filter are parsed. Other flags of the verbs are checked only by the
+// checker installed by SetCommandLineChecker; without one, Miller exits the process on an invalid
+// flag when the chain runs. Errors in the command line are *CommandLineError values.
+func CheckVerbChain(ctx context.Context, verbChain []string) error {
+	return checkCommandLine(ctx, append([]string{"mlr", "-n"}, verbChain...), verbChain)
+}
+
+// RunContext runs Miller with the specified files and chain of verbs, given as command-line
+// arguments like []string{"sort", "-f", "Date", "then", "put", "-e", "$x = 1"}.
+// hasHeader indicates whether the first row should be treated as a header.
+// Like PutContext, it stops reading records when ctx is done.
+// Errors in the command line, such as a syntax error of a put script, are *CommandLineError values.
+func RunContext(
+	ctx context.Context,
+	files []string,
+	verbChain []string,
+	hasHeader bool,
+	inputFormat string,
+	outputFormat string,
+	writeCloser io.WriteCloser,
+) (
+	err error,
 ) {
 	args := []string{
 		"mlr",
@@ -28,22 +127,57 @@ func Put(
 		"--pass-comments",
 	}
 	if !hasHeader {
-		args = append(args, "--implicit-csv-header")
-	}
-	args = append(args,
-		// In-place mode - Miller Documentation https://miller.readthedocs.io/en/latest/reference-main-in-place-processing/
-		// Windows tries to rename across drives.
-		// "-I",
-		// List of verbs - Miller Documentation https://miller.readthedocs.io/en/latest/reference-verbs/#put
-		"put",
-	)
-	for _, script := range scripts {
-		args = append(args, "-e", script)
+		// Fields are named 1, 2, 3, ..., and the output has no header either
+		args = append(args, "--implicit-csv-header", "--headerless-csv-output")
+	}
+	// In-place mode - Miller Documentation https://miller.readthedocs.io/en/latest/reference-main-in-place-processing/
+	// Windows tries to rename across drives.
+	// "-I",
+	args = append(args, verbChain...)
+	// Miller's parser exits the process on errors, so the command line is checked beforehand
+	if err = checkCommandLine(ctx, args, verbChain); err != nil {
+		return
 	}
 	options, recordTransformers, err := climain.ParseCommandLine(args)
 	if err != nil {
 		return
 	}
+	// Arguments left after the verbs would be taken as input files
+	if len(options.FileNames) > 0 {
+		return fmt.Errorf("unexpected arguments after the verbs: %q", options.FileNames)
+	}
+	if ctx.Done() != nil {
+		recordTransformers = append([]transformers.IRecordTransformer{&cancelTransformer{ctx: ctx}}, recordTransformers...)
+	}
 	err = stream.Stream(files, options, recordTransformers, writeCloser, false)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("miller processing stopped: %w", ctxErr)
+	}
 	return
 }
+
+// cancelTransformer is a record transformer put first in the chain to stop the
+// stream when its context is done. Like the head verb, it tells the record reader
+// that further records are not needed, and drops the records already read.
+type cancelTransformer struct {
+	ctx                 context.Context
+	wroteDownstreamDone bool
+}
+
+// Transform passes records through until the context is done.
+func (tr *cancelTransformer) Transform(
+	inrecAndContext *types.RecordAndContext,
+	outputRecordsAndContexts *list.List, // list of *types.RecordAndContext
+	inputDownstreamDoneChannel <-chan bool,
+	outputDownstreamDoneChannel chan<- bool,
+) {
+	transformers.HandleDefaultDownstreamDone(inputDownstreamDoneChannel, outputDownstreamDoneChannel)
+	if inrecAndContext.EndOfStream || tr.ctx.Err() == nil {
+		outputRecordsAndContexts.PushBack(inrecAndContext)
+		return
+	}
+	if !tr.wroteDownstreamDone {
+		outputDownstreamDoneChannel <- true
+		tr.wroteDownstreamDone = true
+	}
+}
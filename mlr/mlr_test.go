@@ -1,5 +1,84 @@
 package mlr
 
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseVerbChain(t *testing.T) {
+	tests := []struct {
+		chain       string
+		expected    []string
+		errorSubstr string
+	}{
+		{chain: "sort -f Date then fill-down -f Category", expected: []string{"sort", "-f", "Date", "then", "fill-down", "-f", "Category"}},
+		{chain: `put '$z = $x . " then"' then head -n 1`, expected: []string{"put", `$z = $x . " then"`, "then", "head", "-n", "1"}},
+		{chain: "", errorSubstr: "empty verb chain"},
+		{chain: "--icsv cat", errorSubstr: "must start with a verb"},
+		{chain: "cat then", errorSubstr: "must have a verb after"},
+		{chain: "cat then no-such-verb", errorSubstr: `unknown verb "no-such-verb"`},
+		{chain: "sort -f 'Date", errorSubstr: "invalid verb chain"},
+		{chain: "head -h", errorSubstr: "mlr head: flags that print or exit, like -h, are not allowed"},
+		{chain: "cat then sort --help", errorSubstr: "like --help, are not allowed"},
+		{chain: "put -X '$x = 1'", errorSubstr: "like -X, are not allowed"},
+		{chain: "put '$x ='", errorSubstr: "mlr: cannot parse DSL expression. Parse error"},
+		{chain: "put -q -e '$x = 1' -e '$y ='", errorSubstr: "mlr: cannot parse DSL expression. Parse error"},
+		{chain: "filter -e", errorSubstr: `mlr filter: option "-e" missing argument(s).`},
+		{chain: "put -S", errorSubstr: "mlr put: -f/-e requires a filename as argument."},
+		{chain: "put 'begin { $x = 1 }'", errorSubstr: "begin/end blocks"},
+		{chain: `put -e 'func f(x) { return x }' -e '$y = f($x)' then head -n 1`, expected: []string{"put", "-e", "func f(x) { return x }", "-e", "$y = f($x)", "then", "head", "-n", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chain, func(t *testing.T) {
+			args, err := ParseVerbChain(tt.chain)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVerbChain failed: %v", err)
+			}
+			if !slices.Equal(args, tt.expected) {
+				t.Errorf("got %q, expected %q", args, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetCommandLineChecker(t *testing.T) {
+	var checked []string
+	SetCommandLineChecker(func(ctx context.Context, args []string) error {
+		checked = args
+		if slices.Contains(args, "-Z") {
+			return &CommandLineError{Message: "invalid arguments"}
+		}
+		return nil
+	})
+	defer SetCommandLineChecker(nil)
+
+	if _, err := ParseVerbChain("head -n 1"); err != nil {
+		t.Fatalf("ParseVerbChain failed: %v", err)
+	}
+	if expected := []string{"mlr", "-n", "head", "-n", "1"}; !slices.Equal(checked, expected) {
+		t.Errorf("checked %q, expected %q", checked, expected)
+	}
+	_, err := ParseVerbChain("head -Z 1")
+	var cmdErr *CommandLineError
+	if !errors.As(err, &cmdErr) || cmdErr.Message != "invalid arguments" {
+		t.Errorf("expected the error of the checker, got %v", err)
+	}
+	// The checks in-process run first
+	checked = nil
+	if _, err := ParseVerbChain("head -h"); err == nil || checked != nil {
+		t.Errorf("expected an error without running the checker, got %v", err)
+	}
+}
+
 // func TestMLR(t *testing.T) {
 // 	tempFile := Value(os.CreateTemp("", "temp.csv"))
 // 	defer (func () { os.Remove(tempFile.Name()) })()
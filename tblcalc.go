@@ -3,16 +3,23 @@ package tblcalc
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/knaka/go-utils/funcopt"
 
@@ -57,11 +64,51 @@ var commentScriptRe = sync.OnceValue(func() *regexp.Regexp {
 
 const commentScriptIdx = 2
 
+var commentVerbRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^#\s*\+(MLR|MILLER)-VERB\s*:\s*(.*)\s*$`)
+})
+
+const commentVerbIdx = 2
+
+var commentLuaRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^#\s*\+LUA\s*:\s*(.*)\s*$`)
+})
+
+const commentLuaIdx = 1
+
+var commentOptionsRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^#\s*\+OPTIONS\s*:\s*(.*)\s*$`)
+})
+
+const commentOptionsIdx = 1
+
+// hlineCommentRe matches a comment line that acts as a horizontal separator (hline) like "#-" or "#---".
+var hlineCommentRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^#-`)
+})
+
 // tblcalcParams holds configuration parameters.
 type tblcalcParams struct {
-	ignoreExit bool
-	formulas   []string
-	scripts    []string
+	ignoreExit     bool
+	asWrittenOrder bool
+	iterate        int
+	decimal        bool
+	now            func() time.Time
+	unsafeLua      bool
+	timeout        time.Duration
+	empty          *tblfm.EmptyMode
+	nilResult      *tblfm.NilResultMode
+	headerRows     *int
+	labelColumn    int
+	createColumns  bool
+	trace          io.Writer
+	traceFilter    func(index, row, col int) bool
+	formulas       []locatedFormula
+	luaChunks      []luaChunk
+	functions      map[string]func(args []tblfm.Value) (tblfm.Value, error)
+	mlrSteps       []mlrStep
+
+	remoteChain []string // Absolute paths of the files that reference the file being processed
 }
 
 // Options is a functional options type.
@@ -71,17 +118,175 @@ var WithIgnoreExit = funcopt.New(func(params *tblcalcParams, ignoreExit bool) {
 	params.ignoreExit = ignoreExit
 })
 
+// WithAsWrittenOrder makes TBLFM formulas evaluate strictly in the order they are written
+// instead of in dependency order.
+var WithAsWrittenOrder = funcopt.New(func(params *tblcalcParams, asWritten bool) {
+	params.asWrittenOrder = asWritten
+})
+
+// WithIterate makes TBLFM formulas apply repeatedly until the table stops changing,
+// up to max passes. It takes precedence over the "iterate" option of an "#+OPTIONS:" directive.
+var WithIterate = funcopt.New(func(params *tblcalcParams, max int) {
+	params.iterate = max
+})
+
+// WithDecimal makes TBLFM formulas calculate with exact decimals instead of floats.
+// The "decimal" option of an "#+OPTIONS:" directive also enables it.
+var WithDecimal = funcopt.New(func(params *tblcalcParams, decimal bool) {
+	params.decimal = decimal
+})
+
+// WithNow sets the function that returns the current time for the today() and now() functions
+// of TBLFM formulas. Giving a fixed time makes the output reproducible.
+var WithNow = funcopt.New(func(params *tblcalcParams, now func() time.Time) {
+	params.now = now
+})
+
+// WithUnsafeLua makes all standard Lua libraries, including io and os, available to TBLFM formulas.
+// Enable it only for files from trusted sources.
+var WithUnsafeLua = funcopt.New(func(params *tblcalcParams, unsafe bool) {
+	params.unsafeLua = unsafe
+})
+
+// WithTimeout sets the time limit for applying the TBLFM formulas of a file.
+// A formula that runs longer, such as an infinite loop, is aborted with an error.
+var WithTimeout = funcopt.New(func(params *tblcalcParams, timeout time.Duration) {
+	params.timeout = timeout
+})
+
+// WithEmpty sets the Lua value of empty fields in TBLFM formulas (see tblfm.WithEmpty).
+// It takes precedence over the "empty" option of an "#+OPTIONS:" directive.
+var WithEmpty = funcopt.New(func(params *tblcalcParams, mode tblfm.EmptyMode) {
+	params.empty = &mode
+})
+
+// WithNilResult sets what a TBLFM formula that evaluates to nil does to its target cell
+// (see tblfm.WithNilResult). It takes precedence over the "nil" option of an "#+OPTIONS:" directive.
+var WithNilResult = funcopt.New(func(params *tblcalcParams, mode tblfm.NilResultMode) {
+	params.nilResult = &mode
+})
+
+// WithHeaderRows sets the number of header rows at the top of the table, which may be 0 for
+// a table without a header (see tblfm.WithHeaderRows). Miller takes the last header row as its header.
+// It takes precedence over the "header" option of an "#+OPTIONS:" directive.
+// Default is 1.
+var WithHeaderRows = funcopt.New(func(params *tblcalcParams, n int) {
+	n = max(n, 0)
+	params.headerRows = &n
+})
+
+// WithLabelColumn sets the key column (1-based) of the row labels referenced by @{label} in TBLFM formulas
+// (see tblfm.WithLabelColumn). It takes precedence over the "label" option of an "#+OPTIONS:" directive.
+var WithLabelColumn = funcopt.New(func(params *tblcalcParams, col int) {
+	params.labelColumn = col
+})
+
+// WithCreateColumns makes TBLFM formulas create the target columns given by header names
+// that are not in the table (see tblfm.WithCreateColumns).
+// The "create" option of an "#+OPTIONS:" directive also enables it.
+var WithCreateColumns = funcopt.New(func(params *tblcalcParams, create bool) {
+	params.createColumns = create
+})
+
+// WithTrace logs each evaluation of a TBLFM formula to w (see tblfm.WithTrace),
+// prefixed with the file name like "sales.csv: ". A stream is shown as "<stdin>".
+var WithTrace = funcopt.New(func(params *tblcalcParams, w io.Writer) {
+	params.trace = w
+})
+
+// WithTraceFilter limits the trace to the evaluations for which filter returns true (see tblfm.WithTraceFilter).
+// The index is the position (0-based) of the formula among those of the file, in the order they are read.
+var WithTraceFilter = funcopt.New(func(params *tblcalcParams, filter func(index, row, col int) bool) {
+	params.traceFilter = filter
+})
+
+// WithFunctions registers Go functions that TBLFM formulas can call by name (see tblfm.WithFunction).
+// It can be given more than once; a later function replaces an earlier one with the same name.
+var WithFunctions = funcopt.New(func(params *tblcalcParams, functions map[string]func(args []tblfm.Value) (tblfm.Value, error)) {
+	params.functions = maps.Clone(params.functions)
+	if params.functions == nil {
+		params.functions = make(map[string]func(args []tblfm.Value) (tblfm.Value, error))
+	}
+	maps.Copy(params.functions, functions)
+})
+
+// withRemoteChain sets the files whose remote() references led to the file being processed.
+var withRemoteChain = funcopt.New(func(params *tblcalcParams, chain []string) {
+	params.remoteChain = chain
+})
+
 var WithFormulas = funcopt.New(func(params *tblcalcParams, formulas []string) {
+	for _, formula := range formulas {
+		params.formulas = append(params.formulas, locatedFormula{text: formula})
+	}
+})
+
+// withLocatedFormulas adds formulas read from a file, such as a .tblfm sidecar file.
+var withLocatedFormulas = funcopt.New(func(params *tblcalcParams, formulas []locatedFormula) {
 	params.formulas = append(params.formulas, formulas...)
 })
 
+// withLuaChunks adds Lua code run before the formulas, such as the contents of a .lua sidecar file.
+var withLuaChunks = funcopt.New(func(params *tblcalcParams, chunks []luaChunk) {
+	params.luaChunks = append(params.luaChunks, chunks...)
+})
+
+// luaChunk is Lua code with the name shown in its error messages.
+type luaChunk struct {
+	name string // File the code is read from
+	code string
+}
+
+// locatedFormula is a formula with the position it is written at.
+type locatedFormula struct {
+	text string
+	file string // File the formula is written in ("" for a stream)
+	line int    // Line in the file (1-based), or 0 if the formula is not from a file
+}
+
+// DirectiveError is an error caused by a directive, such as a "#+TBLFM:" comment line
+// or a formula in a .tblfm sidecar file, with the position of the directive.
+// For a formula, Err is a *tblfm.FormulaError with the details of the evaluation.
+type DirectiveError struct {
+	File      string // File the directive is written in ("" for a stream)
+	Line      int    // Line of the directive (1-based)
+	Directive string // Text of the directive
+	Err       error  // Underlying error
+}
+
+// Error returns the message in the compiler-style format "file:line: message",
+// which editors can jump to. A stream is shown as "<stdin>". Only the first line
+// of the underlying error is included, so the message is a single line.
+func (e *DirectiveError) Error() string {
+	file := e.File
+	if file == "" {
+		file = "<stdin>"
+	}
+	msg, _, _ := strings.Cut(e.Err.Error(), "\n")
+	return fmt.Sprintf("%s:%d: %s", file, e.Line, msg)
+}
+
+// Unwrap returns the underlying error.
+func (e *DirectiveError) Unwrap() error {
+	return e.Err
+}
+
 var WithScripts = funcopt.New(func(params *tblcalcParams, scripts []string) {
-	params.scripts = append(params.scripts, scripts...)
+	for _, script := range scripts {
+		params.mlrSteps = append(params.mlrSteps, mlrStep{script: script})
+	}
+})
+
+// withMlrSteps adds Miller scripts and chains of verbs read from files, such as .mlr and
+// .mlr-verb sidecar files. The chains are parsed by mlr.ParseVerbChain.
+var withMlrSteps = funcopt.New(func(params *tblcalcParams, steps []mlrStep) {
+	params.mlrSteps = append(params.mlrSteps, steps...)
 })
 
 // process is an internal function that handles both file and stream processing.
 // If nullableReader is nil, it reads from filepath; otherwise it reads from the reader.
 func process(
+	ctx context.Context,
 	filepath string,
 	nullableReader io.Reader,
 	inputFormat InputFormat,
@@ -96,6 +301,8 @@ func process(
 	if err != nil {
 		return
 	}
+	// Options for the files referenced by remote(), before the directives of this file are applied
+	remoteParams := params
 	reader := nullableReader
 	if reader == nil {
 		inFile, err2 := os.Open(filepath)
@@ -105,12 +312,18 @@ func process(
 		defer (func() { Must(inFile.Close()) })()
 		reader = inFile
 	}
-	formulas := params.formulas
-	scripts := params.scripts
+	// Formulas and scripts given by options and sidecar files run first, then the directives in the order they appear
+	stages := &pipeline{ignoreExit: params.ignoreExit}
+	stages.addFormulas(params.formulas...)
+	stages.addSteps(params.mlrSteps...)
+	var fileOpts fileOptions
+	// Lua code of the "#+LUA:" directives at the index of their line (0-based), so that
+	// the line numbers in Lua error messages are those of the file
+	var luaLines []string
 	// Use bufio.Reader to read line by line
 	bufReader := bufio.NewReader(reader)
 	var commentBlock strings.Builder
-	for {
+	for lineNum := 1; ; lineNum++ {
 		line, err := bufReader.ReadString('\n')
 		if err != nil && err != io.EOF {
 			return err
@@ -123,42 +336,530 @@ func process(
 		line = strings.TrimSpace(line)
 		if matches := commentFormulaRe().FindStringSubmatch(line); matches != nil {
 			formula := matches[commentFormulaIdx]
-			formulas = append(formulas, formula)
+			stages.addFormulas(locatedFormula{text: formula, file: filepath, line: lineNum})
 		} else if matches := commentScriptRe().FindStringSubmatch(line); matches != nil {
 			script := matches[commentScriptIdx]
-			scripts = append(scripts, script)
+			stages.addSteps(mlrStep{script: script, file: filepath, line: lineNum})
+		} else if matches := commentVerbRe().FindStringSubmatch(line); matches != nil {
+			chain, err := mlr.ParseVerbChain(matches[commentVerbIdx])
+			if err != nil {
+				return &DirectiveError{
+					File:      filepath,
+					Line:      lineNum,
+					Directive: line,
+					Err:       fmt.Errorf("invalid directive %q: %w", line, err),
+				}
+			}
+			stages.addSteps(mlrStep{verbs: chain, file: filepath, line: lineNum})
+		} else if matches := commentLuaRe().FindStringSubmatch(line); matches != nil {
+			for len(luaLines) < lineNum-1 {
+				luaLines = append(luaLines, "")
+			}
+			luaLines = append(luaLines, matches[commentLuaIdx])
+		} else if matches := commentOptionsRe().FindStringSubmatch(line); matches != nil {
+			if err := parseOptionsDirective(matches[commentOptionsIdx], &fileOpts); err != nil {
+				return &DirectiveError{
+					File:      filepath,
+					Line:      lineNum,
+					Directive: line,
+					Err:       fmt.Errorf("invalid directive %q: %w", line, err),
+				}
+			}
 		}
 	}
+	if len(luaLines) > 0 {
+		name := filepath
+		if name == "" {
+			name = "<stdin>"
+		}
+		params.luaChunks = append(params.luaChunks, luaChunk{name: name, code: strings.Join(luaLines, "\n")})
+	}
+	// Options given explicitly take precedence over the directives
+	if params.iterate == 0 {
+		params.iterate = fileOpts.iterate
+	}
+	params.decimal = params.decimal || fileOpts.decimal
+	if params.empty == nil {
+		params.empty = fileOpts.empty
+	}
+	if params.nilResult == nil {
+		params.nilResult = fileOpts.nilResult
+	}
+	if params.labelColumn == 0 {
+		params.labelColumn = fileOpts.labelColumn
+	}
+	if params.headerRows == nil {
+		params.headerRows = fileOpts.headerRows
+	}
+	params.createColumns = params.createColumns || fileOpts.createColumns
 	// Reconstruct reader with comment block and remaining content
 	reader = io.MultiReader(
 		strings.NewReader(commentBlock.String()),
 		bufReader,
 	)
-	if len(formulas) > 0 {
-		return processWithTBLFMLib(reader, inputFormat, writer, outputFormat, formulas, params.ignoreExit)
-	} else if len(scripts) > 0 {
-		// If input-stream is passed, write it to temporary file and pass to library function.
-		if nullableReader != nil {
-			inFile, err := os.CreateTemp("", "tblcalc-*")
+	tblfmOpts := append(params.tblfmOptions(), tblfm.WithRemoteTable(remoteParams.remoteLoader(ctx, filepath)))
+	if params.trace != nil {
+		name := filepath
+		if name == "" {
+			name = "<stdin>"
+		}
+		tblfmOpts = append(tblfmOpts, tblfm.WithTrace(&prefixWriter{w: params.trace, prefix: name + ": "}))
+	}
+	if len(stages.stages) == 0 {
+		// Without directives, the table is only converted into the output format
+		return processWithTBLFMLib(ctx, reader, inputFormat, writer, outputFormat, nil, tblfmOpts)
+	}
+	// Run the stages, passing the table between them in the input format
+	numFormulas := 0
+	for i, stage := range stages.stages {
+		stageWriter, stageOutputFormat := writer, outputFormat
+		var stageOutput bytes.Buffer
+		if i < len(stages.stages)-1 {
+			stageWriter, stageOutputFormat = &stageOutput, outputFormatOf(inputFormat)
+		}
+		if stage.mlr {
+			err = processStreamWithMlr(ctx, reader, inputFormat, stageWriter, stageOutputFormat, stage.verbChain(), params.numHeaderRows())
 			if err != nil {
-				return fmt.Errorf("failed to create temp file: %w", err)
+				err = stage.locateError(ctx, err)
 			}
-			defer (func() {
-				Ignore(inFile.Close())
-				Must(os.Remove(inFile.Name()))
-			})()
-			Must(io.Copy(inFile, reader))
-			Must(inFile.Close())
-			filepath = inFile.Name()
+		} else {
+			err = params.processStage(ctx, reader, inputFormat, stageWriter, stageOutputFormat, stage.formulas, numFormulas, tblfmOpts)
+			numFormulas += len(stage.formulas)
+		}
+		if err != nil {
+			return
 		}
-		return processWithMlr(filepath, inputFormat, writer, outputFormat, scripts, params.ignoreExit)
+		reader = &stageOutput
 	}
 	return
 }
 
+// stage is a step of the processing pipeline, which runs either TBLFM formulas or Miller scripts and verbs.
+type stage struct {
+	mlr      bool             // Whether the stage runs Miller instead of TBLFM formulas
+	formulas []locatedFormula // TBLFM formulas
+	steps    []mlrStep        // Miller scripts and verbs
+}
+
+// mlrStep is either a Miller script or a chain of Miller verbs, with the position it is written at.
+type mlrStep struct {
+	script string
+	verbs  []string // Chain of verbs, or nil for a script
+	file   string   // File the step is written in ("" for a stream)
+	line   int      // Line in the file (1-based), or 0 if the step is not from a file
+}
+
+// text returns the step as it is written.
+func (step *mlrStep) text() string {
+	if step.verbs == nil {
+		return step.script
+	}
+	return strings.Join(step.verbs, " ")
+}
+
+// verbChain returns the chain of Miller verbs that runs the steps of the stage.
+// Consecutive scripts form a single put verb, as they do in a .mlr file.
+func (s *stage) verbChain() (chain []string) {
+	var scripts []string
+	flush := func() {
+		if len(scripts) == 0 {
+			return
+		}
+		if len(chain) > 0 {
+			chain = append(chain, "then")
+		}
+		chain = append(chain, mlr.PutVerb(scripts)...)
+		scripts = nil
+	}
+	for _, step := range s.steps {
+		if step.verbs == nil {
+			scripts = append(scripts, step.script)
+			continue
+		}
+		flush()
+		if len(chain) > 0 {
+			chain = append(chain, "then")
+		}
+		chain = append(chain, step.verbs...)
+	}
+	flush()
+	return
+}
+
+// pipeline is a sequence of stages. Consecutive formulas, or consecutive scripts and verbs, form a single stage.
+type pipeline struct {
+	stages     []stage
+	ignoreExit bool
+	exited     bool // Whether an "exit" formula or script has ended the pipeline
+}
+
+// isExit reports whether a formula or script is "exit", which ends the pipeline unless exits are ignored.
+func (p *pipeline) isExit(text string) bool {
+	if strings.TrimSpace(text) != "exit" {
+		return false
+	}
+	p.exited = p.exited || !p.ignoreExit
+	return true
+}
+
+// addFormulas adds TBLFM formulas to the pipeline.
+func (p *pipeline) addFormulas(formulas ...locatedFormula) {
+	for _, formula := range formulas {
+		if p.exited || p.isExit(formula.text) {
+			continue
+		}
+		if n := len(p.stages); n == 0 || p.stages[n-1].mlr {
+			p.stages = append(p.stages, stage{})
+		}
+		last := &p.stages[len(p.stages)-1]
+		last.formulas = append(last.formulas, formula)
+	}
+}
+
+// addSteps adds Miller scripts and chains of verbs to the pipeline.
+func (p *pipeline) addSteps(steps ...mlrStep) {
+	for _, step := range steps {
+		if p.exited || (step.verbs == nil && p.isExit(step.script)) {
+			continue
+		}
+		if n := len(p.stages); n == 0 || !p.stages[n-1].mlr {
+			p.stages = append(p.stages, stage{mlr: true})
+		}
+		last := &p.stages[len(p.stages)-1]
+		last.steps = append(last.steps, step)
+	}
+}
+
+// locateError attributes a Miller command-line error of the stage to the step it is caused by,
+// the first one whose chain fails when checked together with the steps before it.
+// The error is returned as a *DirectiveError if that step is written in a file or stream.
+func (s *stage) locateError(ctx context.Context, err error) error {
+	var cmdErr *mlr.CommandLineError
+	if !errors.As(err, &cmdErr) {
+		return err
+	}
+	for i := range s.steps {
+		leading := stage{mlr: true, steps: s.steps[:i+1]}
+		if !errors.As(mlr.CheckVerbChain(ctx, leading.verbChain()), new(*mlr.CommandLineError)) {
+			continue
+		}
+		step := &s.steps[i]
+		if step.line == 0 {
+			return err
+		}
+		return &DirectiveError{File: step.file, Line: step.line, Directive: step.text(), Err: cmdErr}
+	}
+	return err
+}
+
+// processStage applies the formulas of a TBLFM stage. offset is the number of formulas
+// in the preceding stages, so that the trace filter sees the position of a formula in the file.
+// Formula errors are attributed to the directives the formulas are written in.
+func (params *tblcalcParams) processStage(
+	ctx context.Context,
+	reader io.Reader,
+	inputFormat InputFormat,
+	writer io.Writer,
+	outputFormat OutputFormat,
+	formulas []locatedFormula,
+	offset int,
+	opts []tblfm.Option,
+) error {
+	if filter := params.traceFilter; filter != nil {
+		opts = append(slices.Clip(opts), tblfm.WithTraceFilter(func(index, row, col int) bool {
+			return filter(offset+index, row, col)
+		}))
+	}
+	texts := make([]string, len(formulas))
+	for i, formula := range formulas {
+		texts[i] = formula.text
+	}
+	err := processWithTBLFMLib(ctx, reader, inputFormat, writer, outputFormat, texts, opts)
+	var formulaErr *tblfm.FormulaError
+	if errors.As(err, &formulaErr) && formulaErr.Index < len(formulas) {
+		if formula := formulas[formulaErr.Index]; formula.line > 0 {
+			return &DirectiveError{
+				File:      formula.file,
+				Line:      formula.line,
+				Directive: formula.text,
+				Err:       formulaErr,
+			}
+		}
+	}
+	return err
+}
+
+// outputFormatOf returns the output format that writes the same format as inputFormat.
+func outputFormatOf(inputFormat InputFormat) OutputFormat {
+	if inputFormat == InputFormatTSV {
+		return OutputFormatTSV
+	}
+	return OutputFormatCSV
+}
+
+// tblfmOptions returns the options for tblfm.Apply derived from params.
+func (params *tblcalcParams) tblfmOptions() (opts []tblfm.Option) {
+	if params.ignoreExit {
+		opts = append(opts, tblfm.WithIgnoreExit(true))
+	}
+	if params.asWrittenOrder {
+		opts = append(opts, tblfm.WithAsWrittenOrder(true))
+	}
+	if params.iterate > 0 {
+		opts = append(opts, tblfm.WithIterate(params.iterate))
+	}
+	if params.decimal {
+		opts = append(opts, tblfm.WithDecimal(true))
+	}
+	if params.now != nil {
+		opts = append(opts, tblfm.WithNow(params.now))
+	}
+	if params.unsafeLua {
+		opts = append(opts, tblfm.WithUnsafeLua(true))
+	}
+	if params.timeout > 0 {
+		opts = append(opts, tblfm.WithTimeout(params.timeout))
+	}
+	if params.empty != nil {
+		opts = append(opts, tblfm.WithEmpty(*params.empty))
+	}
+	if params.nilResult != nil {
+		opts = append(opts, tblfm.WithNilResult(*params.nilResult))
+	}
+	if params.labelColumn > 0 {
+		opts = append(opts, tblfm.WithLabelColumn(params.labelColumn))
+	}
+	if params.headerRows != nil {
+		opts = append(opts, tblfm.WithHeaderRows(*params.headerRows))
+	}
+	if params.createColumns {
+		opts = append(opts, tblfm.WithCreateColumns(true))
+	}
+	for _, name := range slices.Sorted(maps.Keys(params.functions)) {
+		opts = append(opts, tblfm.WithFunction(name, params.functions[name]))
+	}
+	for _, chunk := range params.luaChunks {
+		opts = append(opts, tblfm.WithLuaChunk(chunk.name, chunk.code))
+	}
+	return
+}
+
+// numHeaderRows returns the number of header rows, which is 1 unless it is given.
+func (params *tblcalcParams) numHeaderRows() int {
+	if params.headerRows == nil {
+		return 1
+	}
+	return *params.headerRows
+}
+
+// remoteLoader returns the function that loads the tables referenced by remote(name, ref)
+// in the formulas of filePath. Names are paths relative to the directory of filePath,
+// or to the current directory for streams. Each referenced file is processed like
+// ProcessFile, so its own formulas are applied first, and a file that references
+// itself through other files is reported as a cycle. The table has the header rows
+// given by the "header" option of its own "#+OPTIONS:" directives, unless given
+// explicitly, and the hlines of its own hline comments.
+func (params *tblcalcParams) remoteLoader(ctx context.Context, filePath string) func(name string) (*tblfm.RemoteTable, error) {
+	dir := "."
+	chain := params.remoteChain
+	if filePath != "" {
+		dir = filepath.Dir(filePath)
+		if absPath, err := filepath.Abs(filePath); err == nil {
+			chain = append(slices.Clone(chain), absPath)
+		}
+	}
+	return func(name string) (*tblfm.RemoteTable, error) {
+		remotePath := name
+		if !filepath.IsAbs(remotePath) {
+			remotePath = filepath.Join(dir, remotePath)
+		}
+		// In the sandbox, a table can only read the files in its directory and below
+		if !params.unsafeLua {
+			rel, err := filepath.Rel(dir, remotePath)
+			if filepath.IsAbs(name) || err != nil || !filepath.IsLocal(rel) {
+				return nil, fmt.Errorf("remote file %q is outside the directory of the table (allowed with unsafe Lua)", name)
+			}
+		}
+		absPath, err := filepath.Abs(remotePath)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(chain, absPath) {
+			var names []string
+			for _, p := range append(chain, absPath) {
+				names = append(names, filepath.Base(p))
+			}
+			return nil, fmt.Errorf("remote reference cycle: %s", strings.Join(names, " -> "))
+		}
+		inputFormat, outputFormat := InputFormatCSV, OutputFormatCSV
+		if strings.ToLower(filepath.Ext(remotePath)) == ".tsv" {
+			inputFormat, outputFormat = InputFormatTSV, OutputFormatTSV
+		}
+		opts := Options{
+			WithIgnoreExit(params.ignoreExit),
+			WithAsWrittenOrder(params.asWrittenOrder),
+			WithIterate(params.iterate),
+			WithDecimal(params.decimal),
+			WithNow(params.now),
+			WithUnsafeLua(params.unsafeLua),
+			WithTimeout(params.timeout),
+			WithLabelColumn(params.labelColumn),
+			WithCreateColumns(params.createColumns),
+			WithTrace(params.trace),
+			WithTraceFilter(params.traceFilter),
+			WithFunctions(params.functions),
+			withRemoteChain(chain),
+		}
+		if params.empty != nil {
+			opts = append(opts, WithEmpty(*params.empty))
+		}
+		if params.nilResult != nil {
+			opts = append(opts, WithNilResult(*params.nilResult))
+		}
+		if params.headerRows != nil {
+			opts = append(opts, WithHeaderRows(*params.headerRows))
+		}
+		var output bytes.Buffer
+		err = ProcessFileContext(ctx, remotePath, inputFormat, &output, outputFormat, opts...)
+		if err != nil {
+			return nil, err
+		}
+		var table [][]string
+		commentLines := make(map[int]string)
+		onComment := func(lineNum int, line string) {
+			commentLines[lineNum] = line
+		}
+		var recordsSeq iter.Seq[[]string]
+		switch inputFormat {
+		case InputFormatCSV:
+			recordsSeq = csvRecordsSeq(&output, onComment)
+		case InputFormatTSV:
+			recordsSeq = tsvRecordsSeq(&output, onComment)
+		}
+		for record := range recordsSeq {
+			table = append(table, record)
+		}
+		// The directives are in the comment lines before the table, as in process
+		var fileOpts fileOptions
+		for lineNum := 0; ; lineNum++ {
+			line, ok := commentLines[lineNum]
+			if !ok {
+				break
+			}
+			if matches := commentOptionsRe().FindStringSubmatch(strings.TrimSpace(line)); matches != nil {
+				// The file has been processed, so the directive is valid
+				Ignore(parseOptionsDirective(matches[commentOptionsIdx], &fileOpts))
+			}
+		}
+		headerRows := 1
+		if params.headerRows != nil {
+			headerRows = *params.headerRows
+		} else if fileOpts.headerRows != nil {
+			headerRows = *fileOpts.headerRows
+		}
+		return &tblfm.RemoteTable{
+			Rows:       table,
+			HeaderRows: headerRows,
+			Hlines:     hlinePositions(commentLines),
+		}, nil
+	}
+}
+
+// prefixWriter writes the data of each Write call prefixed with prefix.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+}
+
+// Write writes the prefix and p in a single Write call to the underlying writer.
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	if _, err := pw.w.Write(append([]byte(pw.prefix), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fileOptions holds the options given by "#+OPTIONS:" directives in the input.
+type fileOptions struct {
+	iterate       int
+	decimal       bool
+	empty         *tblfm.EmptyMode
+	nilResult     *tblfm.NilResultMode
+	labelColumn   int
+	createColumns bool
+	headerRows    *int
+}
+
+// parseOptionsDirective parses the value of an "#+OPTIONS:" directive,
+// which is a space-separated list of "key:value" pairs like "iterate:10 decimal:t empty:nil nil:keep label:2 create:t header:2".
+func parseOptionsDirective(value string, fileOpts *fileOptions) error {
+	for field := range strings.FieldsSeq(value) {
+		key, val, _ := strings.Cut(field, ":")
+		switch key {
+		case "iterate":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid value for option %q: %q", key, val)
+			}
+			fileOpts.iterate = n
+		case "decimal":
+			switch val {
+			case "t", "true":
+				fileOpts.decimal = true
+			case "nil", "false":
+				fileOpts.decimal = false
+			default:
+				return fmt.Errorf("invalid value for option %q: %q", key, val)
+			}
+		case "empty":
+			mode, err := tblfm.ParseEmptyMode(val)
+			if err != nil {
+				return fmt.Errorf("invalid value for option %q: %w", key, err)
+			}
+			fileOpts.empty = &mode
+		case "nil":
+			mode, err := tblfm.ParseNilResultMode(val)
+			if err != nil {
+				return fmt.Errorf("invalid value for option %q: %w", key, err)
+			}
+			fileOpts.nilResult = &mode
+		case "label":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid value for option %q: %q", key, val)
+			}
+			fileOpts.labelColumn = n
+		case "create":
+			switch val {
+			case "t", "true":
+				fileOpts.createColumns = true
+			case "nil", "false":
+				fileOpts.createColumns = false
+			default:
+				return fmt.Errorf("invalid value for option %q: %q", key, val)
+			}
+		case "header":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid value for option %q: %q", key, val)
+			}
+			fileOpts.headerRows = &n
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return nil
+}
+
 // ProcessStream reads data from reader, applies table formulas found in comment lines,
 // and writes the result to writer. Comment lines starting with "# +TBLFM:" contain
-// formulas that are applied to the table data. The input and output formats are
+// formulas that are applied to the table data, after running the Lua code of comment lines
+// starting with "#+LUA:", comment lines starting with "#+MLR:" contain Miller scripts, and
+// comment lines starting with "#+MLR-VERB:" contain chains of Miller verbs like "sort -f Date".
+// Formulas, scripts and verbs run as a pipeline in the order they appear: consecutive formulas,
+// or consecutive scripts and verbs, form a stage whose output table is the input of the next stage.
+// Comment lines stay at their lines even if a verb reorders or drops the records.
+// Those given by WithFormulas and WithScripts run first. The input and output formats are
 // specified by inputFormat and outputFormat parameters.
 func ProcessStream(
 	reader io.Reader,
@@ -167,20 +868,37 @@ func ProcessStream(
 	outputFormat OutputFormat,
 	opts ...funcopt.Option[tblcalcParams],
 ) error {
-	return process("", reader, inputFormat, writer, outputFormat, opts...)
+	return ProcessStreamContext(context.Background(), reader, inputFormat, writer, outputFormat, opts...)
+}
+
+// ProcessStreamContext is like ProcessStream but stops processing when ctx is done.
+// Both Lua formulas and Miller scripts are stopped, and the returned error wraps ctx.Err().
+func ProcessStreamContext(
+	ctx context.Context,
+	reader io.Reader,
+	inputFormat InputFormat,
+	writer io.Writer,
+	outputFormat OutputFormat,
+	opts ...funcopt.Option[tblcalcParams],
+) error {
+	return process(ctx, "", reader, inputFormat, writer, outputFormat, opts...)
 }
 
 // ProcessFile reads data from filepath, applies table formulas found in comment lines,
 // and writes the result to writer. Comment lines starting with "# +TBLFM:" contain
 // formulas that are applied to the table data. The input and output formats are
 // specified by inputFormat and outputFormat parameters.
-// External files with extensions .skip, .tblfm, .mlr are searched in the same directory.
+// External files with extensions .skip, .tblfm, .lua, .mlr, .mlr-verb are searched in the same directory.
 // The "%" character in these filenames acts as a wildcard (like SQL LIKE).
 // For example, "foo%baz.csv.skip" matches "foo-bar-baz.csv".
 // If a matching .skip file exists, no formulas or scripts are applied.
 // If a matching .tblfm file exists, its contents are parsed as formulas
-// (split by newlines and "::"). Similarly, if a matching .mlr file exists,
-// its contents are used as a Miller script.
+// (split by newlines and "::"). If a matching .lua file exists, it is run before the
+// formulas, like the Lua code of "#+LUA:" comment lines. Similarly, if a matching .mlr file exists,
+// its contents are used as a Miller script, and if a matching .mlr-verb file exists, its contents
+// are used as a chain of Miller verbs. As in ProcessStream, the formulas, scripts and verbs run as
+// a pipeline: those of .tblfm files first, then those of .mlr files, then those of .mlr-verb files,
+// then the directives in the file.
 func ProcessFile(
 	filePath string,
 	inputFormat InputFormat,
@@ -189,6 +907,21 @@ func ProcessFile(
 	opts ...funcopt.Option[tblcalcParams],
 ) (
 	err error,
+) {
+	return ProcessFileContext(context.Background(), filePath, inputFormat, writer, outputFormat, opts...)
+}
+
+// ProcessFileContext is like ProcessFile but stops processing when ctx is done.
+// Both Lua formulas and Miller scripts are stopped, and the returned error wraps ctx.Err().
+func ProcessFileContext(
+	ctx context.Context,
+	filePath string,
+	inputFormat InputFormat,
+	writer io.Writer,
+	outputFormat OutputFormat,
+	opts ...funcopt.Option[tblcalcParams],
+) (
+	err error,
 ) {
 	dir := filepath.Dir(filePath)
 	base := filepath.Base(filePath)
@@ -203,29 +936,55 @@ func ProcessFile(
 		}
 	}
 	// Load formulas from matching .tblfm file
-	var formulas []string
+	var formulas []locatedFormula
 	for _, tblfmFile := range findMatchingFiles(dir, base, ".tblfm") {
 		if content, err := os.ReadFile(tblfmFile); err == nil {
-			formulas = append(formulas, splitFormulas(string(content))...)
+			texts, lines := splitFormulas(string(content))
+			for i, text := range texts {
+				formulas = append(formulas, locatedFormula{text: text, file: tblfmFile, line: lines[i]})
+			}
 		}
 	}
 	if len(formulas) > 0 {
-		opts = append(opts, WithFormulas(formulas))
+		opts = append(opts, withLocatedFormulas(formulas))
+	}
+	// Load Lua chunks from matching .lua files
+	var luaChunks []luaChunk
+	for _, luaFile := range findMatchingFiles(dir, base, ".lua") {
+		if content, err := os.ReadFile(luaFile); err == nil {
+			luaChunks = append(luaChunks, luaChunk{name: luaFile, code: string(content)})
+		}
+	}
+	if len(luaChunks) > 0 {
+		opts = append(opts, withLuaChunks(luaChunks))
 	}
 	// Load script from matching .mlr file
-	var scripts []string
+	var mlrSteps []mlrStep
 	for _, mlrFile := range findMatchingFiles(dir, base, ".mlr") {
 		if content, err := os.ReadFile(mlrFile); err == nil {
 			script := strings.TrimSpace(string(content))
 			if script != "" {
-				scripts = append(scripts, script)
+				mlrSteps = append(mlrSteps, mlrStep{script: script, file: mlrFile, line: 1})
+			}
+		}
+	}
+	// Load chains of verbs from matching .mlr-verb files
+	for _, verbFile := range findMatchingFiles(dir, base, ".mlr-verb") {
+		if content, err := os.ReadFile(verbFile); err == nil {
+			texts, lines := splitVerbChains(string(content))
+			for i, text := range texts {
+				chain, err := mlr.ParseVerbChain(text)
+				if err != nil {
+					return &DirectiveError{File: verbFile, Line: lines[i], Directive: text, Err: err}
+				}
+				mlrSteps = append(mlrSteps, mlrStep{verbs: chain, file: verbFile, line: lines[i]})
 			}
 		}
 	}
-	if len(scripts) > 0 {
-		opts = append(opts, WithScripts(scripts))
+	if len(mlrSteps) > 0 {
+		opts = append(opts, withMlrSteps(mlrSteps))
 	}
-	return process(filePath, nil, inputFormat, writer, outputFormat, opts...)
+	return process(ctx, filePath, nil, inputFormat, writer, outputFormat, opts...)
 }
 
 // findMatchingFiles searches for files in dir that match the target filename
@@ -283,17 +1042,47 @@ func matchWildcard(pattern, target string) bool {
 }
 
 // splitFormulas splits content by newlines and "::" separator.
-func splitFormulas(content string) []string {
-	var result []string
+// It also returns the line (1-based) each formula is on.
+func splitFormulas(content string) (formulas []string, lines []int) {
+	lineNum := 0
 	for line := range strings.SplitSeq(content, "\n") {
+		lineNum++
 		for part := range strings.SplitSeq(line, "::") {
 			part = strings.TrimSpace(part)
 			if part != "" {
-				result = append(result, part)
+				formulas = append(formulas, part)
+				lines = append(lines, lineNum)
 			}
 		}
 	}
-	return result
+	return
+}
+
+// splitVerbChains splits the content of a .mlr-verb file into chains of verbs, separated
+// by blank lines. A chain may span lines; lines starting with "#" are comments.
+// lines holds the line (1-based) each chain starts at.
+func splitVerbChains(content string) (chains []string, lines []int) {
+	var chain []string
+	lineNum := 0
+	for line := range strings.SplitSeq(content+"\n", "\n") {
+		lineNum++
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line != "" {
+			if len(chain) == 0 {
+				lines = append(lines, lineNum)
+			}
+			chain = append(chain, line)
+			continue
+		}
+		if len(chain) > 0 {
+			chains = append(chains, strings.Join(chain, " "))
+			chain = nil
+		}
+	}
+	return
 }
 
 func csvRecordsSeq(
@@ -357,12 +1146,13 @@ func tsvRecordsSeq(
 }
 
 func processWithTBLFMLib(
+	ctx context.Context,
 	reader io.Reader,
 	inputFormat InputFormat,
 	writer io.Writer,
 	outputFormat OutputFormat,
 	formulas []string,
-	ignoreExit bool,
+	opts []tblfm.Option,
 ) (
 	err error,
 ) {
@@ -381,13 +1171,12 @@ func processWithTBLFMLib(
 	for record := range recordsSeq {
 		table = append(table, record)
 	}
-	var opts []tblfm.Option
-	if ignoreExit {
-		opts = append(opts, tblfm.WithIgnoreExit(true))
+	if hlines := hlinePositions(commentLines); len(hlines) > 0 {
+		opts = append(opts, tblfm.WithHlines(hlines))
 	}
 	// Apply formulas
-	if table, err = tblfm.Apply(table, formulas, opts...); err != nil {
-		return fmt.Errorf("failed to apply formulas: %v", err)
+	if table, err = tblfm.ApplyContext(ctx, table, formulas, opts...); err != nil {
+		return fmt.Errorf("failed to apply formulas: %w", err)
 	}
 	// Write output with comments preserved
 	switch outputFormat {
@@ -399,6 +1188,23 @@ func processWithTBLFMLib(
 	return
 }
 
+// hlinePositions returns the positions of hline comments (see hlineCommentRe)
+// as the 0-based indices of the table rows that follow them.
+func hlinePositions(commentLines map[int]string) (hlines []int) {
+	lineNums := make([]int, 0, len(commentLines))
+	for lineNum := range commentLines {
+		lineNums = append(lineNums, lineNum)
+	}
+	sort.Ints(lineNums)
+	for i, lineNum := range lineNums {
+		if hlineCommentRe().MatchString(commentLines[lineNum]) {
+			// Lines before this one that are not comments are table rows
+			hlines = append(hlines, lineNum-i)
+		}
+	}
+	return
+}
+
 func writeCSV(writer io.Writer, table [][]string, commentLines map[int]string) error {
 	csvWriter := csv.NewWriter(writer)
 	defer csvWriter.Flush()
@@ -451,13 +1257,137 @@ func writeTSV(writer io.Writer, table [][]string, commentLines map[int]string) e
 	return nil
 }
 
+// processStreamWithMlr is like processWithMlr but reads the input from reader,
+// which is written to a temporary file for Miller.
+// Comment lines are kept out of Miller, which would move them to the top when
+// a verb like sort holds back the records, and are put back at their lines.
+// Of headerRows header rows, Miller takes the last one as its header, and the
+// rows above it are put back like comments, padded to the columns of the output.
+func processStreamWithMlr(
+	ctx context.Context,
+	reader io.Reader,
+	inputFormat InputFormat,
+	writer io.Writer,
+	outputFormat OutputFormat,
+	verbChain []string,
+	headerRows int,
+) error {
+	inFile, err := os.CreateTemp("", "tblcalc-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer (func() {
+		Ignore(inFile.Close())
+		Must(os.Remove(inFile.Name()))
+	})()
+	// Comment lines, and header rows above the last one, at the index of their line (0-based)
+	keptLines := make(map[int]string)
+	upperHeaders := make(map[int][]string)
+	numRecords := 0
+	bufReader := bufio.NewReader(reader)
+	for i := 0; ; i++ {
+		line, err := bufReader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.HasPrefix(line, "#") {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			keptLines[i] = line
+		} else if line != "" && numRecords < headerRows-1 {
+			record, err := parseRecordLine(line, inputFormat == InputFormatTSV)
+			if err != nil {
+				return fmt.Errorf("failed to read header row %d: %w", numRecords+1, err)
+			}
+			upperHeaders[i] = record
+			numRecords++
+		} else {
+			if _, err := io.WriteString(inFile, line); err != nil {
+				return fmt.Errorf("failed to write temp file: %w", err)
+			}
+			numRecords++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	Must(inFile.Close())
+	var output bytes.Buffer
+	if err := processWithMlr(ctx, inFile.Name(), inputFormat, &output, outputFormat, verbChain, headerRows > 0); err != nil {
+		return err
+	}
+	if len(upperHeaders) > 0 {
+		// Pad the rows to the header of Miller, which may have added columns
+		numCols := 0
+		if header, _, _ := strings.Cut(output.String(), "\n"); header != "" {
+			record, err := parseRecordLine(header, outputFormat == OutputFormatTSV)
+			if err != nil {
+				return fmt.Errorf("failed to read the header of Miller: %w", err)
+			}
+			numCols = len(record)
+		}
+		for i, record := range upperHeaders {
+			if len(record) < numCols {
+				record = append(record, make([]string, numCols-len(record))...)
+			}
+			var line bytes.Buffer
+			switch outputFormat {
+			case OutputFormatCSV:
+				err = writeCSV(&line, [][]string{record}, nil)
+			case OutputFormatTSV:
+				err = writeTSV(&line, [][]string{record}, nil)
+			}
+			if err != nil {
+				return err
+			}
+			keptLines[i] = line.String()
+		}
+	}
+	return writeWithComments(writer, output.String(), keptLines)
+}
+
+// parseRecordLine parses a line of CSV, or of TSV if tsv is true, into the fields of a record.
+func parseRecordLine(line string, tsv bool) ([]string, error) {
+	if tsv {
+		return strings.Split(strings.TrimRight(line, "\r\n"), "\t"), nil
+	}
+	return csv.NewReader(strings.NewReader(line)).Read()
+}
+
+// writeWithComments writes the lines of output with the comment lines put back at their
+// indices. The comment lines after the last line of output are written at the end.
+func writeWithComments(writer io.Writer, output string, commentLines map[int]string) error {
+	lines := strings.SplitAfter(output, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var buf strings.Builder
+	for i := 0; len(lines) > 0 || len(commentLines) > 0; i++ {
+		if comment, ok := commentLines[i]; ok {
+			buf.WriteString(comment)
+			delete(commentLines, i)
+			continue
+		}
+		if len(lines) > 0 {
+			buf.WriteString(lines[0])
+			lines = lines[1:]
+		}
+	}
+	if _, err := io.WriteString(writer, buf.String()); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
 func processWithMlr(
+	ctx context.Context,
 	inPath string,
 	inputFormat InputFormat,
 	writer io.Writer,
 	outputFormat OutputFormat,
-	scripts []string,
-	ignoreExit bool,
+	verbChain []string,
+	hasHeader bool,
 ) (
 	err error,
 ) {
@@ -475,18 +1405,6 @@ func processWithMlr(
 	case OutputFormatTSV:
 		outFmt = "tsv"
 	}
-	// Run Miller for each script
-	var mlrScripts []string
-	for _, script := range scripts {
-		if script == "exit" {
-			if ignoreExit {
-				continue
-			} else {
-				break
-			}
-		}
-		mlrScripts = append(mlrScripts, script)
-	}
 	resultFile, err := os.CreateTemp("", "tblcalc-*.csv")
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %w", err)
@@ -495,8 +1413,8 @@ func processWithMlr(
 		Ignore(resultFile.Close())
 		Ignore(os.Remove(resultFile.Name()))
 	})()
-	if len(mlrScripts) > 0 {
-		err = mlr.Put([]string{inPath}, mlrScripts, true, inFmt, outFmt, resultFile)
+	if len(verbChain) > 0 {
+		err = mlr.RunContext(ctx, []string{inPath}, verbChain, hasHeader, inFmt, outFmt, resultFile)
 		if err != nil {
 			return
 		}
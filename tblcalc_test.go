@@ -2,12 +2,17 @@ package tblcalc
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/knaka/go-utils/funcopt"
+	"github.com/knaka/tblcalc/tblfm"
 	"github.com/knaka/tblcalc/testdata"
 )
 
@@ -39,6 +44,11 @@ func TestExecute_CSV(t *testing.T) {
 			expected: testdata.Test3NotExitedCSV,
 			opts:     []funcopt.Option[tblcalcParams]{WithIgnoreExit(true)},
 		},
+		{
+			name:     "hline section references",
+			input:    testdata.Test4CSV,
+			expected: testdata.Test4ResultCSV,
+		},
 	}
 
 	for _, tt := range tests {
@@ -159,3 +169,1012 @@ func TestExecute_Ledger(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessFile_SidecarFormatModifiers(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "prices.csv")
+	input := "Item,Price,Qty,Total\nApple,11.1,3,\nOrange,2,5,\n"
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to write input file: %v", err)
+	}
+	if err := os.WriteFile(inputPath+".tblfm", []byte("$4=$2*$3;%.2f\n"), 0644); err != nil {
+		t.Fatalf("Failed to write tblfm file: %v", err)
+	}
+
+	var output bytes.Buffer
+	err := ProcessFile(inputPath, InputFormatCSV, &output, OutputFormatCSV)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := "Item,Price,Qty,Total\nApple,11.1,3,33.30\nOrange,2,5,10.00\n"
+	if output.String() != expected {
+		t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+	}
+}
+
+func TestProcessFile_Remote(t *testing.T) {
+	writeFile := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	t.Run("formulas of the remote file are applied first", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "shared", "rates.tsv"), "#+TBLFM: $3=$2*2\nCurrency\tRate\tDouble\nUSD\t150\t\n")
+		ledgerPath := filepath.Join(dir, "ledger.csv")
+		writeFile(t, ledgerPath, "#+TBLFM: $2=$1*remote(\"shared/rates.tsv\", @2${Double})\nAmount,Yen\n2,\n")
+
+		var output bytes.Buffer
+		if err := ProcessFile(ledgerPath, InputFormatCSV, &output, OutputFormatCSV); err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		expected := "#+TBLFM: $2=$1*remote(\"shared/rates.tsv\", @2${Double})\nAmount,Yen\n2,600\n"
+		if output.String() != expected {
+			t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+		}
+	})
+
+	t.Run("header rows and hlines of the remote file", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "rates.csv"), "#+OPTIONS: header:2\n,Q1\nCurrency,Rate\n#-\nUSD,150\nEUR,160\n")
+		ledgerPath := filepath.Join(dir, "ledger.csv")
+		content := "#+OPTIONS: header:0\n#+TBLFM: $2=$1*remote(\"rates.csv\", @I${Q1 Rate})\n#+TBLFM: $3=#remote(\"rates.csv\", ${Rate}..)\n2,,\n"
+		writeFile(t, ledgerPath, content)
+
+		var output bytes.Buffer
+		if err := ProcessFile(ledgerPath, InputFormatCSV, &output, OutputFormatCSV); err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		expected := strings.Replace(content, "2,,", "2,300,2", 1)
+		if output.String() != expected {
+			t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+		}
+	})
+
+	t.Run("cycle between files", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "a.csv"), "#+TBLFM: @2$1=remote(\"b.csv\", @2$1)\nValue\n1\n")
+		writeFile(t, filepath.Join(dir, "b.csv"), "#+TBLFM: @2$1=remote(\"a.csv\", @2$1)\nValue\n2\n")
+
+		var output bytes.Buffer
+		err := ProcessFile(filepath.Join(dir, "a.csv"), InputFormatCSV, &output, OutputFormatCSV)
+		if err == nil {
+			t.Fatalf("Execute expected error but got none")
+		}
+		if !strings.Contains(err.Error(), "remote reference cycle: a.csv -> b.csv -> a.csv") {
+			t.Errorf("Execute error %q does not contain the cycle", err.Error())
+		}
+	})
+
+	t.Run("files outside the directory of the table", func(t *testing.T) {
+		dir := t.TempDir()
+		outsidePath := filepath.Join(dir, "secret.csv")
+		writeFile(t, outsidePath, "Value\nsecret\n")
+		tableDir := filepath.Join(dir, "tables")
+		writeFile(t, filepath.Join(tableDir, "sub", "rates.csv"), "Value\n150\n")
+		for _, name := range []string{"../secret.csv", outsidePath, "sub/../../secret.csv"} {
+			tablePath := filepath.Join(tableDir, "table.csv")
+			writeFile(t, tablePath, "#+TBLFM: @2$1=remote(\""+name+"\", @2$1)\nValue,Other\n,1\n")
+			var output bytes.Buffer
+			err := ProcessFile(tablePath, InputFormatCSV, &output, OutputFormatCSV)
+			if err == nil || !strings.Contains(err.Error(), "is outside the directory of the table") {
+				t.Errorf("%s: expected an error for a file outside the directory, got %v", name, err)
+			}
+			if strings.Contains(output.String(), "secret") {
+				t.Errorf("%s: the file outside the directory was read:\n%s", name, output.String())
+			}
+
+			output.Reset()
+			if err := ProcessFile(tablePath, InputFormatCSV, &output, OutputFormatCSV, WithUnsafeLua(true)); err != nil {
+				t.Fatalf("%s: unsafe Lua allows files outside the directory, got %v", name, err)
+			}
+			if !strings.Contains(output.String(), "\nsecret,1\n") {
+				t.Errorf("%s: expected the file outside the directory with unsafe Lua, got:\n%s", name, output.String())
+			}
+		}
+
+		tablePath := filepath.Join(tableDir, "table.csv")
+		writeFile(t, tablePath, "#+TBLFM: @2$1=remote(\"sub/../sub/rates.csv\", @2$1)\nValue,Other\n,1\n")
+		var output bytes.Buffer
+		if err := ProcessFile(tablePath, InputFormatCSV, &output, OutputFormatCSV); err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		if expected := "#+TBLFM: @2$1=remote(\"sub/../sub/rates.csv\", @2$1)\nValue,Other\n150,1\n"; output.String() != expected {
+			t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+		}
+	})
+}
+
+func TestExecute_FormulaOrder(t *testing.T) {
+	input := `#+TBLFM: @>$2=vsum(@2..@>>)
+#+TBLFM: @2$2..@>>$2=$3*2
+Item,Amount,Base
+A,,1
+B,,2
+TOTAL,,
+`
+	tests := []struct {
+		name     string
+		expected string
+		opts     Options
+	}{
+		{
+			name: "dependency order",
+			expected: `#+TBLFM: @>$2=vsum(@2..@>>)
+#+TBLFM: @2$2..@>>$2=$3*2
+Item,Amount,Base
+A,2,1
+B,4,2
+TOTAL,6,
+`,
+		},
+		{
+			name: "as written order",
+			expected: `#+TBLFM: @>$2=vsum(@2..@>>)
+#+TBLFM: @2$2..@>>$2=$3*2
+Item,Amount,Base
+A,2,1
+B,4,2
+TOTAL,0,
+`,
+			opts: []funcopt.Option[tblcalcParams]{WithAsWrittenOrder(true)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Iterate(t *testing.T) {
+	const formulas = `#+TBLFM: @2$2=@3$2/2;%.2f
+#+TBLFM: @3$2=10-@2$2;%.2f
+`
+	const table = `Name,Value
+x,0
+y,0
+`
+	const converged = `Name,Value
+x,3.33
+y,6.67
+`
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		opts        Options
+		errorSubstr string
+	}{
+		{
+			name:     "options directive",
+			input:    "#+OPTIONS: iterate:20\n" + formulas + table,
+			expected: "#+OPTIONS: iterate:20\n" + formulas + converged,
+		},
+		{
+			name:     "option",
+			input:    formulas + table,
+			expected: formulas + converged,
+			opts:     []funcopt.Option[tblcalcParams]{WithIterate(20)},
+		},
+		{
+			name:        "option takes precedence over directive",
+			input:       "#+OPTIONS: iterate:20\n" + formulas + table,
+			opts:        []funcopt.Option[tblcalcParams]{WithIterate(3)},
+			errorSubstr: "did not converge after 3 iterations",
+		},
+		{
+			name:        "cycle without iteration",
+			input:       formulas + table,
+			errorSubstr: "reference cycle",
+		},
+		{
+			name:        "unknown option",
+			input:       "#+OPTIONS: iterat:20\n" + formulas + table,
+			errorSubstr: `unknown option "iterat"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Execute expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Execute error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Decimal(t *testing.T) {
+	const formulas = "#+TBLFM: @>$2=vsum(@2..@>>)\n"
+	const table = `Item,Amount
+A,0.1
+B,0.2
+Total,
+`
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		opts        Options
+		errorSubstr string
+	}{
+		{
+			name:     "float by default",
+			input:    formulas + table,
+			expected: formulas + strings.Replace(table, "Total,", "Total,0.30000000000000004", 1),
+		},
+		{
+			name:     "options directive",
+			input:    "#+OPTIONS: decimal:t\n" + formulas + table,
+			expected: "#+OPTIONS: decimal:t\n" + formulas + strings.Replace(table, "Total,", "Total,0.3", 1),
+		},
+		{
+			name:     "option",
+			input:    formulas + table,
+			expected: formulas + strings.Replace(table, "Total,", "Total,0.3", 1),
+			opts:     []funcopt.Option[tblcalcParams]{WithDecimal(true)},
+		},
+		{
+			name:        "invalid value",
+			input:       "#+OPTIONS: decimal:yes\n" + formulas + table,
+			errorSubstr: `invalid value for option "decimal": "yes"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Execute expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Execute error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Now(t *testing.T) {
+	input := "#+TBLFM: $2=daysdiff(today(), $1)\nDue,Days left\n2025-04-01,\n"
+	expected := "#+TBLFM: $2=daysdiff(today(), $1)\nDue,Days left\n2025-04-01,18\n"
+	var output bytes.Buffer
+	err := ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV,
+		WithNow(func() time.Time { return time.Date(2025, 3, 14, 23, 59, 0, 0, time.Local) }),
+	)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if output.String() != expected {
+		t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+	}
+}
+
+func TestExecute_Sandbox(t *testing.T) {
+	t.Run("unsafe libraries need opt-in", func(t *testing.T) {
+		input := "#+TBLFM: $2=type(os)\nA,B\n1,\n"
+		var output bytes.Buffer
+		err := ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV)
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		if expected := "#+TBLFM: $2=type(os)\nA,B\n1,nil\n"; output.String() != expected {
+			t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+		}
+		output.Reset()
+		err = ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV, WithUnsafeLua(true))
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		if expected := "#+TBLFM: $2=type(os)\nA,B\n1,table\n"; output.String() != expected {
+			t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+		}
+	})
+	t.Run("files outside the directory of the table", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "secret.csv"), []byte("Value\nsecret\n"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		tableDir := filepath.Join(dir, "tables")
+		if err := os.Mkdir(tableDir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		for _, formula := range []string{
+			`$2=io and io.open("../secret.csv"):read("*a") or "blocked"`,
+			`$2=dofile and dofile("../secret.csv") or "blocked"`,
+			`$2=remote("../secret.csv", @2$1)`,
+		} {
+			tablePath := filepath.Join(tableDir, "table.csv")
+			if err := os.WriteFile(tablePath, []byte("#+TBLFM: "+formula+"\nA,B\n1,\n"), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			var output bytes.Buffer
+			err := ProcessFile(tablePath, InputFormatCSV, &output, OutputFormatCSV)
+			if strings.Contains(output.String(), "\n1,secret") || strings.Contains(output.String(), "\n1,Value") {
+				t.Errorf("%s: the file outside the directory was read:\n%s", formula, output.String())
+			}
+			if err == nil && !strings.Contains(output.String(), "\n1,blocked\n") {
+				t.Errorf("%s: expected the formula to be blocked, got:\n%s", formula, output.String())
+			}
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		input := "#+TBLFM: $2=(function() repeat until false end)()\nA,B\n1,\n"
+		var output bytes.Buffer
+		err := ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV,
+			WithTimeout(50*time.Millisecond),
+		)
+		if err == nil {
+			t.Fatal("expected an error for the infinite loop")
+		}
+		if !strings.Contains(err.Error(), "time limit of 50ms exceeded") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestProcessStreamContext(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "TBLFM",
+			input: "#+TBLFM: $2=$1+1\nA,B\n1,\n",
+		},
+		{
+			name:  "Miller",
+			input: "#+MLR: $B=$A+1\nA,B\n1,\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var output bytes.Buffer
+			err := ProcessStreamContext(ctx, strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("ProcessStreamContext() error = %v, want context.Canceled", err)
+			}
+		})
+	}
+}
+
+func TestProcessFile_DirectiveError(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	inlinePath := write("inline.csv", "# Comment\n#+TBLFM: $2=$1*2\n#+TBLFM: $3=$1 .. nil\nA,B,C\n1,,\n")
+	sidecarPath := write("sidecar.csv", "A,B,C\n1,,\n")
+	write("sidecar.csv.tblfm", "$2=$1\n\n$3=1 :: $1=$1 +* 1\n")
+	optionsPath := write("options.csv", "#+OPTIONS: iterate:x\nA\n1\n")
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedFile   string
+		expectedLine   int
+		expectedIndex  int
+		expectedPrefix string
+	}{
+		{
+			name:           "inline formula",
+			path:           inlinePath,
+			expectedFile:   inlinePath,
+			expectedLine:   3,
+			expectedIndex:  1,
+			expectedPrefix: inlinePath + ":3: error evaluating formula $3=$1 .. nil at @2$3: ",
+		},
+		{
+			name:           "sidecar formula",
+			path:           sidecarPath,
+			expectedFile:   filepath.Join(dir, "sidecar.csv.tblfm"),
+			expectedLine:   3,
+			expectedIndex:  2,
+			expectedPrefix: filepath.Join(dir, "sidecar.csv.tblfm") + ":3: error compiling formula $1=$1 +* 1: ",
+		},
+		{
+			name:           "options directive",
+			path:           optionsPath,
+			expectedFile:   optionsPath,
+			expectedLine:   1,
+			expectedIndex:  -1,
+			expectedPrefix: optionsPath + `:1: invalid directive "#+OPTIONS: iterate:x"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessFile(tt.path, InputFormatCSV, &output, OutputFormatCSV)
+			var directiveErr *DirectiveError
+			if !errors.As(err, &directiveErr) {
+				t.Fatalf("ProcessFile() error = %v, want *DirectiveError", err)
+			}
+			if directiveErr.File != tt.expectedFile || directiveErr.Line != tt.expectedLine {
+				t.Errorf("position = %s:%d, want %s:%d", directiveErr.File, directiveErr.Line, tt.expectedFile, tt.expectedLine)
+			}
+			if !strings.HasPrefix(err.Error(), tt.expectedPrefix) {
+				t.Errorf("error %q does not start with %q", err.Error(), tt.expectedPrefix)
+			}
+			if strings.Contains(err.Error(), "\n") {
+				t.Errorf("error %q is not a single line", err.Error())
+			}
+			var formulaErr *tblfm.FormulaError
+			if tt.expectedIndex < 0 {
+				if errors.As(err, &formulaErr) {
+					t.Errorf("unexpected *tblfm.FormulaError: %v", formulaErr)
+				}
+				return
+			}
+			if !errors.As(err, &formulaErr) {
+				t.Fatalf("ProcessFile() error = %v, want *tblfm.FormulaError", err)
+			}
+			if formulaErr.Index != tt.expectedIndex {
+				t.Errorf("formula index = %d, want %d", formulaErr.Index, tt.expectedIndex)
+			}
+		})
+	}
+}
+
+func TestExecute_EmptySemantics(t *testing.T) {
+	const table = "A,B,C\n1,,old\n"
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		opts        Options
+		errorSubstr string
+	}{
+		{
+			name:     "default",
+			input:    "#+TBLFM: $3=$2\n" + table,
+			expected: "#+TBLFM: $3=$2\nA,B,C\n1,,\n",
+		},
+		{
+			name:     "options directive",
+			input:    "#+OPTIONS: empty:nil nil:keep\n#+TBLFM: $3=$2\n" + table,
+			expected: "#+OPTIONS: empty:nil nil:keep\n#+TBLFM: $3=$2\n" + table,
+		},
+		{
+			name:     "options take precedence over the directive",
+			input:    "#+OPTIONS: empty:nil nil:keep\n#+TBLFM: $3=$2\n" + table,
+			expected: "#+OPTIONS: empty:nil nil:keep\n#+TBLFM: $3=$2\nA,B,C\n1,,0\n",
+			opts:     Options{WithEmpty(tblfm.EmptyAsZero)},
+		},
+		{
+			name:        "invalid value",
+			input:       "#+OPTIONS: empty:blank\n#+TBLFM: $3=$2\n" + table,
+			errorSubstr: `invalid value for option "empty": invalid empty mode "blank"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_RowLabels(t *testing.T) {
+	const formulas = "#+TBLFM: @{t}$2=vsum(@2..@{t}-1)\n"
+	const table = "Item,Amount,Code\nApple,10,a\nBanana,20,b\nTOTAL,,t\n"
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		opts        Options
+		errorSubstr string
+	}{
+		{
+			name:     "options directive",
+			input:    "#+OPTIONS: label:3\n" + formulas + table,
+			expected: "#+OPTIONS: label:3\n" + formulas + strings.Replace(table, "TOTAL,,", "TOTAL,30,", 1),
+		},
+		{
+			name:     "options take precedence over the directive",
+			input:    "#+OPTIONS: label:1\n" + formulas + table,
+			expected: "#+OPTIONS: label:1\n" + formulas + strings.Replace(table, "TOTAL,,", "TOTAL,30,", 1),
+			opts:     Options{WithLabelColumn(3)},
+		},
+		{
+			name:        "label not found in the default column",
+			input:       formulas + table,
+			errorSubstr: "row label @{t} not found in column $1",
+		},
+		{
+			name:        "invalid value",
+			input:       "#+OPTIONS: label:0\n" + formulas + table,
+			errorSubstr: `invalid value for option "label": "0"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Trace(t *testing.T) {
+	const input = "#+TBLFM: @2$3..@3$3=$1*$2\n#+TBLFM: @>$1=vsum(@2..@>>)\nA,B,C\n2,3,\n4,5,\n,,\n"
+	tests := []struct {
+		name     string
+		filter   func(index, row, col int) bool
+		expected []string
+	}{
+		{
+			name: "all evaluations",
+			expected: []string{
+				`<stdin>: @2$3..@3$3=$1*$2 at @2$3: 2*3 => "6"`,
+				`<stdin>: @2$3..@3$3=$1*$2 at @3$3: 4*5 => "20"`,
+				`<stdin>: @>$1=vsum(@2..@>>) at @4$1: vsum({2,4}) => "6"`,
+			},
+		},
+		{
+			name:   "filtered by formula",
+			filter: func(index, row, col int) bool { return index == 1 },
+			expected: []string{
+				`<stdin>: @>$1=vsum(@2..@>>) at @4$1: vsum({2,4}) => "6"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output, trace bytes.Buffer
+			_ = ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV,
+				WithTrace(&trace), WithTraceFilter(tt.filter))
+			lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+			if len(lines) != len(tt.expected) {
+				t.Fatalf("trace has %d lines, want %d:\n%s", len(lines), len(tt.expected), trace.String())
+			}
+			for i, line := range lines {
+				if !strings.HasPrefix(line, tt.expected[i]) {
+					t.Errorf("trace line %d = %q, want prefix %q", i+1, line, tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProcessFile_LuaChunks(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	write("sales-%.csv.lua", "rate = 0.1\nfunction tax(x) return x * rate end\n")
+	directivePath := write("sales-01.csv", "#+LUA: function half_up(x) return math.floor(x + 0.5) end\n#+TBLFM: $3=half_up(tax($2) * 1.04)\nItem,Price,Tax\nA,100,\n")
+	overridePath := write("sales-02.csv", "#+LUA: rate = 0.2\n#+TBLFM: $3=tax($2)\nItem,Price,Tax\nA,100,\n")
+	errorPath := write("other.csv", "# Comment\n#+LUA: x = 1\n#+LUA: y = x .. nil\n#+TBLFM: $2=x\nA,B\n1,\n")
+
+	tests := []struct {
+		name        string
+		path        string
+		expected    string
+		errorSubstr string
+	}{
+		{
+			name:     "sidecar and directive",
+			path:     directivePath,
+			expected: "#+LUA: function half_up(x) return math.floor(x + 0.5) end\n#+TBLFM: $3=half_up(tax($2) * 1.04)\nItem,Price,Tax\nA,100,10\n",
+		},
+		{
+			name:     "directive runs after the sidecar",
+			path:     overridePath,
+			expected: "#+LUA: rate = 0.2\n#+TBLFM: $3=tax($2)\nItem,Price,Tax\nA,100,20\n",
+		},
+		{
+			name:        "error at the line of the directive",
+			path:        errorPath,
+			errorSubstr: "error loading Lua chunk " + errorPath + ": " + errorPath + ":3: cannot perform concat operation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessFile(tt.path, InputFormatCSV, &output, OutputFormatCSV)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessFile failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Functions(t *testing.T) {
+	const input = "#+TBLFM: $3=convert($1, $2)\nAmount,Currency,JPY\n10,USD,\n2,EUR,\n"
+	rates := map[string]float64{"USD": 150, "EUR": 160}
+	convert := func(args []tblfm.Value) (tblfm.Value, error) {
+		rate, ok := rates[args[1].(string)]
+		if !ok {
+			return nil, fmt.Errorf("unknown currency %q", args[1])
+		}
+		return args[0].(float64) * rate, nil
+	}
+	var output bytes.Buffer
+	err := ProcessStream(strings.NewReader(input), InputFormatCSV, &output, OutputFormatCSV,
+		WithFunctions(map[string]func([]tblfm.Value) (tblfm.Value, error){"convert": convert}))
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	expected := "#+TBLFM: $3=convert($1, $2)\nAmount,Currency,JPY\n10,USD,1500\n2,EUR,320\n"
+	if output.String() != expected {
+		t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+	}
+}
+
+func TestExecute_CreateColumns(t *testing.T) {
+	const formulas = "#+TBLFM: ${Tax}=${Total}*0.1\n"
+	const table = "Item,Total\nA,100\n# Comment\nB,250\n"
+	const created = "Item,Total,Tax\nA,100,10\n# Comment\nB,250,25\n"
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		opts        Options
+		errorSubstr string
+	}{
+		{
+			name:        "default",
+			input:       formulas + table,
+			errorSubstr: `header column "Tax" not found`,
+		},
+		{
+			name:     "options directive",
+			input:    "#+OPTIONS: create:t\n" + formulas + table,
+			expected: "#+OPTIONS: create:t\n" + formulas + created,
+		},
+		{
+			name:     "option",
+			input:    formulas + table,
+			expected: formulas + created,
+			opts:     Options{WithCreateColumns(true)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Pipeline(t *testing.T) {
+	const table = "Item,Price,Qty\nApple,100,5\n# Comment\nOrange,150,3\nTOTAL,,\n"
+	tests := []struct {
+		name        string
+		input       string
+		opts        Options
+		expected    string
+		errorSubstr string
+	}{
+		{
+			name:     "miller then formulas",
+			input:    "#+MLR: $Total = $Price * $Qty\n#+TBLFM: @>${Total}=vsum(@2..@>>)\n" + table,
+			expected: "#+MLR: $Total = $Price * $Qty\n#+TBLFM: @>${Total}=vsum(@2..@>>)\nItem,Price,Qty,Total\nApple,100,5,500\n# Comment\nOrange,150,3,450\nTOTAL,,,950\n",
+		},
+		{
+			name:     "formulas then miller then formulas",
+			input:    "#+TBLFM: @>$3=vsum(@2..@>>)\n#+MLR: $Total = $Price * $Qty\n#+TBLFM: @>$2=vsum(@2$4..@>>$4)/@>$3\n" + table,
+			expected: "#+TBLFM: @>$3=vsum(@2..@>>)\n#+MLR: $Total = $Price * $Qty\n#+TBLFM: @>$2=vsum(@2$4..@>>$4)/@>$3\nItem,Price,Qty,Total\nApple,100,5,500\n# Comment\nOrange,150,3,450\nTOTAL,118.75,8,8\n",
+		},
+		{
+			name:     "options run before the directives",
+			input:    "#+TBLFM: @>${Total}=vsum(@2..@>>)\n" + table,
+			opts:     Options{WithScripts([]string{"$Total = $Price * $Qty"})},
+			expected: "#+TBLFM: @>${Total}=vsum(@2..@>>)\nItem,Price,Qty,Total\nApple,100,5,500\n# Comment\nOrange,150,3,450\nTOTAL,,,950\n",
+		},
+		{
+			name:     "exit ends the pipeline",
+			input:    "#+TBLFM: @>$3=vsum(@2..@>>)\n#+MLR: exit\n#+TBLFM: @>$2=1\n#+MLR: $Total = 1\n" + table,
+			expected: "#+TBLFM: @>$3=vsum(@2..@>>)\n#+MLR: exit\n#+TBLFM: @>$2=1\n#+MLR: $Total = 1\n" + strings.Replace(table, "TOTAL,,", "TOTAL,,8", 1),
+		},
+		{
+			name:     "no directives",
+			input:    table,
+			expected: table,
+		},
+		{
+			name:        "error in a later stage",
+			input:       "#+MLR: $Total = $Price * $Qty\n#+TBLFM: @>$2=vsum(@2..@>>)\n#+TBLFM: @>$4=@>$5\n" + table,
+			errorSubstr: "<stdin>:3: error evaluating formula @>$4=@>$5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecute_Verbs(t *testing.T) {
+	const table = "Date,Category,Amount\n2024-03,Food,30\n# Imported\n2024-01,,10\n2024-02,Rent,20\n"
+	tests := []struct {
+		name        string
+		input       string
+		expected    string
+		errorSubstr string
+	}{
+		{
+			name:     "verbs keep comments in place",
+			input:    "#+MLR-VERB: sort -f Date then fill-down -a -f Category\n" + table,
+			expected: "#+MLR-VERB: sort -f Date then fill-down -a -f Category\nDate,Category,Amount\n2024-01,,10\n# Imported\n2024-02,Rent,20\n2024-03,Food,30\n",
+		},
+		{
+			name:     "verbs and scripts",
+			input:    "#+MLR: $Double = $Amount * 2\n#+MILLER-VERB: head -n 2\n#+MLR: $Half = $Amount / 2\n" + table,
+			expected: "#+MLR: $Double = $Amount * 2\n#+MILLER-VERB: head -n 2\n#+MLR: $Half = $Amount / 2\nDate,Category,Amount,Double,Half\n2024-03,Food,30,60,15\n# Imported\n2024-01,,10,20,5\n",
+		},
+		{
+			name:     "verbs then formulas",
+			input:    "#+MLR-VERB: sort -nr Amount\n#+TBLFM: @2$2=\"Top\"\n" + table,
+			expected: "#+MLR-VERB: sort -nr Amount\n#+TBLFM: @2$2=\"Top\"\nDate,Category,Amount\n2024-03,Top,30\n# Imported\n2024-02,Rent,20\n2024-01,,10\n",
+		},
+		{
+			name:        "unknown verb",
+			input:       "# Comment\n#+MLR-VERB: sort -f Date then shuffle-all\n" + table,
+			errorSubstr: "<stdin>:2: invalid directive \"#+MLR-VERB: sort -f Date then shuffle-all\": unknown verb \"shuffle-all\"",
+		},
+		{
+			name:        "main flag",
+			input:       "#+MLR-VERB: --ojson cat\n" + table,
+			errorSubstr: "<stdin>:1: invalid directive",
+		},
+		{
+			name:        "version flag",
+			input:       "# Comment\n#+MLR-VERB: sort -f Date then head --version\n" + table,
+			errorSubstr: "<stdin>:2: invalid directive \"#+MLR-VERB: sort -f Date then head --version\": mlr head: flags that print or exit, like --version, are not allowed",
+		},
+		{
+			name:        "help flag",
+			input:       "#+MLR-VERB: head -h\n" + table,
+			errorSubstr: "<stdin>:1: invalid directive",
+		},
+		{
+			name:        "script syntax error",
+			input:       "#+MLR: $x = 1\n#+MLR-VERB: sort -f Date\n#+MLR: $y = \n" + table,
+			errorSubstr: "<stdin>:3: mlr: cannot parse DSL expression.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, OutputFormatCSV)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessFile_VerbSidecar(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	write("sales-%.csv.mlr", "$Total = $Price * $Qty\n")
+	write("sales-%.csv.mlr-verb", "sort -nr Total\n")
+	sortedPath := write("sales-01.csv", "#+MLR-VERB: head -n 1\nItem,Price,Qty\nApple,100,1\nOrange,150,3\n")
+	write("broken.csv.mlr-verb", "# Sort the items\nsort -f Item\n  then head -n 1\n\nsort -f Item then\n")
+	brokenPath := write("broken.csv", "Item\nApple\n")
+	write("badflag.csv.mlr-verb", "sort -f Item\n\n# Take the first\nhead -h 1\n")
+	badFlagPath := write("badflag.csv", "Item\nApple\n")
+	write("badscript.csv.mlr", "$x = \n")
+	badScriptPath := write("badscript.csv", "Item\nApple\n")
+
+	var output bytes.Buffer
+	if err := ProcessFile(sortedPath, InputFormatCSV, &output, OutputFormatCSV); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	expected := "#+MLR-VERB: head -n 1\nItem,Price,Qty,Total\nOrange,150,3,450\n"
+	if output.String() != expected {
+		t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), expected)
+	}
+
+	err := ProcessFile(brokenPath, InputFormatCSV, &output, OutputFormatCSV)
+	var directiveErr *DirectiveError
+	if !errors.As(err, &directiveErr) || directiveErr.File != filepath.Join(dir, "broken.csv.mlr-verb") || directiveErr.Line != 5 {
+		t.Fatalf("expected a DirectiveError at line 5 of the sidecar file, got %v", err)
+	}
+	err = ProcessFile(badFlagPath, InputFormatCSV, &output, OutputFormatCSV)
+	if !errors.As(err, &directiveErr) || directiveErr.File != filepath.Join(dir, "badflag.csv.mlr-verb") || directiveErr.Line != 4 {
+		t.Fatalf("expected a DirectiveError at line 4 of the sidecar file, got %v", err)
+	}
+	err = ProcessFile(badScriptPath, InputFormatCSV, &output, OutputFormatCSV)
+	if !errors.As(err, &directiveErr) || directiveErr.File != filepath.Join(dir, "badscript.csv.mlr") || directiveErr.Line != 1 {
+		t.Fatalf("expected a DirectiveError of the script file, got %v", err)
+	}
+}
+
+func TestExecute_HeaderRows(t *testing.T) {
+	const twoHeaders = ",Q1,\nItem,Sales,Cost\n# Comment\nOrange,150,90\nApple,100,60\n"
+	tests := []struct {
+		name         string
+		input        string
+		opts         Options
+		outputFormat OutputFormat
+		expected     string
+		errorSubstr  string
+	}{
+		{
+			name:     "headerless directive",
+			input:    "#+OPTIONS: header:0\n#+TBLFM: $3=$1*$2\n2,3,\n4,5,\n",
+			expected: "#+OPTIONS: header:0\n#+TBLFM: $3=$1*$2\n2,3,6\n4,5,20\n",
+		},
+		{
+			name:     "option takes precedence over the directive",
+			input:    "#+OPTIONS: header:0\n#+TBLFM: $3=$1*$2\nA,B,C\n4,5,\n",
+			opts:     Options{WithHeaderRows(1)},
+			expected: "#+OPTIONS: header:0\n#+TBLFM: $3=$1*$2\nA,B,C\n4,5,20\n",
+		},
+		{
+			name:     "headerless miller",
+			input:    "#+OPTIONS: header:0\n#+MLR: $3 = $1 * $2\n#+MLR-VERB: sort -nr 3\n2,3\n4,5\n",
+			expected: "#+OPTIONS: header:0\n#+MLR: $3 = $1 * $2\n#+MLR-VERB: sort -nr 3\n4,5,20\n2,3,6\n",
+		},
+		{
+			name:     "joined header names",
+			input:    "#+OPTIONS: header:2\n#+TBLFM: @>${Q1 Sales}=vsum(@3..@>>)\n" + twoHeaders + "Total,,\n",
+			expected: "#+OPTIONS: header:2\n#+TBLFM: @>${Q1 Sales}=vsum(@3..@>>)\n" + twoHeaders + "Total,250,\n",
+		},
+		{
+			name:     "miller takes the last header row",
+			input:    "#+OPTIONS: header:2\n#+MLR-VERB: sort -f Item\n#+MLR: $Profit = $Sales - $Cost\n" + twoHeaders,
+			expected: "#+OPTIONS: header:2\n#+MLR-VERB: sort -f Item\n#+MLR: $Profit = $Sales - $Cost\n,Q1,,\nItem,Sales,Cost,Profit\n# Comment\nApple,100,60,40\nOrange,150,90,60\n",
+		},
+		{
+			name:         "upper header rows in the output format",
+			input:        "#+OPTIONS: header:2\n#+MLR: $Profit = $Sales - $Cost\n" + twoHeaders,
+			outputFormat: OutputFormatTSV,
+			expected:     "#+OPTIONS: header:2\n#+MLR: $Profit = $Sales - $Cost\n\tQ1\t\t\nItem\tSales\tCost\tProfit\n# Comment\nOrange\t150\t90\t60\nApple\t100\t60\t40\n",
+		},
+		{
+			name:        "invalid directive",
+			input:       "#+OPTIONS: header:-1\nA\n",
+			errorSubstr: `<stdin>:1: invalid directive "#+OPTIONS: header:-1": invalid value for option "header": "-1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			err := ProcessStream(strings.NewReader(tt.input), InputFormatCSV, &output, tt.outputFormat, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("Output mismatch:\nGot:\n%s\nExpected:\n%s", output.String(), tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package tblfm
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Layouts of the dates and times written by the date functions.
+const (
+	dateLayout            = "2006-01-02"
+	dateTimeLayout        = "2006-01-02 15:04"
+	dateTimeSecondsLayout = "2006-01-02 15:04:05"
+)
+
+// dateLayouts are the layouts tried in order when a date is parsed without an explicit layout.
+var dateLayouts = []string{
+	dateLayout,
+	dateTimeSecondsLayout,
+	dateTimeLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	time.RFC3339,
+	"2006/01/02",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+}
+
+// orgTimestampRe matches an Org-mode timestamp like "<2025-01-15 Wed>" or "[2025-01-15 Wed 10:30]".
+var orgTimestampRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^[<\[](\d{4}-\d{2}-\d{2})(?:\s+[^\s\d>\]]+)?(?:\s+(\d{1,2}:\d{2}))?[>\]]$`)
+})
+
+// parseDate parses a date or date-time string. If layout is empty, ISO-like layouts
+// and Org-mode timestamps are accepted. Dates are handled as wall-clock times in UTC,
+// so that a day is always 24 hours. hasTime tells whether the value has a time of day.
+func parseDate(value string, layout string) (t time.Time, hasTime bool, err error) {
+	value = strings.TrimSpace(value)
+	if layout != "" {
+		t, err = time.Parse(layout, value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid date %q for layout %q", value, layout)
+		}
+		return wallClock(t), t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0, nil
+	}
+	if matches := orgTimestampRe().FindStringSubmatch(value); matches != nil {
+		value = strings.TrimSpace(matches[1] + " " + matches[2])
+	}
+	for _, l := range dateLayouts {
+		if t, err = time.Parse(l, value); err == nil {
+			return wallClock(t), l != dateLayout && l != "2006/01/02", nil
+		}
+	}
+	return t, false, fmt.Errorf("invalid date %q", value)
+}
+
+// wallClock returns t's wall-clock time in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// formatDate writes a date, or a date and time if hasTime is true.
+// Seconds are written only if they are not zero.
+func formatDate(t time.Time, hasTime bool) string {
+	switch {
+	case !hasTime:
+		return t.Format(dateLayout)
+	case t.Second() == 0:
+		return t.Format(dateTimeLayout)
+	default:
+		return t.Format(dateTimeSecondsLayout)
+	}
+}
+
+// addMonths adds n months to t. If the day does not exist in the resulting month,
+// the last day of the month is used (e.g., Jan 31 + 1 month is Feb 28 or 29).
+func addMonths(t time.Time, n int) time.Time {
+	firstOfMonth := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	return firstOfMonth.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
+
+// checkDate parses the date at argument n with the optional layout at argument layoutArg (0 if none).
+func checkDate(L *lua.LState, n int, layoutArg int) (time.Time, bool) {
+	layout := ""
+	if layoutArg > 0 {
+		layout = L.OptString(layoutArg, "")
+	}
+	t, hasTime, err := parseDate(lua.LVAsString(L.CheckAny(n)), layout)
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return t, hasTime
+}
+
+// checkFloat returns the number (or decimal) at argument n as a float.
+func checkFloat(L *lua.LState, n int) float64 {
+	f, ok := toFloat(L.Get(n))
+	if !ok {
+		L.ArgError(n, "number expected, got "+L.Get(n).Type().String())
+	}
+	return f
+}
+
+// registerDateFunctions registers the date and time functions. now returns the current time.
+func registerDateFunctions(L *lua.LState, now func() time.Time) {
+	// date(s, layout) normalizes a date to "YYYY-MM-DD"
+	L.SetGlobal("date", L.NewFunction(func(L *lua.LState) int {
+		t, _ := checkDate(L, 1, 2)
+		L.Push(lua.LString(formatDate(t, false)))
+		return 1
+	}))
+	// datetime(s, layout) normalizes a date and time to "YYYY-MM-DD HH:MM[:SS]"
+	L.SetGlobal("datetime", L.NewFunction(func(L *lua.LState) int {
+		t, _ := checkDate(L, 1, 2)
+		L.Push(lua.LString(formatDate(t, true)))
+		return 1
+	}))
+	L.SetGlobal("today", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(formatDate(wallClock(now()), false)))
+		return 1
+	}))
+	L.SetGlobal("now", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(formatDate(wallClock(now()), true)))
+		return 1
+	}))
+	// adddays(d, n) adds n days, which may be fractional for dates with times
+	L.SetGlobal("adddays", L.NewFunction(func(L *lua.LState) int {
+		t, hasTime := checkDate(L, 1, 0)
+		n := checkFloat(L, 2)
+		if n == math.Trunc(n) {
+			t = t.AddDate(0, 0, int(n))
+		} else {
+			t = t.Add(time.Duration(n * float64(24*time.Hour)))
+			hasTime = true
+		}
+		L.Push(lua.LString(formatDate(t, hasTime)))
+		return 1
+	}))
+	L.SetGlobal("addmonths", L.NewFunction(func(L *lua.LState) int {
+		t, hasTime := checkDate(L, 1, 0)
+		L.Push(lua.LString(formatDate(addMonths(t, int(checkFloat(L, 2))), hasTime)))
+		return 1
+	}))
+	L.SetGlobal("addyears", L.NewFunction(func(L *lua.LState) int {
+		t, hasTime := checkDate(L, 1, 0)
+		L.Push(lua.LString(formatDate(addMonths(t, 12*int(checkFloat(L, 2))), hasTime)))
+		return 1
+	}))
+	// daysdiff(from, to) is the number of days from one date to another
+	L.SetGlobal("daysdiff", L.NewFunction(func(L *lua.LState) int {
+		from, _ := checkDate(L, 1, 0)
+		to, _ := checkDate(L, 2, 0)
+		L.Push(lua.LNumber(to.Sub(from).Hours() / 24))
+		return 1
+	}))
+	// monthsdiff(from, to) is the number of complete months from one date to another
+	L.SetGlobal("monthsdiff", L.NewFunction(func(L *lua.LState) int {
+		from, _ := checkDate(L, 1, 0)
+		to, _ := checkDate(L, 2, 0)
+		months := (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+		if months > 0 && addMonths(from, months).After(to) {
+			months--
+		} else if months < 0 && addMonths(from, months).Before(to) {
+			months++
+		}
+		L.Push(lua.LNumber(months))
+		return 1
+	}))
+	datePart := func(part func(t time.Time) int) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			t, _ := checkDate(L, 1, 0)
+			L.Push(lua.LNumber(part(t)))
+			return 1
+		})
+	}
+	L.SetGlobal("year", datePart(time.Time.Year))
+	L.SetGlobal("month", datePart(func(t time.Time) int { return int(t.Month()) }))
+	L.SetGlobal("day", datePart(time.Time.Day))
+	L.SetGlobal("hour", datePart(time.Time.Hour))
+	L.SetGlobal("minute", datePart(time.Time.Minute))
+	// weekday(d) is the ISO day of the week, from 1 (Monday) to 7 (Sunday)
+	L.SetGlobal("weekday", datePart(func(t time.Time) int {
+		if t.Weekday() == time.Sunday {
+			return 7
+		}
+		return int(t.Weekday())
+	}))
+	// formatdate(d, layout) formats a date with a Go layout like "Jan 2, 2006"
+	L.SetGlobal("formatdate", L.NewFunction(func(L *lua.LState) int {
+		t, _ := checkDate(L, 1, 0)
+		L.Push(lua.LString(t.Format(L.CheckString(2))))
+		return 1
+	}))
+}
+
+// durationRe matches a duration field like "2:30" or "-1:05:30" (HH:MM[:SS]).
+var durationRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^(-)?(\d+):([0-5]\d)(?::([0-5]\d))?$`)
+})
+
+// parseDuration parses a duration field (HH:MM[:SS]) into seconds.
+func parseDuration(value string) (float64, bool) {
+	matches := durationRe().FindStringSubmatch(value)
+	if matches == nil {
+		return 0, false
+	}
+	hours, _ := strconv.Atoi(matches[2])
+	minutes, _ := strconv.Atoi(matches[3])
+	var seconds int
+	if matches[4] != "" {
+		seconds, _ = strconv.Atoi(matches[4])
+	}
+	total := float64(hours*3600 + minutes*60 + seconds)
+	if matches[1] != "" {
+		total = -total
+	}
+	return total, true
+}
+
+// formatDuration writes a number of seconds as a duration according to the mode:
+// 'T' writes HH:MM:SS, 'U' writes HH:MM, and 't' writes hours as a number
+// (with printf, or "%.2f" if it is empty).
+func formatDuration(seconds float64, mode byte, printf string) string {
+	if mode == 't' {
+		if printf == "" {
+			printf = "%.2f"
+		}
+		return formatNumber(seconds/3600, printf)
+	}
+	sign := ""
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	total := int64(math.Round(seconds))
+	if mode == 'U' {
+		total = int64(math.Round(seconds / 60))
+		return fmt.Sprintf("%s%02d:%02d", sign, total/60, total%60)
+	}
+	return fmt.Sprintf("%s%02d:%02d:%02d", sign, total/3600, total/60%60, total%60)
+}
@@ -0,0 +1,483 @@
+package tblfm
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+)
+
+// decimalTypeName is the name of the Lua metatable for decimal values.
+const decimalTypeName = "tblfm.decimal"
+
+// decimalMaxScale is the maximum number of fractional digits written for a
+// decimal value that has no finite decimal representation (e.g., 1/3).
+const decimalMaxScale = 20
+
+// decimalMaxPowBits is the maximum size in bits of the numerator or the denominator
+// of a decimal power (about 315,000 digits).
+const decimalMaxPowBits = 1 << 20
+
+// decimalMaxRoundDigits is the maximum number of digits round can round to, so that
+// the power of ten it scales by stays within decimalMaxPowBits.
+const decimalMaxRoundDigits = decimalMaxPowBits * 3 / 10
+
+// registerDecimalType registers the metatable of decimal values in L.
+// Decimal values are userdata holding a *big.Rat. Arithmetic between decimals,
+// Lua numbers and numeric strings is exact, except for non-integer powers.
+func registerDecimalType(L *lua.LState) {
+	mt := L.NewTypeMetatable(decimalTypeName)
+	arith := func(op func(x, y *big.Rat) (*big.Rat, error)) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			x, okX := toDecimal(L.Get(1))
+			y, okY := toDecimal(L.Get(2))
+			if !okX || !okY {
+				L.RaiseError("attempt to perform arithmetic on %s and %s", L.Get(1).Type(), L.Get(2).Type())
+			}
+			z, err := op(x, y)
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(newDecimal(L, z))
+			return 1
+		})
+	}
+	L.SetField(mt, "__add", arith(func(x, y *big.Rat) (*big.Rat, error) {
+		return new(big.Rat).Add(x, y), nil
+	}))
+	L.SetField(mt, "__sub", arith(func(x, y *big.Rat) (*big.Rat, error) {
+		return new(big.Rat).Sub(x, y), nil
+	}))
+	L.SetField(mt, "__mul", arith(func(x, y *big.Rat) (*big.Rat, error) {
+		return new(big.Rat).Mul(x, y), nil
+	}))
+	L.SetField(mt, "__div", arith(func(x, y *big.Rat) (*big.Rat, error) {
+		if y.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return new(big.Rat).Quo(x, y), nil
+	}))
+	L.SetField(mt, "__mod", arith(func(x, y *big.Rat) (*big.Rat, error) {
+		if y.Sign() == 0 {
+			return nil, fmt.Errorf("modulo by zero")
+		}
+		// Lua semantics: x - floor(x/y)*y
+		q := new(big.Rat).Quo(x, y)
+		floor := new(big.Int).Div(q.Num(), q.Denom())
+		return new(big.Rat).Sub(x, new(big.Rat).Mul(new(big.Rat).SetInt(floor), y)), nil
+	}))
+	L.SetField(mt, "__pow", L.NewFunction(func(L *lua.LState) int {
+		x, okX := toDecimal(L.Get(1))
+		y, okY := toDecimal(L.Get(2))
+		if !okX || !okY {
+			L.RaiseError("attempt to perform arithmetic on %s and %s", L.Get(1).Type(), L.Get(2).Type())
+		}
+		if y.IsInt() && y.Sign() >= 0 {
+			z, err := decimalPow(x, y.Num())
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(newDecimal(L, z))
+			return 1
+		}
+		// Non-integer powers cannot be exact
+		fx, _ := x.Float64()
+		fy, _ := y.Float64()
+		L.Push(lua.LNumber(math.Pow(fx, fy)))
+		return 1
+	}))
+	L.SetField(mt, "__unm", L.NewFunction(func(L *lua.LState) int {
+		x, _ := toDecimal(L.Get(1))
+		L.Push(newDecimal(L, new(big.Rat).Neg(x)))
+		return 1
+	}))
+	compare := func(cmp func(c int) bool) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			x, _ := toDecimal(L.Get(1))
+			y, _ := toDecimal(L.Get(2))
+			L.Push(lua.LBool(cmp(x.Cmp(y))))
+			return 1
+		})
+	}
+	L.SetField(mt, "__eq", compare(func(c int) bool { return c == 0 }))
+	L.SetField(mt, "__lt", compare(func(c int) bool { return c < 0 }))
+	L.SetField(mt, "__le", compare(func(c int) bool { return c <= 0 }))
+	L.SetField(mt, "__tostring", L.NewFunction(func(L *lua.LState) int {
+		x, _ := toDecimal(L.Get(1))
+		L.Push(lua.LString(formatDecimal(x, "")))
+		return 1
+	}))
+	L.SetField(mt, "__concat", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(concatString(L, L.Get(1)) + concatString(L, L.Get(2))))
+		return 1
+	}))
+}
+
+// decimalPow returns x raised to the non-negative integer power n, by squaring.
+// It is an error if the numerator or the denominator of the result would have more than
+// decimalMaxPowBits bits, which would take too long to calculate and too much memory.
+func decimalPow(x *big.Rat, n *big.Int) (*big.Rat, error) {
+	// Bits of a factor, where 0 and ±1 do not grow
+	bits := func(v *big.Int) int64 {
+		if v.CmpAbs(big.NewInt(1)) <= 0 {
+			return 0
+		}
+		return int64(v.BitLen())
+	}
+	for _, b := range []int64{bits(x.Num()), bits(x.Denom())} {
+		if b > 0 && (!n.IsInt64() || n.Int64() > decimalMaxPowBits/b) {
+			return nil, fmt.Errorf("power with exponent %s is too large to calculate exactly", n)
+		}
+	}
+	num := new(big.Int).Exp(x.Num(), n, nil)
+	denom := new(big.Int).Exp(x.Denom(), n, nil)
+	return new(big.Rat).SetFrac(num, denom), nil
+}
+
+// concatString converts an operand of ".." into a string.
+func concatString(L *lua.LState, v lua.LValue) string {
+	switch v := v.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return v.String()
+	}
+	if x, ok := decimalValue(v); ok {
+		return formatDecimal(x, "")
+	}
+	L.RaiseError("attempt to concatenate a %s value", v.Type())
+	return ""
+}
+
+// newDecimal creates a Lua decimal value.
+func newDecimal(L *lua.LState, x *big.Rat) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = x
+	L.SetMetatable(ud, L.GetTypeMetatable(decimalTypeName))
+	return ud
+}
+
+// decimalValue returns the *big.Rat held by a Lua decimal value.
+func decimalValue(v lua.LValue) (*big.Rat, bool) {
+	if ud, ok := v.(*lua.LUserData); ok {
+		x, ok := ud.Value.(*big.Rat)
+		return x, ok
+	}
+	return nil, false
+}
+
+// parseDecimal parses a numeric field value as an exact decimal.
+// Only values that are also valid float numbers are accepted, so that the
+// same values are numeric in both modes.
+func parseDecimal(s string) (*big.Rat, bool) {
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return nil, false
+	}
+	return new(big.Rat).SetString(s)
+}
+
+// floatToDecimal converts a Lua number into a decimal using its shortest decimal representation,
+// so that 0.1 becomes exactly 1/10.
+func floatToDecimal(f float64) (*big.Rat, bool) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// toDecimal converts a Lua decimal, number or numeric string into a decimal.
+func toDecimal(v lua.LValue) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return floatToDecimal(float64(v))
+	case lua.LString:
+		return parseDecimal(string(v))
+	}
+	return decimalValue(v)
+}
+
+// toFloat converts a Lua number, decimal or numeric string into a float.
+func toFloat(v lua.LValue) (float64, bool) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return float64(v), true
+	case lua.LString:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	if x, ok := decimalValue(v); ok {
+		f, _ := x.Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// formatDecimal converts a decimal into a string.
+// If printf is empty, the exact value is written when it has a finite decimal
+// representation, and otherwise it is rounded to decimalMaxScale fractional digits.
+// A printf format of the form "%.Nf" or "%f" is applied exactly (rounding half away from zero);
+// other formats are applied to the value converted to a float.
+func formatDecimal(x *big.Rat, printf string) string {
+	if printf == "" {
+		s := x.FloatString(decimalScale(x))
+		if strings.Contains(s, ".") {
+			s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+		}
+		return s
+	}
+	if matches := decimalPrintfRe().FindStringSubmatch(printf); matches != nil {
+		prec := 6
+		if matches[1] != "" {
+			prec, _ = strconv.Atoi(matches[1])
+		}
+		return x.FloatString(prec)
+	}
+	f, _ := x.Float64()
+	return formatNumber(f, printf)
+}
+
+// decimalPrintfRe matches printf formats that are applied to decimals exactly.
+var decimalPrintfRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`^%(?:\.(\d+))?f$`)
+})
+
+// decimalScale returns the number of fractional digits needed to write x exactly,
+// or decimalMaxScale if x has no finite decimal representation.
+func decimalScale(x *big.Rat) int {
+	denom := new(big.Int).Set(x.Denom())
+	var twos, fives int
+	two, five := big.NewInt(2), big.NewInt(5)
+	mod := new(big.Int)
+	for denom.Cmp(big.NewInt(1)) != 0 {
+		if mod.Mod(denom, two).Sign() == 0 {
+			denom.Quo(denom, two)
+			twos++
+		} else if mod.Mod(denom, five).Sign() == 0 {
+			denom.Quo(denom, five)
+			fives++
+		} else {
+			return decimalMaxScale
+		}
+	}
+	return max(twos, fives)
+}
+
+// Rounding modes for roundDecimal.
+const (
+	roundHalfEven = "half-even"
+	roundHalfUp   = "half-up"
+)
+
+// roundDecimal rounds x to n fractional digits (n may be negative) using the given rounding mode.
+// "half-up" rounds ties away from zero, and "half-even" rounds ties to the nearest even digit.
+// |n| must be at most decimalMaxRoundDigits.
+func roundDecimal(x *big.Rat, n int, mode string) (*big.Rat, error) {
+	if mode != roundHalfEven && mode != roundHalfUp {
+		return nil, fmt.Errorf("unknown rounding mode %q (expected %q or %q)", mode, roundHalfEven, roundHalfUp)
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(n))), nil))
+	if n < 0 {
+		scale.Inv(scale)
+	}
+	scaled := new(big.Rat).Mul(x, scale)
+	// Split |scaled| into integer part and remainder
+	neg := scaled.Sign() < 0
+	scaled.Abs(scaled)
+	q, r := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	// Compare the remainder with half the denominator
+	cmp := new(big.Int).Mul(r, big.NewInt(2)).Cmp(scaled.Denom())
+	if cmp > 0 || (cmp == 0 && (mode == roundHalfUp || q.Bit(0) == 1)) {
+		q.Add(q, big.NewInt(1))
+	}
+	if neg {
+		q.Neg(q)
+	}
+	return new(big.Rat).Quo(new(big.Rat).SetInt(q), scale), nil
+}
+
+// abs returns the absolute value of n.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// comparatorName is the name of the local variable that holds the comparator in compiled chunks.
+const comparatorName = "__cmp"
+
+// compareFunction is the comparator called for the relational operators (==, ~=, <, <=, >, >=)
+// in compiled expressions. Lua cannot compare a decimal with a number, so numeric operands
+// of any kind are compared as decimals here; other operands are compared as Lua does.
+func compareFunction(L *lua.LState) int {
+	op := L.CheckString(1)
+	lhs, rhs := L.Get(2), L.Get(3)
+	if _, isDecimal := decimalValue(lhs); !isDecimal {
+		if _, isDecimal := decimalValue(rhs); !isDecimal {
+			L.Push(lua.LBool(compareLua(L, op, lhs, rhs)))
+			return 1
+		}
+	}
+	x, okX := toDecimal(lhs)
+	y, okY := toDecimal(rhs)
+	// A numeric string is not equal to a number in Lua
+	_, strX := lhs.(lua.LString)
+	_, strY := rhs.(lua.LString)
+	if !okX || !okY || strX || strY {
+		if op == "==" || op == "~=" {
+			L.Push(lua.LBool(op == "~="))
+			return 1
+		}
+		L.RaiseError("attempt to compare %s with %s", lhs.Type(), rhs.Type())
+	}
+	c := x.Cmp(y)
+	var result bool
+	switch op {
+	case "==":
+		result = c == 0
+	case "~=":
+		result = c != 0
+	case "<":
+		result = c < 0
+	case "<=":
+		result = c <= 0
+	case ">":
+		result = c > 0
+	case ">=":
+		result = c >= 0
+	}
+	L.Push(lua.LBool(result))
+	return 1
+}
+
+// compareLua compares two values with the semantics of the Lua relational operators.
+func compareLua(L *lua.LState, op string, lhs, rhs lua.LValue) bool {
+	switch op {
+	case "==":
+		return L.Equal(lhs, rhs)
+	case "~=":
+		return !L.Equal(lhs, rhs)
+	case "<":
+		return L.LessThan(lhs, rhs)
+	case "<=":
+		return !L.LessThan(rhs, lhs)
+	case ">":
+		return L.LessThan(rhs, lhs)
+	default: // ">="
+		return !L.LessThan(lhs, rhs)
+	}
+}
+
+// rewriteComparisons replaces the relational operators in stmts with calls to the comparator.
+func rewriteComparisons(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		rewriteStmt(stmt)
+	}
+}
+
+// rewriteStmt rewrites the expressions in a statement (see rewriteComparisons).
+func rewriteStmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		rewriteExprs(s.Lhs)
+		rewriteExprs(s.Rhs)
+	case *ast.LocalAssignStmt:
+		rewriteExprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		s.Expr = rewriteExpr(s.Expr)
+	case *ast.DoBlockStmt:
+		rewriteComparisons(s.Stmts)
+	case *ast.WhileStmt:
+		s.Condition = rewriteExpr(s.Condition)
+		rewriteComparisons(s.Stmts)
+	case *ast.RepeatStmt:
+		s.Condition = rewriteExpr(s.Condition)
+		rewriteComparisons(s.Stmts)
+	case *ast.IfStmt:
+		s.Condition = rewriteExpr(s.Condition)
+		rewriteComparisons(s.Then)
+		rewriteComparisons(s.Else)
+	case *ast.NumberForStmt:
+		s.Init = rewriteExpr(s.Init)
+		s.Limit = rewriteExpr(s.Limit)
+		if s.Step != nil {
+			s.Step = rewriteExpr(s.Step)
+		}
+		rewriteComparisons(s.Stmts)
+	case *ast.GenericForStmt:
+		rewriteExprs(s.Exprs)
+		rewriteComparisons(s.Stmts)
+	case *ast.FuncDefStmt:
+		rewriteComparisons(s.Func.Stmts)
+	case *ast.ReturnStmt:
+		rewriteExprs(s.Exprs)
+	}
+}
+
+// rewriteExprs rewrites each expression in place (see rewriteComparisons).
+func rewriteExprs(exprs []ast.Expr) {
+	for i, expr := range exprs {
+		exprs[i] = rewriteExpr(expr)
+	}
+}
+
+// rewriteExpr returns the expression with relational operators replaced by calls to the comparator.
+func rewriteExpr(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.RelationalOpExpr:
+		call := &ast.FuncCallExpr{
+			Func: &ast.IdentExpr{Value: comparatorName},
+			Args: []ast.Expr{
+				&ast.StringExpr{Value: e.Operator},
+				rewriteExpr(e.Lhs),
+				rewriteExpr(e.Rhs),
+			},
+		}
+		call.SetLine(e.Line())
+		call.SetLastLine(e.LastLine())
+		call.Func.SetLine(e.Line())
+		return call
+	case *ast.AttrGetExpr:
+		e.Object = rewriteExpr(e.Object)
+		e.Key = rewriteExpr(e.Key)
+	case *ast.TableExpr:
+		for _, field := range e.Fields {
+			if field.Key != nil {
+				field.Key = rewriteExpr(field.Key)
+			}
+			field.Value = rewriteExpr(field.Value)
+		}
+	case *ast.FuncCallExpr:
+		if e.Func != nil {
+			e.Func = rewriteExpr(e.Func)
+		}
+		if e.Receiver != nil {
+			e.Receiver = rewriteExpr(e.Receiver)
+		}
+		rewriteExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs = rewriteExpr(e.Lhs)
+		e.Rhs = rewriteExpr(e.Rhs)
+	case *ast.StringConcatOpExpr:
+		e.Lhs = rewriteExpr(e.Lhs)
+		e.Rhs = rewriteExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs = rewriteExpr(e.Lhs)
+		e.Rhs = rewriteExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = rewriteExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = rewriteExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = rewriteExpr(e.Expr)
+	case *ast.FunctionExpr:
+		rewriteComparisons(e.Stmts)
+	}
+	return expr
+}
@@ -0,0 +1,85 @@
+package tblfm
+
+import (
+	"errors"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// FormulaError is an error in compiling or evaluating a formula.
+type FormulaError struct {
+	Index   int    // Position of the formula in the list given to Compile or Apply (0-based)
+	Formula string // Formula text
+	Row     int    // Row of the target cell being evaluated (1-based), or 0 if the error is not about a cell
+	Col     int    // Column of the target cell being evaluated (1-based), or 0 if the error is not about a cell
+	Code    string // Lua code evaluated, with references replaced by field values as in the L mode (empty if not evaluated)
+	Err     error  // Underlying error
+
+	op string // Operation that failed, like "compiling" (empty if unspecified)
+}
+
+// Error returns the message like "error evaluating formula $3=$1/$2 at @2$3: <error>".
+func (e *FormulaError) Error() string {
+	msg := "formula " + e.Formula
+	if e.op != "" {
+		msg = "error " + e.op + " " + msg
+	}
+	if e.Row > 0 {
+		msg += fmt.Sprintf(" at @%d$%d", e.Row, e.Col)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *FormulaError) Unwrap() error {
+	return e.Err
+}
+
+// luaError is an error raised while running Lua code. Its message is that of the
+// Lua error without the stack traceback, so that it fits in a "file:line: message" line.
+type luaError struct {
+	err *lua.ApiError
+}
+
+// Error returns the message of the Lua error.
+func (e *luaError) Error() string {
+	return e.err.Object.String()
+}
+
+// Unwrap returns the underlying Lua error.
+func (e *luaError) Unwrap() error {
+	return e.err
+}
+
+// runError returns an error of running Lua code as a *luaError.
+func runError(err error) error {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) && apiErr.Object != nil {
+		return &luaError{err: apiErr}
+	}
+	return err
+}
+
+// syntaxError returns a syntax error of Lua source code that starts with prefix, which is generated
+// in front of the code on its first line, in one line. The column is made relative to the code,
+// or left out if withColumn is false, as when the code is not written as it is compiled.
+func syntaxError(err error, prefix string, withColumn bool) error {
+	var parseErr *parse.Error
+	if !errors.As(err, &parseErr) {
+		return err
+	}
+	pos := parseErr.Pos
+	switch {
+	case pos.Line == parse.EOF:
+		return fmt.Errorf("%s at EOF: %s", pos.Source, parseErr.Message)
+	case !withColumn:
+		return fmt.Errorf("%s line:%d near '%s': %s", pos.Source, pos.Line, parseErr.Token, parseErr.Message)
+	}
+	column := pos.Column
+	if pos.Line == 1 {
+		column -= len(prefix)
+	}
+	return fmt.Errorf("%s line:%d(column:%d) near '%s': %s", pos.Source, pos.Line, column, parseErr.Token, parseErr.Message)
+}
@@ -1,21 +1,88 @@
 package tblfm
 
 import (
+	"fmt"
 	"math"
+	"math/big"
+	"regexp"
+	"slices"
 	"sort"
-	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
 // registerBuiltinFunctions registers all built-in functions for Lua expression evaluation.
-func registerBuiltinFunctions(L *lua.LState) {
+// In decimal mode, the vector functions calculate with exact decimals.
+func registerBuiltinFunctions(L *lua.LState, cfg *config) {
+	decimal := cfg.decimal
+	now := cfg.now
+	if now == nil {
+		now = time.Now
+	}
+	registerDecimalType(L)
+	registerDateFunctions(L, now)
 	L.SetGlobal("vsum", L.NewFunction(vsumFunction))
 	L.SetGlobal("vmean", L.NewFunction(vmeanFunction))
 	L.SetGlobal("vmax", L.NewFunction(vmaxFunction))
 	L.SetGlobal("vmin", L.NewFunction(vminFunction))
 	L.SetGlobal("vmedian", L.NewFunction(vmedianFunction))
+	L.SetGlobal("vcount", L.NewFunction(vcountFunction))
+	L.SetGlobal("vcounta", L.NewFunction(vcountaFunction))
+	L.SetGlobal("vprod", L.NewFunction(vprodFunction))
+	L.SetGlobal("vvar", L.NewFunction(vvarFunction))
+	L.SetGlobal("vsdev", L.NewFunction(vsdevFunction))
+	L.SetGlobal("vpercentile", L.NewFunction(vpercentileFunction))
+	L.SetGlobal("vmode", L.NewFunction(vmodeFunction))
 	L.SetGlobal("exp", L.NewFunction(expFunction))
+	L.SetGlobal("split", L.NewFunction(splitFunction))
+	L.SetGlobal("trim", L.NewFunction(trimFunction))
+	L.SetGlobal("upper", L.NewFunction(upperFunction))
+	L.SetGlobal("lower", L.NewFunction(lowerFunction))
+	L.SetGlobal("pad", L.NewFunction(padFunction))
+	L.SetGlobal("match", L.NewFunction(matchFunction))
+	L.SetGlobal("replace", L.NewFunction(replaceFunction))
+	L.SetGlobal("sprintf", L.NewFunction(sprintfFunction))
+	L.SetGlobal("vjoin", L.NewFunction(vjoinFunction))
+	L.SetGlobal("vunique", L.NewFunction(vuniqueFunction))
+	L.SetGlobal("round", L.NewFunction(roundFunction(decimal)))
+	L.SetGlobal("nrows", L.NewFunction(nrowsFunction))
+	L.SetGlobal("ncols", L.NewFunction(ncolsFunction))
+	L.SetGlobal("index", L.NewFunction(indexFunction))
+	L.SetGlobal("vlookup", L.NewFunction(vlookupFunction))
+	L.SetGlobal("xlookup", L.NewFunction(xlookupFunction))
+	L.SetGlobal("xmatch", L.NewFunction(xmatchFunction))
+	if decimal {
+		L.SetGlobal("vsum", L.NewFunction(vsumDecimalFunction))
+		L.SetGlobal("vmean", L.NewFunction(vmeanDecimalFunction))
+		L.SetGlobal("vmax", L.NewFunction(vmaxDecimalFunction))
+		L.SetGlobal("vmin", L.NewFunction(vminDecimalFunction))
+		L.SetGlobal("vmedian", L.NewFunction(vmedianDecimalFunction))
+		L.SetGlobal("vprod", L.NewFunction(vprodDecimalFunction))
+		L.SetGlobal("vvar", L.NewFunction(vvarDecimalFunction))
+		L.SetGlobal("vsdev", L.NewFunction(vsdevDecimalFunction))
+		L.SetGlobal("vpercentile", L.NewFunction(vpercentileDecimalFunction))
+		L.SetGlobal("vmode", L.NewFunction(vmodeDecimalFunction))
+		L.SetGlobal("dec", L.NewFunction(decFunction))
+		L.SetGlobal("tonumber", L.NewFunction(tonumberFunction(L.GetGlobal("tonumber"))))
+		registerDecimalLibFunctions(L)
+	}
+	registerConditionalFunctions(L)
+}
+
+// registerConditionalFunctions registers the conditional versions of the vector functions
+// (vsumif, vcountif, vmeanif). They aggregate with the registered vsum and vmean,
+// so they must be registered after them.
+func registerConditionalFunctions(L *lua.LState) {
+	aggregate := func(name string) lua.LGFunction {
+		return L.GetGlobal(name).(*lua.LFunction).GFunction
+	}
+	L.SetGlobal("vsumif", L.NewFunction(conditionalFunction("vsumif", aggregate("vsum"))))
+	L.SetGlobal("vmeanif", L.NewFunction(conditionalFunction("vmeanif", aggregate("vmean"))))
+	L.SetGlobal("vcountif", L.NewFunction(vcountifFunction))
 }
 
 // vsumFunction is a Lua function to calculate the sum of values.
@@ -103,10 +170,718 @@ func vmedianFunction(L *lua.LState) int {
 	return 1
 }
 
+// vcountFunction is a Lua function to count the numeric values.
+func vcountFunction(L *lua.LState) int {
+	var count int
+	processTable(L, func(float64) {
+		count++
+	})
+	L.Push(lua.LNumber(count))
+	return 1
+}
+
+// vcountaFunction is a Lua function to count the non-empty values, numeric or not.
+func vcountaFunction(L *lua.LState) int {
+	var count int
+	if tbl := L.ToTable(1); tbl != nil {
+		tbl.ForEach(func(_, val lua.LValue) {
+			if val != lua.LNil && val != lua.LString("") {
+				count++
+			}
+		})
+	}
+	L.Push(lua.LNumber(count))
+	return 1
+}
+
+// vprodFunction is a Lua function to calculate the product of values.
+func vprodFunction(L *lua.LState) int {
+	prod := 1.0
+	processTable(L, func(v float64) {
+		prod *= v
+	})
+	L.Push(lua.LNumber(prod))
+	return 1
+}
+
+// variance returns the sample variance of values, or 0 if there are fewer than two values.
+func variance(values []float64) float64 {
+	n := len(values)
+	if n < 2 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(n)
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return squares / float64(n-1)
+}
+
+// vvarFunction is a Lua function to calculate the sample variance of values.
+func vvarFunction(L *lua.LState) int {
+	var values []float64
+	processTable(L, func(v float64) {
+		values = append(values, v)
+	})
+	L.Push(lua.LNumber(variance(values)))
+	return 1
+}
+
+// vsdevFunction is a Lua function to calculate the sample standard deviation of values.
+func vsdevFunction(L *lua.LState) int {
+	var values []float64
+	processTable(L, func(v float64) {
+		values = append(values, v)
+	})
+	L.Push(lua.LNumber(math.Sqrt(variance(values))))
+	return 1
+}
+
+// checkPercentile returns the percentile argument at n, which must be between 0 and 1.
+func checkPercentile(L *lua.LState, n int) float64 {
+	p := checkFloat(L, n)
+	if p < 0 || p > 1 {
+		L.ArgError(n, "percentile must be between 0 and 1")
+	}
+	return p
+}
+
+// vpercentileFunction is a Lua function to calculate the p-th percentile of values (0 <= p <= 1),
+// interpolating linearly between the closest ranks: vpercentile(range, p).
+func vpercentileFunction(L *lua.LState) int {
+	p := checkPercentile(L, 2)
+	var values []float64
+	processTable(L, func(v float64) {
+		values = append(values, v)
+	})
+	if len(values) == 0 {
+		L.Push(lua.LNumber(0))
+		return 1
+	}
+	sort.Float64s(values)
+	rank := p * float64(len(values)-1)
+	lower := int(rank)
+	if lower == len(values)-1 {
+		L.Push(lua.LNumber(values[lower]))
+		return 1
+	}
+	L.Push(lua.LNumber(values[lower] + (rank-float64(lower))*(values[lower+1]-values[lower])))
+	return 1
+}
+
+// vmodeFunction is a Lua function to find the most frequent value.
+// Among values with the same frequency, the one that appears first wins.
+func vmodeFunction(L *lua.LState) int {
+	var values []float64
+	counts := make(map[float64]int)
+	processTable(L, func(v float64) {
+		if counts[v] == 0 {
+			values = append(values, v)
+		}
+		counts[v]++
+	})
+	var modeVal float64
+	var modeCount int
+	for _, v := range values {
+		if counts[v] > modeCount {
+			modeVal, modeCount = v, counts[v]
+		}
+	}
+	L.Push(lua.LNumber(modeVal))
+	return 1
+}
+
 // expFunction is a Lua function for math.Exp.
 func expFunction(L *lua.LState) int {
-	val := L.ToNumber(1)
-	L.Push(lua.LNumber(math.Exp(float64(val))))
+	val, _ := toFloat(L.Get(1))
+	L.Push(lua.LNumber(math.Exp(val)))
+	return 1
+}
+
+// roundFunction returns a Lua function to round a value to n fractional digits: round(x, n, mode).
+// n defaults to 0 and may be negative; mode is "half-even" (default) or "half-up".
+// The value is rounded exactly as a decimal. The result is a decimal in decimal mode and a number otherwise.
+func roundFunction(decimal bool) lua.LGFunction {
+	return func(L *lua.LState) int {
+		x, ok := toDecimal(L.Get(1))
+		if !ok {
+			L.ArgError(1, "number expected, got "+L.Get(1).Type().String())
+		}
+		n := L.OptInt(2, 0)
+		if n < -decimalMaxRoundDigits || n > decimalMaxRoundDigits {
+			L.ArgError(2, fmt.Sprintf("number of digits must be between %d and %d", -decimalMaxRoundDigits, decimalMaxRoundDigits))
+		}
+		mode := L.OptString(3, roundHalfEven)
+		rounded, err := roundDecimal(x, n, mode)
+		if err != nil {
+			L.ArgError(3, err.Error())
+		}
+		if decimal {
+			L.Push(newDecimal(L, rounded))
+		} else {
+			f, _ := rounded.Float64()
+			L.Push(lua.LNumber(f))
+		}
+		return 1
+	}
+}
+
+// decFunction is a Lua function to convert a number or numeric string into a decimal.
+func decFunction(L *lua.LState) int {
+	x, ok := toDecimal(L.Get(1))
+	if !ok {
+		L.ArgError(1, "number expected, got "+L.Get(1).Type().String())
+	}
+	L.Push(newDecimal(L, x))
+	return 1
+}
+
+// tonumberFunction returns a Lua tonumber function that also converts decimals into numbers.
+func tonumberFunction(original lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if x, ok := decimalValue(L.Get(1)); ok {
+			f, _ := x.Float64()
+			L.Push(lua.LNumber(f))
+			return 1
+		}
+		nargs := L.GetTop()
+		L.Push(original)
+		for i := 1; i <= nargs; i++ {
+			L.Push(L.Get(i))
+		}
+		L.Call(nargs, 1)
+		return 1
+	}
+}
+
+// registerDecimalLibFunctions replaces functions of the math and string libraries with versions
+// that also take decimals, so that formulas written for floats work in decimal mode.
+// floor, ceil, abs, max, min and fmod calculate exactly, and string.format formats decimals like sprintf.
+func registerDecimalLibFunctions(L *lua.LState) {
+	libs := []struct {
+		name      string
+		functions map[string]lua.LGFunction
+	}{
+		{lua.MathLibName, map[string]lua.LGFunction{
+			"floor": mathFloorDecimalFunction,
+			"ceil":  mathCeilDecimalFunction,
+			"abs":   mathAbsDecimalFunction,
+			"max":   mathMaxDecimalFunction,
+			"min":   mathMinDecimalFunction,
+			"fmod":  mathFmodDecimalFunction,
+		}},
+		{lua.StringLibName, map[string]lua.LGFunction{
+			"format": stringFormatDecimalFunction,
+		}},
+	}
+	for _, lib := range libs {
+		tbl, ok := L.GetGlobal(lib.name).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		for name, fn := range lib.functions {
+			L.SetField(tbl, name, L.NewFunction(decimalLibFunction(L.GetField(tbl, name), fn)))
+		}
+	}
+}
+
+// decimalLibFunction returns a Lua function that calls fn if one of its arguments is a decimal,
+// and the original library function otherwise.
+func decimalLibFunction(original lua.LValue, fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		nargs := L.GetTop()
+		for i := 1; i <= nargs; i++ {
+			if _, ok := decimalValue(L.Get(i)); ok {
+				return fn(L)
+			}
+		}
+		L.Push(original)
+		for i := 1; i <= nargs; i++ {
+			L.Push(L.Get(i))
+		}
+		L.Call(nargs, lua.MultRet)
+		return L.GetTop() - nargs
+	}
+}
+
+// checkDecimal returns argument n converted into a decimal, raising an argument error if it is not numeric.
+func checkDecimal(L *lua.LState, n int) *big.Rat {
+	x, ok := toDecimal(L.Get(n))
+	if !ok {
+		L.ArgError(n, "number expected, got "+L.Get(n).Type().String())
+	}
+	return x
+}
+
+// floorDecimal returns the largest integer not greater than x.
+func floorDecimal(x *big.Rat) *big.Rat {
+	// The denominator is positive, so Div rounds toward negative infinity
+	return new(big.Rat).SetInt(new(big.Int).Div(x.Num(), x.Denom()))
+}
+
+// mathFloorDecimalFunction is the decimal version of math.floor.
+func mathFloorDecimalFunction(L *lua.LState) int {
+	L.Push(newDecimal(L, floorDecimal(checkDecimal(L, 1))))
+	return 1
+}
+
+// mathCeilDecimalFunction is the decimal version of math.ceil.
+func mathCeilDecimalFunction(L *lua.LState) int {
+	x := checkDecimal(L, 1)
+	L.Push(newDecimal(L, new(big.Rat).Neg(floorDecimal(new(big.Rat).Neg(x)))))
+	return 1
+}
+
+// mathAbsDecimalFunction is the decimal version of math.abs.
+func mathAbsDecimalFunction(L *lua.LState) int {
+	L.Push(newDecimal(L, new(big.Rat).Abs(checkDecimal(L, 1))))
+	return 1
+}
+
+// mathMaxDecimalFunction is the decimal version of math.max.
+func mathMaxDecimalFunction(L *lua.LState) int {
+	return pickDecimal(L, func(c int) bool { return c > 0 })
+}
+
+// mathMinDecimalFunction is the decimal version of math.min.
+func mathMinDecimalFunction(L *lua.LState) int {
+	return pickDecimal(L, func(c int) bool { return c < 0 })
+}
+
+// pickDecimal pushes the argument that better satisfies better, which is given the result of
+// comparing an argument with the best one so far.
+func pickDecimal(L *lua.LState, better func(c int) bool) int {
+	best := checkDecimal(L, 1)
+	for i := 2; i <= L.GetTop(); i++ {
+		if x := checkDecimal(L, i); better(x.Cmp(best)) {
+			best = x
+		}
+	}
+	L.Push(newDecimal(L, best))
+	return 1
+}
+
+// mathFmodDecimalFunction is the decimal version of math.fmod. The remainder has the sign of x.
+func mathFmodDecimalFunction(L *lua.LState) int {
+	x, y := checkDecimal(L, 1), checkDecimal(L, 2)
+	if y.Sign() == 0 {
+		L.ArgError(2, "zero")
+	}
+	q := new(big.Rat).Quo(x, y)
+	truncated := new(big.Int).Quo(q.Num(), q.Denom())
+	L.Push(newDecimal(L, new(big.Rat).Sub(x, new(big.Rat).Mul(new(big.Rat).SetInt(truncated), y))))
+	return 1
+}
+
+// stringFormatDecimalFunction is the decimal version of string.format. Decimals are formatted
+// like sprintf does, and other values like string.format does. A numeric verb given a value
+// that is not numeric is an argument error, as is a verb that Go cannot format.
+func stringFormatDecimalFunction(L *lua.LState) int {
+	format := L.CheckString(1)
+	arg := 2
+	result := sprintfVerbRe().ReplaceAllStringFunc(format, func(verb string) string {
+		if verb == "%%" {
+			return "%"
+		}
+		if arg > L.GetTop() {
+			L.ArgError(arg, "no value")
+		}
+		value := L.Get(arg)
+		arg++
+		var s string
+		if strings.ContainsRune("sqv", rune(verb[len(verb)-1])) {
+			s = fmt.Sprintf(verb, L.ToStringMeta(value).String())
+		} else if x, ok := decimalValue(value); ok {
+			s = formatDecimal(x, verb)
+		} else if f, ok := toFloat(value); ok {
+			s = fmt.Sprintf(verb, lua.LNumber(f))
+		} else {
+			L.ArgError(arg-1, "number expected, got "+value.Type().String())
+		}
+		if strings.Contains(s, "%!") {
+			L.ArgError(arg-1, fmt.Sprintf("invalid format %s", verb))
+		}
+		return s
+	})
+	L.Push(lua.LString(result))
+	return 1
+}
+
+// vsumDecimalFunction is the decimal version of vsumFunction.
+func vsumDecimalFunction(L *lua.LState) int {
+	sum := new(big.Rat)
+	processDecimalTable(L, func(v *big.Rat) {
+		sum.Add(sum, v)
+	})
+	L.Push(newDecimal(L, sum))
+	return 1
+}
+
+// vmeanDecimalFunction is the decimal version of vmeanFunction.
+func vmeanDecimalFunction(L *lua.LState) int {
+	sum := new(big.Rat)
+	var count int64
+	processDecimalTable(L, func(v *big.Rat) {
+		sum.Add(sum, v)
+		count++
+	})
+	if count > 0 {
+		sum.Quo(sum, big.NewRat(count, 1))
+	}
+	L.Push(newDecimal(L, sum))
+	return 1
+}
+
+// vmaxDecimalFunction is the decimal version of vmaxFunction.
+func vmaxDecimalFunction(L *lua.LState) int {
+	var maxVal *big.Rat
+	processDecimalTable(L, func(v *big.Rat) {
+		if maxVal == nil || v.Cmp(maxVal) > 0 {
+			maxVal = v
+		}
+	})
+	if maxVal == nil {
+		maxVal = new(big.Rat)
+	}
+	L.Push(newDecimal(L, maxVal))
+	return 1
+}
+
+// vminDecimalFunction is the decimal version of vminFunction.
+func vminDecimalFunction(L *lua.LState) int {
+	var minVal *big.Rat
+	processDecimalTable(L, func(v *big.Rat) {
+		if minVal == nil || v.Cmp(minVal) < 0 {
+			minVal = v
+		}
+	})
+	if minVal == nil {
+		minVal = new(big.Rat)
+	}
+	L.Push(newDecimal(L, minVal))
+	return 1
+}
+
+// vmedianDecimalFunction is the decimal version of vmedianFunction.
+func vmedianDecimalFunction(L *lua.LState) int {
+	var values []*big.Rat
+	processDecimalTable(L, func(v *big.Rat) {
+		values = append(values, v)
+	})
+
+	if len(values) == 0 {
+		L.Push(newDecimal(L, new(big.Rat)))
+		return 1
+	}
+
+	slices.SortFunc(values, func(a, b *big.Rat) int { return a.Cmp(b) })
+
+	n := len(values)
+	if n%2 == 0 {
+		median := new(big.Rat).Add(values[n/2-1], values[n/2])
+		L.Push(newDecimal(L, median.Quo(median, big.NewRat(2, 1))))
+	} else {
+		L.Push(newDecimal(L, values[n/2]))
+	}
+	return 1
+}
+
+// vprodDecimalFunction is the decimal version of vprodFunction.
+func vprodDecimalFunction(L *lua.LState) int {
+	prod := big.NewRat(1, 1)
+	processDecimalTable(L, func(v *big.Rat) {
+		prod.Mul(prod, v)
+	})
+	L.Push(newDecimal(L, prod))
+	return 1
+}
+
+// decimalVariance returns the sample variance of values, or 0 if there are fewer than two values.
+func decimalVariance(values []*big.Rat) *big.Rat {
+	n := len(values)
+	if n < 2 {
+		return new(big.Rat)
+	}
+	mean := new(big.Rat)
+	for _, v := range values {
+		mean.Add(mean, v)
+	}
+	mean.Quo(mean, big.NewRat(int64(n), 1))
+	squares := new(big.Rat)
+	for _, v := range values {
+		d := new(big.Rat).Sub(v, mean)
+		squares.Add(squares, d.Mul(d, d))
+	}
+	return squares.Quo(squares, big.NewRat(int64(n-1), 1))
+}
+
+// vvarDecimalFunction is the decimal version of vvarFunction.
+func vvarDecimalFunction(L *lua.LState) int {
+	var values []*big.Rat
+	processDecimalTable(L, func(v *big.Rat) {
+		values = append(values, v)
+	})
+	L.Push(newDecimal(L, decimalVariance(values)))
+	return 1
+}
+
+// vsdevDecimalFunction is the decimal version of vsdevFunction.
+// The square root is not exact in general, so the result is a number.
+func vsdevDecimalFunction(L *lua.LState) int {
+	var values []*big.Rat
+	processDecimalTable(L, func(v *big.Rat) {
+		values = append(values, v)
+	})
+	f, _ := decimalVariance(values).Float64()
+	L.Push(lua.LNumber(math.Sqrt(f)))
+	return 1
+}
+
+// vpercentileDecimalFunction is the decimal version of vpercentileFunction.
+func vpercentileDecimalFunction(L *lua.LState) int {
+	p, ok := toDecimal(L.Get(2))
+	if !ok || p.Sign() < 0 || p.Cmp(big.NewRat(1, 1)) > 0 {
+		L.ArgError(2, "percentile must be between 0 and 1")
+	}
+	var values []*big.Rat
+	processDecimalTable(L, func(v *big.Rat) {
+		values = append(values, v)
+	})
+	if len(values) == 0 {
+		L.Push(newDecimal(L, new(big.Rat)))
+		return 1
+	}
+	slices.SortFunc(values, func(a, b *big.Rat) int { return a.Cmp(b) })
+	rank := new(big.Rat).Mul(p, big.NewRat(int64(len(values)-1), 1))
+	lower := int(new(big.Int).Quo(rank.Num(), rank.Denom()).Int64())
+	if lower == len(values)-1 {
+		L.Push(newDecimal(L, values[lower]))
+		return 1
+	}
+	frac := new(big.Rat).Sub(rank, big.NewRat(int64(lower), 1))
+	diff := new(big.Rat).Sub(values[lower+1], values[lower])
+	L.Push(newDecimal(L, diff.Add(values[lower], diff.Mul(diff, frac))))
+	return 1
+}
+
+// vmodeDecimalFunction is the decimal version of vmodeFunction.
+func vmodeDecimalFunction(L *lua.LState) int {
+	var values []*big.Rat
+	counts := make(map[string]int)
+	processDecimalTable(L, func(v *big.Rat) {
+		key := v.RatString()
+		if counts[key] == 0 {
+			values = append(values, v)
+		}
+		counts[key]++
+	})
+	modeVal, modeCount := new(big.Rat), 0
+	for _, v := range values {
+		if count := counts[v.RatString()]; count > modeCount {
+			modeVal, modeCount = v, count
+		}
+	}
+	L.Push(newDecimal(L, modeVal))
+	return 1
+}
+
+// valueString converts a Lua value into a string the way results are written to fields.
+func valueString(v lua.LValue) string {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return formatNumber(float64(v), "")
+	case lua.LString:
+		return string(v)
+	}
+	if x, ok := decimalValue(v); ok {
+		return formatDecimal(x, "")
+	}
+	return v.String()
+}
+
+// checkValueString returns the value at argument n as a string (see valueString).
+func checkValueString(L *lua.LState, n int) string {
+	return valueString(L.CheckAny(n))
+}
+
+// checkRegexp compiles the RE2 regular expression at argument n.
+func checkRegexp(L *lua.LState, n int) *regexp.Regexp {
+	re, err := regexp.Compile(L.CheckString(n))
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return re
+}
+
+// splitFunction is a Lua function to split a string by a separator: split(s, sep, n).
+// Returns an array of the parts, or only the n-th part (1-based, "" if there is none) if n is given.
+func splitFunction(L *lua.LState) int {
+	parts := strings.Split(checkValueString(L, 1), L.CheckString(2))
+	if L.GetTop() >= 3 {
+		n := L.CheckInt(3)
+		if n >= 1 && n <= len(parts) {
+			L.Push(lua.LString(parts[n-1]))
+		} else {
+			L.Push(lua.LString(""))
+		}
+		return 1
+	}
+	tbl := L.NewTable()
+	for _, part := range parts {
+		tbl.Append(lua.LString(part))
+	}
+	L.Push(tbl)
+	return 1
+}
+
+// trimFunction is a Lua function to remove leading and trailing white space,
+// or the characters in cutset if it is given: trim(s, cutset).
+func trimFunction(L *lua.LState) int {
+	str := checkValueString(L, 1)
+	if L.GetTop() >= 2 {
+		L.Push(lua.LString(strings.Trim(str, L.CheckString(2))))
+	} else {
+		L.Push(lua.LString(strings.TrimSpace(str)))
+	}
+	return 1
+}
+
+// upperFunction is a Lua function to convert a string to upper case.
+func upperFunction(L *lua.LState) int {
+	L.Push(lua.LString(strings.ToUpper(checkValueString(L, 1))))
+	return 1
+}
+
+// lowerFunction is a Lua function to convert a string to lower case.
+func lowerFunction(L *lua.LState) int {
+	L.Push(lua.LString(strings.ToLower(checkValueString(L, 1))))
+	return 1
+}
+
+// padFunction is a Lua function to pad a string to width characters: pad(s, width, char).
+// Like printf's %5s and %-5s, a positive width pads on the left and a negative width pads on the right.
+// char defaults to a space.
+func padFunction(L *lua.LState) int {
+	str := checkValueString(L, 1)
+	width := L.CheckInt(2)
+	char := L.OptString(3, " ")
+	if utf8.RuneCountInString(char) != 1 {
+		L.ArgError(3, "single character expected")
+	}
+	padding := strings.Repeat(char, max(0, abs(width)-utf8.RuneCountInString(str)))
+	if width < 0 {
+		L.Push(lua.LString(str + padding))
+	} else {
+		L.Push(lua.LString(padding + str))
+	}
+	return 1
+}
+
+// matchFunction is a Lua function to find a regular expression (RE2 syntax) in a string: match(s, pattern, group).
+// Returns the first match, or its group-th capture group if group is given, or nil if there is no match.
+func matchFunction(L *lua.LState) int {
+	str := checkValueString(L, 1)
+	re := checkRegexp(L, 2)
+	group := L.OptInt(3, 0)
+	if group < 0 || group > re.NumSubexp() {
+		L.ArgError(3, "no such capture group")
+	}
+	matches := re.FindStringSubmatch(str)
+	if matches == nil {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(lua.LString(matches[group]))
+	}
+	return 1
+}
+
+// replaceFunction is a Lua function to replace all matches of a regular expression (RE2 syntax):
+// replace(s, pattern, replacement). The replacement can refer to capture groups as $1 or ${name}.
+func replaceFunction(L *lua.LState) int {
+	str := checkValueString(L, 1)
+	re := checkRegexp(L, 2)
+	L.Push(lua.LString(re.ReplaceAllString(str, L.CheckString(3))))
+	return 1
+}
+
+// sprintfVerbRe matches a verb of a printf format.
+var sprintfVerbRe = sync.OnceValue(func() *regexp.Regexp {
+	return regexp.MustCompile(`%[-+ #0-9.]*[a-zA-Z%]`)
+})
+
+// sprintfFunction is a Lua function to format values with a Go printf format: sprintf(format, ...).
+// Numeric values are formatted like the printf format modifier of formulas, so %d rounds
+// toward zero and %.2f is exact for decimals; other values are formatted as strings, and are
+// an argument error with a numeric verb such as %d.
+func sprintfFunction(L *lua.LState) int {
+	format := L.CheckString(1)
+	arg := 2
+	var formatErr string
+	result := sprintfVerbRe().ReplaceAllStringFunc(format, func(verb string) string {
+		if verb == "%%" {
+			return "%"
+		}
+		if arg > L.GetTop() {
+			if formatErr == "" {
+				formatErr = fmt.Sprintf("missing argument for %s", verb)
+			}
+			return verb
+		}
+		value := L.Get(arg)
+		arg++
+		if x, ok := decimalValue(value); ok {
+			return formatDecimal(x, verb)
+		}
+		if strings.ContainsRune("dcoxXbeEfFgG", rune(verb[len(verb)-1])) {
+			f, ok := toFloat(value)
+			if !ok {
+				L.ArgError(arg-1, fmt.Sprintf("number expected for %s, got %s", verb, value.Type()))
+			}
+			return formatNumber(f, verb)
+		}
+		return fmt.Sprintf(verb, valueString(value))
+	})
+	if formatErr != "" {
+		L.RaiseError("sprintf: %s", formatErr)
+	}
+	L.Push(lua.LString(result))
+	return 1
+}
+
+// vjoinFunction is a Lua function to join the values of a range into a string: vjoin(range, sep).
+// sep defaults to ", ".
+func vjoinFunction(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	sep := L.OptString(2, ", ")
+	var parts []string
+	for i := 1; i <= tbl.Len(); i++ {
+		parts = append(parts, valueString(tbl.RawGetInt(i)))
+	}
+	L.Push(lua.LString(strings.Join(parts, sep)))
+	return 1
+}
+
+// vuniqueFunction is a Lua function to remove duplicate values from a range, keeping the first ones.
+// Values are compared by their string forms.
+func vuniqueFunction(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	seen := make(map[string]struct{})
+	unique := L.NewTable()
+	for i := 1; i <= tbl.Len(); i++ {
+		value := tbl.RawGetInt(i)
+		key := valueString(value)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique.Append(value)
+	}
+	L.Push(unique)
 	return 1
 }
 
@@ -118,19 +893,22 @@ func processTable(L *lua.LState, processor func(float64)) {
 	}
 
 	tbl.ForEach(func(_, val lua.LValue) {
-		var f float64
-		var err error
-		switch v := val.(type) {
-		case lua.LNumber:
-			f = float64(v)
-		case lua.LString:
-			f, err = strconv.ParseFloat(string(v), 64)
-			if err != nil {
-				return // Skip non-numeric strings
-			}
-		default:
-			return // Skip other types
-		}
-		processor(f)
+		if f, ok := toFloat(val); ok {
+			processor(f)
+		} // Skip non-numeric strings and other types
+	})
+}
+
+// processDecimalTable is a helper to extract decimals from a Lua table at arg 1.
+func processDecimalTable(L *lua.LState, processor func(*big.Rat)) {
+	tbl := L.ToTable(1)
+	if tbl == nil {
+		return
+	}
+
+	tbl.ForEach(func(_, val lua.LValue) {
+		if x, ok := toDecimal(val); ok {
+			processor(x)
+		} // Skip non-numeric strings and other types
 	})
 }
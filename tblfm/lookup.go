@@ -0,0 +1,215 @@
+package tblfm
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// rangeGridKey is the metatable field of a range array that holds its grid.
+const rangeGridKey = "__grid"
+
+// rangeGrid is the two-dimensional shape of a range reference.
+// Unlike the range array, it keeps empty fields so that positions in it
+// correspond to rows and columns of the table.
+type rangeGrid struct {
+	rows   int
+	cols   int
+	values []lua.LValue // Field values in row-major order
+}
+
+// at returns the value at 1-based row r and column c.
+func (g *rangeGrid) at(r, c int) lua.LValue {
+	return g.values[(r-1)*g.cols+(c-1)]
+}
+
+// setRangeGrid attaches grid to the range array tbl.
+func setRangeGrid(L *lua.LState, tbl *lua.LTable, grid *rangeGrid) {
+	ud := L.NewUserData()
+	ud.Value = grid
+	mt := L.NewTable()
+	mt.RawSetString(rangeGridKey, ud)
+	L.SetMetatable(tbl, mt)
+}
+
+// checkGrid returns the grid of the range at argument n.
+// A Lua array without a grid (e.g., {1, 2, 3}) is treated as a single column.
+func checkGrid(L *lua.LState, n int) *rangeGrid {
+	tbl := L.CheckTable(n)
+	if mt, ok := L.GetMetatable(tbl).(*lua.LTable); ok {
+		if ud, ok := mt.RawGetString(rangeGridKey).(*lua.LUserData); ok {
+			if grid, ok := ud.Value.(*rangeGrid); ok {
+				return grid
+			}
+		}
+	}
+	grid := &rangeGrid{rows: tbl.Len(), cols: 1}
+	for i := 1; i <= grid.rows; i++ {
+		grid.values = append(grid.values, tbl.RawGetInt(i))
+	}
+	return grid
+}
+
+// lookupEqual reports whether a lookup key matches a value.
+// Numbers, decimals and numeric strings are compared by their numeric values,
+// and other values by their string forms.
+func lookupEqual(key, value lua.LValue) bool {
+	if x, ok := toDecimal(key); ok {
+		if y, ok := toDecimal(value); ok {
+			return x.Cmp(y) == 0
+		}
+		return false
+	}
+	if _, ok := toDecimal(value); ok {
+		return false
+	}
+	return lua.LVAsString(key) == lua.LVAsString(value) && key.Type() == value.Type()
+}
+
+// findKey returns the 1-based position of the first value in values that matches key, or 0 if there is none.
+func findKey(key lua.LValue, values []lua.LValue) int {
+	for i, value := range values {
+		if lookupEqual(key, value) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// nrowsFunction is a Lua function to get the number of rows of a range: nrows(range).
+func nrowsFunction(L *lua.LState) int {
+	L.Push(lua.LNumber(checkGrid(L, 1).rows))
+	return 1
+}
+
+// ncolsFunction is a Lua function to get the number of columns of a range: ncols(range).
+func ncolsFunction(L *lua.LState) int {
+	L.Push(lua.LNumber(checkGrid(L, 1).cols))
+	return 1
+}
+
+// indexFunction is a Lua function to get a value of a range by its position: index(range, r, c).
+// r and c are 1-based. If c is omitted, it is 1, or r is taken as the column for a single-row range.
+func indexFunction(L *lua.LState) int {
+	grid := checkGrid(L, 1)
+	r := L.CheckInt(2)
+	c := L.OptInt(3, 1)
+	if L.GetTop() < 3 && grid.rows == 1 {
+		r, c = 1, r
+	}
+	if r < 1 || r > grid.rows || c < 1 || c > grid.cols {
+		L.RaiseError("index: position (%d, %d) is outside the range of %d row(s) and %d column(s)", r, c, grid.rows, grid.cols)
+	}
+	L.Push(grid.at(r, c))
+	return 1
+}
+
+// vlookupFunction is a Lua function to look up a key in the first column of a range
+// and get the value in column c of the matching row: vlookup(key, range, c).
+// Raises an error if there is no matching row.
+func vlookupFunction(L *lua.LState) int {
+	key := L.CheckAny(1)
+	grid := checkGrid(L, 2)
+	c := L.CheckInt(3)
+	if c < 1 || c > grid.cols {
+		L.ArgError(3, "column out of range")
+	}
+	for r := 1; r <= grid.rows; r++ {
+		if lookupEqual(key, grid.at(r, 1)) {
+			L.Push(grid.at(r, c))
+			return 1
+		}
+	}
+	L.RaiseError("vlookup: key %s not found", lua.LVAsString(key))
+	return 0
+}
+
+// xlookupFunction is a Lua function to look up a key in a range and get the value at
+// the same position in another range: xlookup(key, keyRange, valueRange, default).
+// Both ranges are read in row-major order. If there is no match, default is returned,
+// or an error is raised if default is omitted.
+func xlookupFunction(L *lua.LState) int {
+	key := L.CheckAny(1)
+	keys := checkGrid(L, 2)
+	values := checkGrid(L, 3)
+	if len(keys.values) != len(values.values) {
+		L.RaiseError("xlookup: key range has %d value(s) but value range has %d", len(keys.values), len(values.values))
+	}
+	if i := findKey(key, keys.values); i > 0 {
+		L.Push(values.values[i-1])
+		return 1
+	}
+	if L.GetTop() >= 4 {
+		L.Push(L.Get(4))
+		return 1
+	}
+	L.RaiseError("xlookup: key %s not found", lua.LVAsString(key))
+	return 0
+}
+
+// xmatchFunction is a Lua function to get the 1-based position of a key in a range: xmatch(key, range).
+// The range is read in row-major order. Returns nil if there is no match.
+func xmatchFunction(L *lua.LState) int {
+	key := L.CheckAny(1)
+	grid := checkGrid(L, 2)
+	if i := findKey(key, grid.values); i > 0 {
+		L.Push(lua.LNumber(i))
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// matchedValues returns the values of the range at argument 3 in the positions where
+// the value of the criteria range at argument 1 satisfies the predicate at argument 2.
+// The ranges are aligned by position, so they must have the same number of fields.
+// If the value range is omitted, the criteria range is used. The predicate is either
+// a value to compare with (see lookupEqual) or a Lua function returning true for matching values.
+func matchedValues(L *lua.LState, name string) []lua.LValue {
+	criteria := checkGrid(L, 1)
+	predicate := L.CheckAny(2)
+	values := criteria
+	if L.GetTop() >= 3 {
+		values = checkGrid(L, 3)
+		if len(values.values) != len(criteria.values) {
+			L.RaiseError("%s: criteria range has %d field(s) but value range has %d", name, len(criteria.values), len(values.values))
+		}
+	}
+	var matched []lua.LValue
+	for i, criterion := range criteria.values {
+		var ok bool
+		if fn, isFunction := predicate.(*lua.LFunction); isFunction {
+			L.Push(fn)
+			L.Push(criterion)
+			L.Call(1, 1)
+			ok = lua.LVAsBool(L.Get(-1))
+			L.Pop(1)
+		} else {
+			ok = lookupEqual(predicate, criterion)
+		}
+		if ok {
+			matched = append(matched, values.values[i])
+		}
+	}
+	return matched
+}
+
+// conditionalFunction returns a Lua function that applies the vector function aggregate
+// to the values matched by matchedValues: vsumif(criteriaRange, predicate, sumRange).
+func conditionalFunction(name string, aggregate lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		matched := L.NewTable()
+		for _, value := range matchedValues(L, name) {
+			matched.Append(value)
+		}
+		L.SetTop(0)
+		L.Push(matched)
+		return aggregate(L)
+	}
+}
+
+// vcountifFunction is a Lua function to count the fields of a range that satisfy a predicate:
+// vcountif(range, predicate). See matchedValues for the predicate.
+func vcountifFunction(L *lua.LState) int {
+	matched := matchedValues(L, "vcountif")
+	L.Push(lua.LNumber(len(matched)))
+	return 1
+}
@@ -0,0 +1,1098 @@
+package tblfm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// chunkName is the name of compiled Lua chunks shown in error messages.
+const chunkName = "<string>"
+
+// Program is a set of TBLFM formulas compiled once and runnable on many tables.
+// References in the formulas are parsed when the program is compiled, and each
+// expression is compiled to a Lua function that reads cells through an accessor.
+type Program struct {
+	cfg      config
+	formulas []*compiledFormula
+}
+
+// compiledFormula is a TBLFM formula parsed into its parts.
+type compiledFormula struct {
+	index  int           // Position in the list of formulas (0-based)
+	text   string        // Original formula text
+	start  cellSpec      // Target start position (e.g., "@2$>" or "$4" or unspecified)
+	end    cellSpec      // Target end position (e.g., "@>>$>")
+	isSpan bool          // Whether the target is a range
+	after  cellSpec      // Column a created target column is inserted after (e.g., "${Total}" of "@after(${Total})")
+	expr   *expression   // Expression with parsed references
+	format formulaFormat // Format modifiers
+
+	// proto is the compiled Lua function of the expression. It receives the
+	// reference accessor as its argument. It is nil in literal (L) mode, where
+	// field values are part of the source code and are compiled for each cell.
+	proto *lua.FunctionProto
+	// decimalProto is proto compiled for decimal mode (see compileExpression).
+	decimalProto *lua.FunctionProto
+}
+
+// refAccessorName is the name of the local variable that holds the reference accessor in compiled chunks.
+const refAccessorName = "__ref"
+
+// Compile parses TBLFM formulas and compiles their expressions.
+// Empty formulas are skipped and compilation stops at "exit" unless WithIgnoreExit(true) is given.
+// The options are used as defaults for every Program.Run.
+func Compile(
+	formulas []string, // TBLFM formula strings
+	opts ...Option, // Functional options
+) (
+	program *Program,
+	err error,
+) {
+	program = &Program{
+		cfg: config{
+			headerRows: 1, // Default: has header
+		},
+	}
+	for _, opt := range opts {
+		opt(&program.cfg)
+	}
+
+	re := getRegexps()
+	for index, formula := range formulas {
+		formula = strings.TrimSpace(formula)
+		if formula == "" {
+			continue
+		}
+
+		if formula == "exit" {
+			if program.cfg.ignoreExit {
+				continue
+			} else {
+				break
+			}
+		}
+
+		// Parse formula
+		matches := re.formula.FindStringSubmatch(formula)
+		if matches == nil {
+			return nil, &FormulaError{Index: index, Formula: formula, Err: errors.New("invalid formula format")}
+		}
+		format, err := parseFormulaFormat(matches[re.formulaFormat])
+		if err != nil {
+			return nil, &FormulaError{Index: index, Formula: formula, Err: fmt.Errorf("invalid format: %w", err)}
+		}
+		f := &compiledFormula{
+			index:  index,
+			text:   formula,
+			start:  parseCellSpec(matches[re.formulaStartPosSpec]),
+			end:    parseCellSpec(matches[re.formulaEndPosSpec]),
+			isSpan: matches[re.formulaEndPosSpec] != "",
+			after:  parseCellSpec(matches[re.formulaAfter]),
+			expr:   parseExpression(matches[re.formulaExpression]),
+			format: format,
+		}
+
+		// Compile the expression with references replaced by accessor calls
+		// Decimal mode can also be enabled when running, so both versions are compiled
+		if !format.literal {
+			source := f.expr.source(func(i int) string {
+				return refAccessorName + "(" + strconv.Itoa(i+1) + ")"
+			})
+			if f.proto, err = compileExpression(source, false); err == nil {
+				f.decimalProto, err = compileExpression(source, true)
+			}
+			if err != nil {
+				return nil, &FormulaError{Index: index, Formula: formula, Err: err, op: "compiling"}
+			}
+		}
+		program.formulas = append(program.formulas, f)
+	}
+	return
+}
+
+// compileExpression compiles a Lua expression into a function that receives
+// the reference accessor and the comparator as its arguments.
+// In decimal mode, relational operators are replaced by comparator calls so that
+// decimal values can be compared with numbers.
+func compileExpression(expr string, decimal bool) (*lua.FunctionProto, error) {
+	prefix := "local " + refAccessorName + ", " + comparatorName + " = ... return "
+	chunk, err := parse.Parse(strings.NewReader(prefix+expr), chunkName)
+	if err != nil {
+		// References are replaced in expr, so columns would not match the formula
+		return nil, syntaxError(err, prefix, false)
+	}
+	if decimal {
+		rewriteComparisons(chunk)
+	}
+	return lua.Compile(chunk, chunkName)
+}
+
+// Run applies the compiled formulas to table and returns the modified table.
+// opts are applied on top of the options given to Compile; table-specific
+// options such as WithHlines are typically given here.
+func (p *Program) Run(
+	table [][]string, // Input table (modified in place)
+	opts ...Option, // Functional options
+) (
+	resultTable [][]string, // Updated table (or the same pointer)
+	err error,
+) {
+	return p.RunContext(context.Background(), table, opts...)
+}
+
+// RunContext is like Run but stops the evaluation when ctx is done, including
+// in the middle of a running Lua formula. The returned error wraps ctx.Err().
+func (p *Program) RunContext(
+	ctx context.Context, // Context to cancel the evaluation
+	table [][]string, // Input table (modified in place)
+	opts ...Option, // Functional options
+) (
+	resultTable [][]string, // Updated table (or the same pointer)
+	err error,
+) {
+	cfg := p.cfg
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	resultTable = table
+	if len(p.formulas) == 0 {
+		return
+	}
+
+	// Create the target columns that are not in the table yet
+	for _, f := range p.formulas {
+		if err = createTargetColumns(table, f, &cfg); err != nil {
+			return resultTable, &FormulaError{Index: f.index, Formula: f.text, Err: err}
+		}
+	}
+
+	tc := newTableContext(table, &cfg)
+
+	// Resolve target cells of each formula
+	targets := make([][]cellPos, len(p.formulas))
+	for i, f := range p.formulas {
+		if targets[i], err = f.targetCells(tc); err != nil {
+			return resultTable, &FormulaError{Index: f.index, Formula: f.text, Err: err}
+		}
+	}
+
+	// Determine evaluation order
+	order := make([]int, len(p.formulas))
+	for i := range order {
+		order[i] = i
+	}
+	if !cfg.asWrittenOrder {
+		if order, targets, err = orderFormulas(p.formulas, targets, tc, cfg.iterate > 0); err != nil {
+			return
+		}
+	}
+
+	// Create Lua state, limiting the evaluation time if requested
+	L := newLuaState(cfg.unsafeLua)
+	defer L.Close()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, cfg.timeout,
+			fmt.Errorf("time limit of %s exceeded: %w", cfg.timeout, context.DeadlineExceeded))
+		defer cancel()
+	}
+	if ctx.Done() != nil {
+		L.SetContext(ctx)
+	}
+
+	// Register built-in functions
+	registerBuiltinFunctions(L, &cfg)
+
+	rs := newRunState(L, tc, p.formulas, &cfg)
+	rs.ctx = ctx
+	rs.registerGoFunctions()
+
+	// Run the user-defined Lua chunks
+	if err = rs.loadChunks(); err != nil {
+		return
+	}
+
+	// Apply the formulas once, or repeatedly until the table reaches a fixed point
+	for pass := 1; ; pass++ {
+		var previous [][]string
+		if cfg.iterate > 0 {
+			previous = cloneTable(table)
+		}
+		if err = rs.evaluateFormulas(order, targets); err != nil {
+			return
+		}
+		if cfg.iterate <= 0 || tablesEqual(previous, table) {
+			break
+		}
+		if pass >= cfg.iterate {
+			return resultTable, fmt.Errorf("table did not converge after %d iterations", cfg.iterate)
+		}
+	}
+
+	return resultTable, nil
+}
+
+// cellPos is a 0-based position of a cell in a table.
+type cellPos struct {
+	row int
+	col int
+}
+
+// tableContext holds the information about a table needed to resolve references.
+type tableContext struct {
+	table        [][]string
+	dataStartRow int
+	headerColMap map[string]int
+	rowLabelMap  map[string][]int // Data rows (0-based) by the label in their key column, for @{label}
+	labelColumn  int              // Key column of the row labels (1-based)
+	hlines       []int
+	maxRowLen    int
+}
+
+// newTableContext creates a tableContext for table.
+func newTableContext(table [][]string, cfg *config) *tableContext {
+	tc := &tableContext{
+		table:       table,
+		rowLabelMap: make(map[string][]int),
+		labelColumn: max(cfg.labelColumn, 1),
+		hlines:      cfg.hlines,
+	}
+
+	// Determine data row start position
+	tc.dataStartRow = min(cfg.headerRows, len(table))
+
+	// Build header column map for ${header name} references
+	tc.headerColMap = headerColumns(table[:tc.dataStartRow])
+
+	// Build row label map for @{label} references
+	for rowIdx := tc.dataStartRow; rowIdx < len(table); rowIdx++ {
+		if tc.labelColumn <= len(table[rowIdx]) {
+			label := strings.TrimSpace(table[rowIdx][tc.labelColumn-1])
+			tc.rowLabelMap[label] = append(tc.rowLabelMap[label], rowIdx)
+		}
+	}
+
+	// Determine maximum row length for column parsing
+	for _, r := range table {
+		if len(r) > tc.maxRowLen {
+			tc.maxRowLen = len(r)
+		}
+	}
+	return tc
+}
+
+// resolveCellSpec resolves a cell specification to a 0-based position, where -1 means "any" (not specified).
+// currentRow and currentCol are 1-based positions used for relative references (0 if there is none).
+// rangeEnd tells whether the specification is the end of a range (see resolveRowSpec).
+func (tc *tableContext) resolveCellSpec(cs cellSpec, currentRow int, currentCol int, rangeEnd bool) (row int, col int, err error) {
+	if row, err = resolveRowSpec(cs.row, len(tc.table), currentRow, tc.hlines, tc.rowLabel, rangeEnd); err != nil {
+		return
+	}
+	col, err = resolveColSpec(cs.col, tc.maxRowLen, currentCol, tc.headerColMap)
+	return
+}
+
+// rowLabel returns the 0-based row whose key column holds label.
+// It is an error if no row or more than one row has the label.
+func (tc *tableContext) rowLabel(label string) (int, error) {
+	rows := tc.rowLabelMap[label]
+	switch len(rows) {
+	case 0:
+		return -1, fmt.Errorf("row label @{%s} not found in column $%d", label, tc.labelColumn)
+	case 1:
+		return rows[0], nil
+	default:
+		return -1, fmt.Errorf("row label @{%s} is ambiguous: found in rows @%d and @%d of column $%d", label, rows[0]+1, rows[1]+1, tc.labelColumn)
+	}
+}
+
+// resolveCellRef resolves a cell reference like @2$3 or $2 to a 0-based position.
+// If the row is not specified, the current row is used.
+func (tc *tableContext) resolveCellRef(cs cellSpec, currentRow int, currentCol int) (row int, col int, err error) {
+	// Determine source row using shared resolver
+	row = currentRow - 1 // 1-based to 0-based
+	if cs.row.kind != specNone {
+		if row, err = resolveRowSpec(cs.row, len(tc.table), currentRow, tc.hlines, tc.rowLabel, false); err != nil {
+			return
+		}
+	}
+
+	// Determine source column using shared resolver. Columns are bounded by the widest row,
+	// so that a cell beyond the end of a short row is an empty field like a cell outside the table.
+	col, err = resolveColSpec(cs.col, tc.maxRowLen, currentCol, tc.headerColMap)
+	return
+}
+
+// resolveRowRef resolves a standalone row reference like @2 to a 0-based position in the current column.
+func (tc *tableContext) resolveRowRef(cs cellSpec, currentRow int, currentCol int) (row int, col int, err error) {
+	row, err = resolveRowSpec(cs.row, len(tc.table), currentRow, tc.hlines, tc.rowLabel, false)
+	return row, currentCol - 1, err
+}
+
+// rangeBounds resolves a range reference like "@<..@>>" into 0-based row and column bounds (inclusive).
+func (tc *tableContext) rangeBounds(ref *reference, currentRow int, currentCol int) (startRow, endRow, startCol, endCol int, err error) {
+	startRow, startCol, err = tc.resolveCellSpec(ref.start, currentRow, currentCol, false)
+	if err != nil {
+		err = fmt.Errorf("invalid range start in %q: %w", ref.text, err)
+		return
+	}
+	endRow, endCol, err = tc.resolveCellSpec(ref.end, currentRow, currentCol, true)
+	if err != nil {
+		err = fmt.Errorf("invalid range end in %q: %w", ref.text, err)
+		return
+	}
+
+	// If only row is specified (no column), assume current column
+	if startCol == -1 && endCol == -1 {
+		startCol = currentCol - 1
+		endCol = currentCol - 1
+	}
+
+	// If only column is specified (no row):
+	// - If columns differ (horizontal range like $1..$4), use current row only
+	// - If columns are same (vertical range like $1..$1), iterate through all data rows
+	if startRow == -1 && endRow == -1 {
+		if startCol != endCol {
+			// Horizontal range: use current row
+			startRow = currentRow - 1
+			endRow = currentRow - 1
+		} else {
+			// Vertical range: iterate through all data rows
+			startRow = tc.dataStartRow
+			endRow = len(tc.table) - 1
+		}
+	}
+
+	return
+}
+
+// rangeCells returns the cells of a range reference in row-major order.
+func (tc *tableContext) rangeCells(ref *reference, currentRow int, currentCol int) ([]cellPos, error) {
+	startRow, endRow, startCol, endCol, err := tc.rangeBounds(ref, currentRow, currentCol)
+	if err != nil {
+		return nil, err
+	}
+	var cells []cellPos
+	for r := startRow; r >= 0 && r <= endRow && r < len(tc.table); r++ {
+		for c := startCol; c >= 0 && c <= endCol && c < tc.maxRowLen; c++ {
+			cells = append(cells, cellPos{r, c})
+		}
+	}
+	return cells, nil
+}
+
+// referencedCells returns the cells referenced by ref when evaluated at currentRow and currentCol (1-based).
+// A remote reference references no cells of this table.
+func (tc *tableContext) referencedCells(ref *reference, currentRow int, currentCol int) ([]cellPos, error) {
+	var row, col int
+	var err error
+	switch ref.kind {
+	case refRemote:
+		return nil, nil // Cells of other tables
+	case refRange:
+		return tc.rangeCells(ref, currentRow, currentCol)
+	case refRow:
+		row, col, err = tc.resolveRowRef(ref.start, currentRow, currentCol)
+	default:
+		row, col, err = tc.resolveCellRef(ref.start, currentRow, currentCol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []cellPos{{row, col}}, nil
+}
+
+// cellValue returns the value of a cell and whether the cell exists.
+func (tc *tableContext) cellValue(row int, col int) (string, bool) {
+	if row >= 0 && row < len(tc.table) && col >= 0 && col < len(tc.table[row]) {
+		return tc.table[row][col], true
+	}
+	return "", false
+}
+
+// headerColumns maps the header names of the columns to their 0-based indices. A column is named by
+// its field in the last header row, and with several header rows, also by its fields joined with a space,
+// skipping empty ones, which take precedence. For example, the header rows "Q1,," and "Sales,Cost"
+// name the columns "Q1 Sales" and "Sales", and "Cost".
+func headerColumns(headerRows [][]string) map[string]int {
+	headerColMap := make(map[string]int)
+	if len(headerRows) == 0 {
+		return headerColMap
+	}
+	for colIdx, headerName := range headerRows[len(headerRows)-1] {
+		headerColMap[headerName] = colIdx
+	}
+	if len(headerRows) == 1 {
+		return headerColMap
+	}
+	numCols := 0
+	for _, row := range headerRows {
+		numCols = max(numCols, len(row))
+	}
+	for colIdx := range numCols {
+		var names []string
+		for _, row := range headerRows {
+			if colIdx < len(row) && row[colIdx] != "" {
+				names = append(names, row[colIdx])
+			}
+		}
+		if len(names) > 0 {
+			headerColMap[strings.Join(names, " ")] = colIdx
+		}
+	}
+	return headerColMap
+}
+
+// createTargetColumns creates the columns of the target of f that are given by header names not in the table,
+// if WithCreateColumns(true) is given or the target has "@after". A column is inserted after the column
+// given by "@after", or appended after the last column, and the rows are padded with empty fields.
+func createTargetColumns(table [][]string, f *compiledFormula, cfg *config) error {
+	numHeaderRows := min(cfg.headerRows, len(table))
+	if numHeaderRows == 0 || (!cfg.createColumns && f.after.col.kind == specNone) {
+		return nil
+	}
+	for _, colSpec := range []spec{f.start.col, f.end.col} {
+		if colSpec.kind != specHeader {
+			continue
+		}
+		if _, ok := headerColumns(table[:numHeaderRows])[colSpec.name]; ok {
+			continue
+		}
+		// Append after the longest row by default
+		colIdx := 0
+		for _, row := range table {
+			colIdx = max(colIdx, len(row))
+		}
+		if f.after.col.kind != specNone {
+			headerRow := table[numHeaderRows-1]
+			afterIdx, err := resolveColSpec(f.after.col, len(headerRow), 0, headerColumns(table[:numHeaderRows]))
+			if err != nil {
+				return fmt.Errorf("invalid position of column %q: %w", colSpec.name, err)
+			}
+			colIdx = afterIdx + 1
+		}
+		for rowIdx, row := range table {
+			if len(row) < colIdx {
+				row = append(row, make([]string, colIdx-len(row))...)
+			}
+			table[rowIdx] = slices.Insert(row, colIdx, "")
+		}
+		// The name goes in the last header row, as in headerColumns
+		table[numHeaderRows-1][colIdx] = colSpec.name
+	}
+	return nil
+}
+
+// targetCells returns the cells targeted by the formula, in row-major order.
+func (f *compiledFormula) targetCells(tc *tableContext) ([]cellPos, error) {
+	table := tc.table
+
+	// Resolve start position (no current position for target specification)
+	targetStartRow, targetStartCol, err := tc.resolveCellSpec(f.start, 0, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target position: %w", err)
+	}
+
+	// Determine target range
+	targetRowStart, targetRowEnd := targetStartRow, targetStartRow
+	targetColStart, targetColEnd := targetStartCol, targetStartCol
+
+	// Resolve end position (if range specified)
+	if f.isSpan {
+		targetRowEnd, targetColEnd, err = tc.resolveCellSpec(f.end, 0, 0, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target end position: %w", err)
+		}
+	}
+
+	// Double loop: iterate over all rows and columns
+	var cells []cellPos
+	for rowIdx := tc.dataStartRow; rowIdx < len(table); rowIdx++ {
+		// Check if this row matches the target range
+		if targetRowStart != -1 && rowIdx < targetRowStart {
+			continue // Skip rows before start
+		}
+		if targetRowEnd != -1 && rowIdx > targetRowEnd {
+			continue // Skip rows after end
+		}
+
+		for colIdx := 0; colIdx < len(table[rowIdx]); colIdx++ {
+			// Check if this column matches the target range
+			if targetColStart != -1 && colIdx < targetColStart {
+				continue // Skip columns before start
+			}
+			if targetColEnd != -1 && colIdx > targetColEnd {
+				continue // Skip columns after end
+			}
+			cells = append(cells, cellPos{rowIdx, colIdx})
+		}
+	}
+	return cells, nil
+}
+
+// runState holds the state of a Program run shared with the reference accessor.
+type runState struct {
+	L         *lua.LState
+	tc        *tableContext
+	formulas  []*compiledFormula
+	fns       []*lua.LFunction // Compiled expression of each formula (nil in literal mode)
+	accessor  *lua.LFunction   // Reference accessor passed to compiled expressions
+	compare   *lua.LFunction   // Comparator passed to compiled expressions
+	cfg       *config
+	ctx       context.Context          // Context that stops the evaluation
+	remotes   map[string]*tableContext // Remote tables loaded so far by name
+	formula   *compiledFormula         // Formula being evaluated
+	current   cellPos                  // Cell being evaluated (0-based)
+	accessErr error                    // Error raised in the reference accessor or a Go function
+}
+
+// newRunState creates a runState and instantiates the compiled formulas in L.
+func newRunState(L *lua.LState, tc *tableContext, formulas []*compiledFormula, cfg *config) *runState {
+	rs := &runState{
+		L:        L,
+		tc:       tc,
+		formulas: formulas,
+		fns:      make([]*lua.LFunction, len(formulas)),
+		cfg:      cfg,
+		remotes:  make(map[string]*tableContext),
+	}
+	for i, f := range formulas {
+		proto := f.proto
+		if cfg.decimal {
+			proto = f.decimalProto
+		}
+		if proto != nil {
+			rs.fns[i] = L.NewFunctionFromProto(proto)
+		}
+	}
+	rs.accessor = L.NewFunction(rs.access)
+	rs.compare = L.NewFunction(compareFunction)
+	return rs
+}
+
+// luaValue converts a field value into a Lua value.
+// Empty fields become the value given by WithEmpty unless the N mode is set,
+// and in decimal mode, numeric fields become decimal values.
+func (rs *runState) luaValue(val string) lua.LValue {
+	if val == "" && !rs.formula.format.numeric {
+		switch rs.cfg.empty {
+		case EmptyAsNil:
+			return lua.LNil
+		case EmptyAsZero:
+			return rs.luaValue("0")
+		}
+		return lua.LString("")
+	}
+	if rs.cfg.decimal && rs.formula.format.duration == 0 {
+		if x, ok := parseDecimal(val); ok {
+			return newDecimal(rs.L, x)
+		}
+	}
+	return luaValue(val, rs.formula.format)
+}
+
+// access is the reference accessor. It takes the 1-based index of a reference
+// in the current formula and returns its value at the current cell.
+func (rs *runState) access(L *lua.LState) int {
+	refIdx := L.CheckInt(1)
+	refs := rs.formula.expr.refs
+	if refIdx < 1 || refIdx > len(refs) {
+		L.ArgError(1, "reference index out of range")
+	}
+	value, err := rs.refValue(refs[refIdx-1])
+	if err != nil {
+		rs.accessErr = err
+		L.RaiseError("%s", err.Error())
+	}
+	L.Push(value)
+	return 1
+}
+
+// refTable returns the table that ref points into and the reference within it.
+// For a remote reference, the remote table is loaded with the function given by WithRemote.
+func (rs *runState) refTable(ref *reference) (*tableContext, *reference, error) {
+	if ref.kind != refRemote {
+		return rs.tc, ref, nil
+	}
+	if tc, ok := rs.remotes[ref.remote]; ok {
+		return tc, ref.target, nil
+	}
+	var remote *RemoteTable
+	var err error
+	switch {
+	case rs.cfg.remoteTable != nil:
+		remote, err = rs.cfg.remoteTable(ref.remote)
+	case rs.cfg.remote != nil:
+		var table [][]string
+		table, err = rs.cfg.remote(ref.remote)
+		remote = &RemoteTable{Rows: table, HeaderRows: rs.cfg.headerRows}
+	default:
+		return nil, nil, fmt.Errorf("remote table %q: remote references are not enabled", ref.remote)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("remote table %q: %w", ref.remote, err)
+	}
+	tc := newTableContext(remote.Rows, &config{
+		headerRows:  max(remote.HeaderRows, 0),
+		hlines:      remote.Hlines,
+		labelColumn: rs.cfg.labelColumn,
+	})
+	rs.remotes[ref.remote] = tc
+	return tc, ref.target, nil
+}
+
+// refValue returns the Lua value of a reference at the current cell.
+// A range becomes a Lua array of the field values, where empty fields are
+// dropped unless the E mode is set. The array also carries the range as a
+// grid with its rows and columns, including empty fields, for the lookup
+// functions (see rangeGrid). A cell outside the table is an empty field.
+func (rs *runState) refValue(ref *reference) (lua.LValue, error) {
+	tc, ref, err := rs.refTable(ref)
+	if err != nil {
+		return nil, err
+	}
+	format := rs.formula.format
+	currentRow, currentCol := rs.current.row+1, rs.current.col+1
+	if ref.kind == refRange {
+		startRow, endRow, startCol, endCol, err := tc.rangeBounds(ref, currentRow, currentCol)
+		if err != nil {
+			return nil, err
+		}
+		endRow = min(endRow, len(tc.table)-1)
+		endCol = min(endCol, tc.maxRowLen-1)
+		grid := &rangeGrid{}
+		if startRow >= 0 && startCol >= 0 && startRow <= endRow && startCol <= endCol {
+			grid.rows, grid.cols = endRow-startRow+1, endCol-startCol+1
+		}
+		tbl := rs.L.NewTable()
+		for r := startRow; r < startRow+grid.rows; r++ {
+			for c := startCol; c < startCol+grid.cols; c++ {
+				val, _ := tc.cellValue(r, c)
+				value := rs.luaValue(val)
+				grid.values = append(grid.values, value)
+				// Skip empty fields unless the E mode is set
+				if val == "" && !format.keepEmpty {
+					continue
+				}
+				tbl.Append(value) // nil values are not appended
+			}
+		}
+		setRangeGrid(rs.L, tbl, grid)
+		return tbl, nil
+	}
+	cells, err := tc.referencedCells(ref, currentRow, currentCol)
+	if err != nil {
+		return nil, err
+	}
+	val, _ := tc.cellValue(cells[0].row, cells[0].col)
+	return rs.luaValue(val), nil
+}
+
+// literalSource returns the value of a reference at the current cell as Lua source code for the L mode.
+func (rs *runState) literalSource(ref *reference) (string, error) {
+	tc, ref, err := rs.refTable(ref)
+	if err != nil {
+		return "", err
+	}
+	format := rs.formula.format
+	currentRow, currentCol := rs.current.row+1, rs.current.col+1
+	cells, err := tc.referencedCells(ref, currentRow, currentCol)
+	if err != nil {
+		return "", err
+	}
+	if ref.kind == refRange {
+		var parts []string
+		for _, cell := range cells {
+			val, _ := tc.cellValue(cell.row, cell.col)
+			// Skip empty fields unless the E mode is set
+			if val == "" && !format.keepEmpty {
+				continue
+			}
+			parts = append(parts, rs.literal(val))
+		}
+		return "{" + strings.Join(parts, ",") + "}", nil
+	}
+	val, _ := tc.cellValue(cells[0].row, cells[0].col)
+	return rs.literal(val), nil
+}
+
+// literal returns a field value as Lua source code for the L mode.
+// Empty fields are written as the value given by WithEmpty (or 0 in the N mode),
+// and in decimal mode, numeric fields are wrapped in dec() to keep them exact.
+func (rs *runState) literal(val string) string {
+	if val == "" {
+		switch {
+		case rs.formula.format.numeric || rs.cfg.empty == EmptyAsZero:
+			return rs.literal("0")
+		case rs.cfg.empty == EmptyAsNil:
+			return "nil"
+		}
+		return `""`
+	}
+	if rs.formula.format.duration != 0 {
+		if seconds, ok := parseDuration(val); ok {
+			return formatNumber(seconds, "")
+		}
+	}
+	if rs.cfg.decimal {
+		if _, ok := parseDecimal(val); ok {
+			return "dec(" + strconv.Quote(val) + ")"
+		}
+	}
+	return val
+}
+
+// interrupted returns an error if the evaluation has to stop because the context
+// is canceled or the time limit is exceeded.
+func (rs *runState) interrupted() error {
+	if rs.ctx.Err() != nil {
+		return fmt.Errorf("formula evaluation stopped: %w", context.Cause(rs.ctx))
+	}
+	return nil
+}
+
+// loadChunks runs the Lua chunks given by WithLuaChunk.
+func (rs *runState) loadChunks() error {
+	for _, chunk := range rs.cfg.luaChunks {
+		proto, err := compileChunk(chunk, rs.cfg.decimal)
+		if err == nil {
+			rs.L.Push(rs.L.NewFunctionFromProto(proto))
+			rs.L.Push(rs.compare)
+			err = rs.L.PCall(1, 0, nil)
+		}
+		if err != nil {
+			if err := rs.interrupted(); err != nil {
+				return err
+			}
+			return fmt.Errorf("error loading Lua chunk %s: %w", chunk.name, runError(err))
+		}
+	}
+	return nil
+}
+
+// compileChunk compiles a Lua chunk into a function that receives the comparator as its argument.
+// As in compileExpression, relational operators are replaced by comparator calls in decimal mode,
+// so that the functions defined in the chunk can compare decimal values with numbers.
+// The comparator is declared on the first line, which keeps the line numbers of the chunk.
+func compileChunk(chunk luaChunk, decimal bool) (*lua.FunctionProto, error) {
+	prefix := "local " + comparatorName + " = ...; "
+	stmts, err := parse.Parse(strings.NewReader(prefix+chunk.code), chunk.name)
+	if err != nil {
+		return nil, syntaxError(err, prefix, true)
+	}
+	if decimal {
+		rewriteComparisons(stmts)
+	}
+	return lua.Compile(stmts, chunk.name)
+}
+
+// evaluateFormulas evaluates the formulas in the given order and writes the results to their target cells.
+func (rs *runState) evaluateFormulas(order []int, targets [][]cellPos) error {
+	for _, i := range order {
+		for _, cell := range targets[i] {
+			if err := rs.interrupted(); err != nil {
+				return err
+			}
+			// This cell is a target, evaluate the expression
+			start := time.Now()
+			resultStr, err := rs.evaluate(i, cell)
+			if rs.tracing(cell) {
+				rs.writeTrace(resultStr, err, time.Since(start))
+			}
+			if err != nil {
+				return &FormulaError{
+					Index:   rs.formula.index,
+					Formula: rs.formula.text,
+					Row:     cell.row + 1,
+					Col:     cell.col + 1,
+					Code:    rs.substitutedCode(),
+					Err:     err,
+					op:      "evaluating",
+				}
+			}
+
+			// Set result to target cell
+			rs.tc.table[cell.row][cell.col] = resultStr
+		}
+	}
+	return nil
+}
+
+// substitutedCode returns the expression of the current formula with references
+// replaced by their field values at the current cell, as in the L mode.
+// References that cannot be resolved are left as written.
+func (rs *runState) substitutedCode() string {
+	refs := rs.formula.expr.refs
+	return rs.formula.expr.source(func(i int) string {
+		literal, err := rs.literalSource(refs[i])
+		if err != nil {
+			return refs[i].text
+		}
+		return literal
+	})
+}
+
+// evaluate evaluates the i-th formula at cell and returns the result as a string.
+func (rs *runState) evaluate(i int, cell cellPos) (string, error) {
+	L := rs.L
+	rs.formula = rs.formulas[i]
+	rs.current = cell
+	rs.accessErr = nil
+
+	fn := rs.fns[i]
+	if fn == nil {
+		// Literal mode: substitute field values into the source code
+		var sourceErr error
+		source := rs.formula.expr.source(func(refIdx int) string {
+			literal, err := rs.literalSource(rs.formula.expr.refs[refIdx])
+			if err != nil && sourceErr == nil {
+				sourceErr = err
+			}
+			return literal
+		})
+		if sourceErr != nil {
+			return "", sourceErr
+		}
+		proto, err := compileExpression(source, rs.cfg.decimal)
+		if err != nil {
+			return "", err
+		}
+		fn = L.NewFunctionFromProto(proto)
+	}
+	L.Push(fn)
+	L.Push(rs.accessor)
+	L.Push(rs.compare)
+	if err := L.PCall(2, 1, nil); err != nil {
+		if err := rs.interrupted(); err != nil {
+			return "", err
+		}
+		if rs.accessErr != nil {
+			return "", rs.accessErr
+		}
+		return "", runError(err)
+	}
+
+	// Get the result from Lua stack
+	ret := L.Get(-1)
+	L.Pop(1)
+	if ret == lua.LNil && rs.cfg.nilResult == NilResultKeep {
+		return rs.tc.table[cell.row][cell.col], nil
+	}
+	return formatResult(ret, rs.formula.format), nil
+}
+
+// formatResult converts a Lua result value into a string according to the formula format.
+// In the duration modes, numeric results are seconds written as durations.
+// nil is written as an empty field.
+func formatResult(ret lua.LValue, format formulaFormat) string {
+	if ret == lua.LNil {
+		return ""
+	}
+	if format.duration != 0 {
+		if seconds, ok := toFloat(ret); ok {
+			return format.before + formatDuration(seconds, format.duration, format.printf) + format.after
+		}
+	}
+	switch v := ret.(type) {
+	case lua.LNumber:
+		return format.before + formatNumber(float64(v), format.printf) + format.after
+	case lua.LString:
+		// Numeric strings are formatted as numbers only when a printf format or "%%" is given
+		if format.printf != "" || format.after != "" {
+			if num, err := strconv.ParseFloat(string(v), 64); err == nil {
+				return format.before + formatNumber(num, format.printf) + format.after
+			}
+		}
+		return string(v)
+	case lua.LBool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case *lua.LUserData:
+		if x, ok := decimalValue(v); ok {
+			return format.before + formatDecimal(x, format.printf) + format.after
+		}
+		return fmt.Sprintf("%v", ret)
+	default:
+		return fmt.Sprintf("%v", ret)
+	}
+}
+
+// cloneTable returns a deep copy of table.
+func cloneTable(table [][]string) [][]string {
+	cloned := make([][]string, len(table))
+	for i, row := range table {
+		cloned[i] = slices.Clone(row)
+	}
+	return cloned
+}
+
+// tablesEqual reports whether two tables have the same cells.
+func tablesEqual(a, b [][]string) bool {
+	return slices.EqualFunc(a, b, slices.Equal)
+}
+
+// orderFormulas sorts formulas topologically by their cell dependencies.
+// Each target cell is owned by the last formula that targets it; the cells
+// a formula does not own are removed from its targets. A formula that
+// references cells owned by another formula is placed after that formula.
+// A formula that reads the cell it overrides, like @2$2=@2$2+1 after $2=$1*10,
+// reads the value of the formula written before it, which keeps the cell in its
+// targets and is placed first.
+// Formulas without dependencies between them keep their written order.
+// If allowCycles is true, a reference cycle is broken by evaluating the earliest
+// written formula in it first; otherwise it is reported as an error.
+// Returns the evaluation order and the owned target cells of each formula.
+func orderFormulas(formulas []*compiledFormula, targets [][]cellPos, tc *tableContext, allowCycles bool) (order []int, owned [][]cellPos, err error) {
+	// Formulas that target each cell, in written order
+	writers := make(map[cellPos][]int)
+	for i := range formulas {
+		for _, cell := range targets[i] {
+			if w := writers[cell]; len(w) == 0 || w[len(w)-1] != i {
+				writers[cell] = append(w, i)
+			}
+		}
+	}
+	// cellRefs returns the cells formula i references when it evaluates cell
+	cellRefs := func(i int, cell cellPos) ([]cellPos, error) {
+		var refs []cellPos
+		for _, ref := range formulas[i].expr.refs {
+			cells, err := tc.referencedCells(ref, cell.row+1, cell.col+1)
+			if err != nil {
+				f := formulas[i]
+				return nil, &FormulaError{Index: f.index, Formula: f.text, Row: cell.row + 1, Col: cell.col + 1, Err: err, op: "evaluating"}
+			}
+			refs = append(refs, cells...)
+		}
+		return refs, nil
+	}
+
+	// Formulas that evaluate each cell: the owner, and the formulas before it
+	// as long as the following one reads the cell
+	evaluators := make(map[cellPos][]int)
+	for i := range formulas {
+		for _, cell := range targets[i] {
+			if _, ok := evaluators[cell]; ok {
+				continue
+			}
+			w := writers[cell]
+			first := len(w) - 1
+			for ; first > 0; first-- {
+				refs, err := cellRefs(w[first], cell)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !slices.Contains(refs, cell) {
+					break
+				}
+			}
+			evaluators[cell] = w[first:]
+		}
+	}
+
+	// Build dependency edges: deps[i] holds the formulas that must run before formula i
+	owned = make([][]cellPos, len(formulas))
+	deps := make([]map[int]struct{}, len(formulas))
+	for i := range formulas {
+		deps[i] = make(map[int]struct{})
+		for _, cell := range targets[i] {
+			pos := slices.Index(evaluators[cell], i)
+			if pos < 0 {
+				continue
+			}
+			owned[i] = append(owned[i], cell)
+			refs, err := cellRefs(i, cell)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, ref := range refs {
+				if ref == cell {
+					// The cell itself holds the value of the previous evaluator, if any
+					if pos > 0 {
+						deps[i][evaluators[cell][pos-1]] = struct{}{}
+					}
+					continue
+				}
+				if w := writers[ref]; len(w) > 0 && w[len(w)-1] != i {
+					deps[i][w[len(w)-1]] = struct{}{}
+				}
+			}
+		}
+	}
+
+	// Kahn's algorithm, always picking the earliest written formula that is ready
+	done := make([]bool, len(formulas))
+	for len(order) < len(formulas) {
+		next := -1
+		for i := range formulas {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for j := range deps[i] {
+				if !done[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			if !allowCycles {
+				return nil, nil, cycleError(formulas, deps, done)
+			}
+			next = slices.Index(done, false)
+		}
+		done[next] = true
+		order = append(order, next)
+	}
+	return
+}
+
+// cycleError returns an error naming the formulas of a reference cycle
+// among the formulas that are not done yet.
+func cycleError(formulas []*compiledFormula, deps []map[int]struct{}, done []bool) error {
+	// Every remaining formula depends on another remaining formula,
+	// so following dependencies from any of them leads into a cycle.
+	visited := make(map[int]int) // formula index -> position in path
+	var path []int
+	current := slices.Index(done, false)
+	for {
+		if pos, ok := visited[current]; ok {
+			path = path[pos:]
+			break
+		}
+		visited[current] = len(path)
+		path = append(path, current)
+		next := -1
+		for j := range deps[current] {
+			if !done[j] && (next == -1 || j < next) {
+				next = j
+			}
+		}
+		current = next
+	}
+	// path lists dependencies backwards; report them in evaluation direction,
+	// starting from the earliest written formula
+	slices.Reverse(path)
+	first := slices.Index(path, slices.Min(path))
+	path = append(path[first:], path[:first]...)
+	var names []string
+	for _, i := range append(path, path[0]) {
+		names = append(names, fmt.Sprintf("%q", formulas[i].text))
+	}
+	return fmt.Errorf("reference cycle between formulas: %s", strings.Join(names, " -> "))
+}
@@ -0,0 +1,48 @@
+package tblfm
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// safeLibs are the Lua libraries opened by default. They cannot touch files,
+// processes or the environment.
+var safeLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// unsafeBaseFunctions are the base functions removed from the default Lua state
+// because they load code from files or strings.
+var unsafeBaseFunctions = []string{
+	"dofile",
+	"loadfile",
+	"load",
+	"loadstring",
+	"module",
+	"require",
+}
+
+// newLuaState creates a Lua state for evaluating formulas.
+// Unless unsafe is true, only the safe libraries (see safeLibs) are opened and
+// the base functions that load code are removed, so that formulas in a table
+// from an untrusted source cannot access files or run commands.
+func newLuaState(unsafe bool) *lua.LState {
+	if unsafe {
+		return lua.NewState()
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range safeLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeBaseFunctions {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
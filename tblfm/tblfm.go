@@ -2,11 +2,15 @@
 package tblfm
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -19,15 +23,59 @@ type Options []func(*config)
 
 // config holds the configuration for Apply.
 type config struct {
-	hasHeader  bool
+	headerRows int
 	ignoreExit bool
+	hlines     []int
+
+	asWrittenOrder bool
+	iterate        int
+	decimal        bool
+
+	remote      func(name string) ([][]string, error)
+	remoteTable func(name string) (*RemoteTable, error)
+	now         func() time.Time
+
+	unsafeLua bool
+	timeout   time.Duration
+
+	empty     EmptyMode
+	nilResult NilResultMode
+
+	labelColumn int
+
+	createColumns bool
+
+	trace       io.Writer
+	traceFilter func(index, row, col int) bool
+
+	luaChunks []luaChunk
+	functions []goFunction
+}
+
+// luaChunk is Lua code loaded before the formulas run.
+type luaChunk struct {
+	name string
+	code string
 }
 
 // WithHeader specifies whether the first row is a header row.
 // Default is true (has header).
 func WithHeader(hasHeader bool) Option {
 	return func(c *config) {
-		c.hasHeader = hasHeader
+		c.headerRows = 0
+		if hasHeader {
+			c.headerRows = 1
+		}
+	}
+}
+
+// WithHeaderRows specifies the number of header rows at the top of the table, which may be 0.
+// With several header rows, ${name} refers to the column whose header fields, joined with
+// a space after skipping empty ones, are name, or else whose field in the last header row is name.
+// Default is 1.
+func WithHeaderRows(n int) Option {
+	return func(c *config) {
+		c.headerRows = max(n, 0)
 	}
 }
 
@@ -39,25 +87,274 @@ func WithIgnoreExit(ignoreExit bool) Option {
 	}
 }
 
+// WithAsWrittenOrder specifies whether formulas are evaluated strictly in the order
+// they are given instead of in dependency order.
+// Default is false (dependency order).
+func WithAsWrittenOrder(asWritten bool) Option {
+	return func(c *config) {
+		c.asWrittenOrder = asWritten
+	}
+}
+
+// WithIterate specifies the maximum number of passes over the formulas.
+// If max is positive, the formulas are applied repeatedly until the table stops
+// changing, and an error is returned if it still changes after max passes.
+// Reference cycles between formulas are allowed in this mode.
+// Default is 0 (a single pass).
+func WithIterate(max int) Option {
+	return func(c *config) {
+		c.iterate = max
+	}
+}
+
+// WithDecimal specifies whether numbers are evaluated as exact decimals instead of floats.
+// In decimal mode, numeric fields become arbitrary-precision decimal values, so that
+// sums like 0.1+0.2 are exactly 0.3, and the vector functions calculate exactly.
+// Default is false (float).
+func WithDecimal(decimal bool) Option {
+	return func(c *config) {
+		c.decimal = decimal
+	}
+}
+
+// WithRemote specifies the function that loads the tables referenced by remote(name, ref).
+// The function receives the name given in the formula and returns the table
+// with its formulas already applied. The table has as many header rows as the table
+// referencing it, and no hlines. Without it, remote references are errors.
+func WithRemote(resolve func(name string) ([][]string, error)) Option {
+	return func(c *config) {
+		c.remote = resolve
+	}
+}
+
+// RemoteTable is a table referenced by remote(name, ref), with the header rows and
+// the hlines of its own, which ${name}, @I and @{label} references in it are resolved with.
+type RemoteTable struct {
+	Rows       [][]string
+	HeaderRows int   // Number of header rows (see WithHeaderRows)
+	Hlines     []int // Positions of the hlines (see WithHlines)
+}
+
+// WithRemoteTable is like WithRemote, but the function returns the table with its
+// header rows and hlines. It takes precedence over WithRemote.
+func WithRemoteTable(resolve func(name string) (*RemoteTable, error)) Option {
+	return func(c *config) {
+		c.remoteTable = resolve
+	}
+}
+
+// WithNow specifies the function that returns the current time for today() and now().
+// Default is time.Now. Giving a fixed time makes the results reproducible.
+func WithNow(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
+// WithUnsafeLua specifies whether all standard Lua libraries are available to formulas.
+// By default, only the base (without the functions that load code, such as dofile and require),
+// string, math and table libraries are opened, so that formulas cannot access files or run commands.
+// Enable this only for tables from trusted sources.
+func WithUnsafeLua(unsafe bool) Option {
+	return func(c *config) {
+		c.unsafeLua = unsafe
+	}
+}
+
+// WithTimeout specifies the time limit for applying the formulas to a table.
+// If the evaluation takes longer (e.g., because of an infinite loop in a formula),
+// it is aborted with an error. Default is 0 (no limit).
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.timeout = timeout
+	}
+}
+
+// WithLuaChunk adds Lua code that is run before the formulas, to define functions and variables
+// shared by them, like "tax = function(x) return x * 0.1 end". The chunks run in the order they are added,
+// in the same sandbox as the formulas. name is the chunk name shown in Lua error messages,
+// such as the name of the file the code is read from.
+func WithLuaChunk(name, code string) Option {
+	return func(c *config) {
+		c.luaChunks = append(slices.Clip(c.luaChunks), luaChunk{name: name, code: code})
+	}
+}
+
+// WithFunction registers a Go function that formulas can call by name, such as a currency
+// conversion with rates held by the program. The arguments and the result are converted
+// between Lua and Go values as described for Value. A function with the name of a built-in
+// function replaces it. If fn returns an error, the evaluation stops with a FormulaError wrapping it.
+func WithFunction(name string, fn func(args []Value) (Value, error)) Option {
+	return func(c *config) {
+		c.functions = append(slices.Clip(c.functions), goFunction{name: name, fn: fn})
+	}
+}
+
+// WithTrace specifies the writer to log each cell evaluation to, with the formula, the target cell,
+// the expression with references replaced by their field values, the result and the elapsed time, like
+//
+//	$3=$1*$2 at @2$3: 3*4 => "12" (8.2µs)
+//
+// Each entry is written with a single Write call. Default is nil (no trace).
+func WithTrace(w io.Writer) Option {
+	return func(c *config) {
+		c.trace = w
+	}
+}
+
+// WithTraceFilter specifies which cell evaluations are traced (see WithTrace).
+// filter is called with the index of the formula (0-based, in the order given to Compile or Apply)
+// and the target cell (1-based), and only the evaluations for which it returns true are logged.
+// Default is nil (all evaluations).
+func WithTraceFilter(filter func(index, row, col int) bool) Option {
+	return func(c *config) {
+		c.traceFilter = filter
+	}
+}
+
+// EmptyMode specifies the Lua value of empty fields.
+// A reference to a cell outside the table, or beyond the end of a short row,
+// is an empty field too, so it is 0 only with EmptyAsZero.
+type EmptyMode int
+
+const (
+	// EmptyAsString makes empty fields empty strings (""). This is the default.
+	EmptyAsString EmptyMode = iota
+	// EmptyAsNil makes empty fields nil.
+	EmptyAsNil
+	// EmptyAsZero makes empty fields 0.
+	EmptyAsZero
+)
+
+// emptyModeNames are the names of the empty modes used by ParseEmptyMode and String.
+var emptyModeNames = []string{"string", "nil", "zero"}
+
+// ParseEmptyMode returns the empty mode named "string", "nil" or "zero".
+func ParseEmptyMode(name string) (EmptyMode, error) {
+	if i := slices.Index(emptyModeNames, name); i >= 0 {
+		return EmptyMode(i), nil
+	}
+	return 0, fmt.Errorf("invalid empty mode %q (want one of %s)", name, strings.Join(emptyModeNames, ", "))
+}
+
+// String returns the name of the empty mode.
+func (m EmptyMode) String() string {
+	if m >= 0 && int(m) < len(emptyModeNames) {
+		return emptyModeNames[m]
+	}
+	return fmt.Sprintf("EmptyMode(%d)", int(m))
+}
+
+// WithEmpty specifies the Lua value of empty fields in expressions.
+// Regardless of the mode, empty fields are dropped from ranges unless the E mode
+// is set, and the N mode makes them 0. Default is EmptyAsString.
+func WithEmpty(mode EmptyMode) Option {
+	return func(c *config) {
+		c.empty = mode
+	}
+}
+
+// NilResultMode specifies what a formula that evaluates to nil does to its target cell.
+type NilResultMode int
+
+const (
+	// NilResultClear makes the target cell empty. This is the default.
+	NilResultClear NilResultMode = iota
+	// NilResultKeep leaves the target cell unchanged.
+	NilResultKeep
+)
+
+// nilResultModeNames are the names of the nil result modes used by ParseNilResultMode and String.
+var nilResultModeNames = []string{"clear", "keep"}
+
+// ParseNilResultMode returns the nil result mode named "clear" or "keep".
+func ParseNilResultMode(name string) (NilResultMode, error) {
+	if i := slices.Index(nilResultModeNames, name); i >= 0 {
+		return NilResultMode(i), nil
+	}
+	return 0, fmt.Errorf("invalid nil result mode %q (want one of %s)", name, strings.Join(nilResultModeNames, ", "))
+}
+
+// String returns the name of the nil result mode.
+func (m NilResultMode) String() string {
+	if m >= 0 && int(m) < len(nilResultModeNames) {
+		return nilResultModeNames[m]
+	}
+	return fmt.Sprintf("NilResultMode(%d)", int(m))
+}
+
+// WithNilResult specifies what a formula that evaluates to nil does to its target cell.
+// Default is NilResultClear.
+func WithNilResult(mode NilResultMode) Option {
+	return func(c *config) {
+		c.nilResult = mode
+	}
+}
+
+// WithLabelColumn specifies the key column (1-based) of the row labels referenced by @{label}.
+// Default is 1 (the first column).
+func WithLabelColumn(col int) Option {
+	return func(c *config) {
+		c.labelColumn = col
+	}
+}
+
+// WithCreateColumns specifies whether a target column given by a header name that is not in the table,
+// like ${Tax} in "${Tax}=${Total}*0.1", is created before the formulas are applied.
+// The column is appended with the name as its header, or inserted after the column given by "@after"
+// as in "${Tax}@after(${Total})=${Total}*0.1", and every row is padded with an empty field.
+// A target with "@after" creates its column even if this is false. Default is false.
+func WithCreateColumns(create bool) Option {
+	return func(c *config) {
+		c.createColumns = create
+	}
+}
+
+// WithHlines specifies the positions of horizontal separator lines (hlines).
+// Each position is the 0-based index of the table row that follows the
+// separator, so an hline between the header and the first data row is 1.
+// Hlines are referenced in row specifications as @I, @II, @-I, @+I, etc.
+func WithHlines(hlines []int) Option {
+	return func(c *config) {
+		c.hlines = hlines
+	}
+}
+
 // Base patterns for row/column specifications.
 // These are used to build more complex regular expressions.
 const (
 	// specValPat matches the value part of a row/column specification:
 	// - Absolute position: 1, 2, 3, ...
 	// - Relative position: -1, +2, ...
-	// - Special markers: <, <<, <<<, >, >>, >>>
-	// - Header name reference: {header name} (for columns only, when hasHeader is true)
-	specValPat = `[-+]?\d+|<{1,3}|>{1,3}|\{[^}]+\}`
+	// - Special markers with an optional offset: <, <<, <<<, >, >>, >>>, <+1, >-2, ...
+	// - Header name reference: {header name} (for columns only, when there are header rows)
+	specValPat = `[-+]?\d+|(?:<{1,3}|>{1,3})(?:[-+]\d+)?|\{[^}]+\}`
+
+	// rowValPat matches the value part of a row specification.
+	// In addition to specValPat, it accepts hline references with an optional offset:
+	// - Absolute hline: I, II, III, ... (first, second, third hline)
+	// - Relative hline: -I (first hline above), +I (first hline below), ...
+	// - Hline with an offset: I+1 (first row below the first hline), II-1 (first row above the second hline), ...
+	// - Row label with an offset: {TOTAL}-1 (the row above the row labeled TOTAL), ...
+	rowValPat = `\{[^}]+\}[-+]\d+|` + specValPat + `|[-+]?I+(?:[-+]\d+)?`
 
-	// rowSpecPat matches a row specification like @2, @-1, @<, @>>
-	rowSpecPat = `@(` + specValPat + `)`
+	// rowSpecPat matches a row specification like @2, @-1, @<, @>>, @I, @-II
+	rowSpecPat = `@(` + rowValPat + `)`
 
 	// colSpecPat matches a column specification like $3, $-1, $<, $>>, ${header name}
 	colSpecPat = `\$(` + specValPat + `)`
 
 	// cellSpecPat matches a cell specification (optional row + optional column)
-	// Examples: @2$3, $4, @3, @<$>, ${Price}
-	cellSpecPat = `(?:@(?:` + specValPat + `))?(?:\$(?:` + specValPat + `))?`
+	// Examples: @2$3, $4, @3, @<$>, ${Price}, @I$2
+	cellSpecPat = `(?:@(?:` + rowValPat + `))?(?:\$(?:` + specValPat + `))?`
+
+	// formatItemPat matches a single item of the format modifiers that follow
+	// a formula after ";": a literal percent sign %%, a printf-style format like %.2f,
+	// or a mode flag letter like N.
+	formatItemPat = `%%|%[-+ #0-9.]*[a-zA-Z]|[A-Za-z]`
+
+	// formatPat matches the whole format modifiers like "%.2f", "N", "%.1fNE"
+	formatPat = `(?:` + formatItemPat + `)+`
 )
 
 // regexps holds all compiled regular expressions used for TBLFM parsing.
@@ -65,7 +362,11 @@ type regexps struct {
 	formula             *regexp.Regexp
 	formulaStartPosSpec int // Capture group index for start position spec (e.g., "@2$3")
 	formulaEndPosSpec   int // Capture group index for end position spec (e.g., "@>>$>")
+	formulaAfter        int // Capture group index for the column a created target column follows (e.g., "${Total}" from "@after(${Total})")
 	formulaExpression   int // Capture group index for expression (e.g., "$2*$3")
+	formulaFormat       int // Capture group index for format modifiers (e.g., "%.2f" from ";%.2f")
+
+	formatItem *regexp.Regexp
 
 	cellRef        *regexp.Regexp
 	cellRefRowSpec int // Capture group index for row spec value (e.g., "2" from "@2")
@@ -81,6 +382,23 @@ type regexps struct {
 	rangeRef         *regexp.Regexp
 	rangeRefStartPos int // Capture group index for start position
 	rangeRefEndPos   int // Capture group index for end position
+
+	// Lua string literals, in which references are not replaced: "...", '...', [[...]]
+	stringLiteral *regexp.Regexp
+	stringMarker  *regexp.Regexp
+
+	columnRef        *regexp.Regexp
+	columnRefRowSpec int // Capture group index for the row spec (which makes it not a column reference)
+	columnRefColSpec int // Capture group index for col spec value
+	columnRefTrailer int // Capture group index for the text that follows ".."
+
+	// Remote reference regex: remote("rates.csv", @2$3), remote(rates.csv, ${Rate}..)
+	remoteRef           *regexp.Regexp
+	remoteRefQuotedName int // Capture group index for the quoted table name
+	remoteRefName       int // Capture group index for the unquoted table name
+	remoteRefStartPos   int // Capture group index for the (start) position
+	remoteRefRange      int // Capture group index for the range operator
+	remoteRefEndPos     int // Capture group index for the end position
 }
 
 // getRegexps returns all compiled regular expressions.
@@ -89,10 +407,17 @@ var getRegexps = sync.OnceValue(func() *regexps {
 	return &regexps{
 		// Formula parser: supports $4=$2*$3 (column), @3=@2 (row), @3$4=@2$2 (cell)
 		// Also supports range syntax: @2$>..@>>$>=@1$>
-		formula:             regexp.MustCompile(`^(` + cellSpecPat + `)(?:\.\.(` + cellSpecPat + `))?\s*=\s*(.+)$`),
+		// and trailing format modifiers: $4=$2*$3;%.2f
+		// and the position of a created target column: ${Tax}@after(${Total})=${Total}*0.1
+		formula:             regexp.MustCompile(`^(` + cellSpecPat + `)(?:\.\.(` + cellSpecPat + `))?(?:@after\((\$(?:` + specValPat + `))\))?\s*=\s*(.+?)(?:\s*;\s*(` + formatPat + `))?\s*$`),
 		formulaStartPosSpec: 1,
 		formulaEndPosSpec:   2,
-		formulaExpression:   3,
+		formulaAfter:        3,
+		formulaExpression:   4,
+		formulaFormat:       5,
+
+		// Split format modifiers into items like "%.2f", "N", "E"
+		formatItem: regexp.MustCompile(formatItemPat),
 
 		// Find cell references like @2$3, $2, $3, $-1, $-2 (with optional row)
 		// Supports <, <<, <<< (up to 3 levels) and >, >>, >>> (up to 3 levels)
@@ -114,522 +439,542 @@ var getRegexps = sync.OnceValue(func() *regexps {
 		rangeRef:         regexp.MustCompile(`(` + cellSpecPat + `)\.\.(` + cellSpecPat + `)`),
 		rangeRefStartPos: 1,
 		rangeRefEndPos:   2,
+
+		stringLiteral: regexp.MustCompile(`"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'|\[\[(?s:.*?)\]\]`),
+		stringMarker:  regexp.MustCompile(stringMarker + `(\d+)` + stringMarker),
+
+		// Find whole-column references like ${Amount}.. or $2.. that end a function argument
+		// Capture groups: 1=@row (must be empty), 2=row value, 3=col value, 4="," or ")" after ".."
+		columnRef:        regexp.MustCompile(`(` + rowSpecPat + `)?` + colSpecPat + `\.\.(\s*[,)])`),
+		columnRefRowSpec: 1,
+		columnRefColSpec: 3,
+		columnRefTrailer: 4,
+
+		remoteRef:           regexp.MustCompile(`remote\(\s*(?:"([^"]*)"|([^\s,()"]+))\s*,\s*(` + cellSpecPat + `)(\.\.)?(` + cellSpecPat + `)\s*\)`),
+		remoteRefQuotedName: 1,
+		remoteRefName:       2,
+		remoteRefStartPos:   3,
+		remoteRefRange:      4,
+		remoteRefEndPos:     5,
 	}
 })
 
-// resolveColSpec resolves a column specification to a 0-based column index.
-// colSpec can be: numeric (1-based), relative (-1), special (<, >, etc.), or header name ({name}).
-// Returns (-1, nil) if not specified, or (index, nil) on success, or (-1, error) on failure.
-func resolveColSpec(colSpec string, rowLen int, currentCol int, headerColMap map[string]int) (int, error) {
-	if colSpec == "" {
-		return -1, nil
-	}
-
-	switch colSpec {
-	case "<":
-		return 0, nil
-	case "<<":
-		return 1, nil
-	case "<<<":
-		return 2, nil
-	case ">":
-		return rowLen - 1, nil
-	case ">>":
-		return rowLen - 2, nil
-	case ">>>":
-		return rowLen - 3, nil
-	default:
-		// Check for header name reference: {header name}
-		if strings.HasPrefix(colSpec, "{") && strings.HasSuffix(colSpec, "}") {
-			headerName := colSpec[1 : len(colSpec)-1]
-			if colIdx, ok := headerColMap[headerName]; ok {
-				return colIdx, nil
+// formulaFormat holds the format modifiers given after ";" at the end of a formula.
+type formulaFormat struct {
+	printf    string // printf-style format for numeric results (e.g., "%.2f")
+	before    string // Percent signs written before numeric results, from "%%" (e.g., "%" for "%%%d")
+	after     string // Percent signs written after numeric results, from "%%" (e.g., "%" for "%.1f%%")
+	numeric   bool   // N: treat non-numeric field values as 0
+	keepEmpty bool   // E: keep empty fields in ranges
+	literal   bool   // L: substitute field values literally without quoting
+	duration  byte   // T, t or U: treat HH:MM[:SS] fields as durations (0 if not set)
+}
+
+// parseFormulaFormat parses format modifiers like "%.2f", "%%", "N", "E", "L", "T" or a combination of them such as "%.1f%%NE".
+func parseFormulaFormat(spec string) (format formulaFormat, err error) {
+	for _, item := range getRegexps().formatItem.FindAllString(spec, -1) {
+		if item == "%%" {
+			if format.printf == "" {
+				format.before += "%"
+			} else {
+				format.after += "%"
 			}
-			return -1, fmt.Errorf("header column %q not found (hasHeader may be false or header name is incorrect)", headerName)
+			continue
 		}
-
-		// Numeric column reference
-		colNum, _ := strconv.Atoi(colSpec)
-		if colNum > 0 {
-			colIdx := colNum - 1 // 1-based to 0-based
-			if rowLen > 0 && colIdx >= rowLen {
-				return -1, fmt.Errorf("column index $%d is out of range (max columns: %d)", colNum, rowLen)
+		if strings.HasPrefix(item, "%") {
+			if format.printf != "" {
+				return format, fmt.Errorf("multiple printf formats in %q", spec)
 			}
-			return colIdx, nil
-		} else if colNum < 0 && currentCol > 0 {
-			// Relative reference: $-1 means one column to the left
-			colIdx := currentCol - 1 + colNum
-			if colIdx < 0 {
-				return -1, fmt.Errorf("relative column reference $%d results in negative index", colNum)
+			format.printf = item
+			continue
+		}
+		switch item {
+		case "N":
+			format.numeric = true
+		case "E":
+			format.keepEmpty = true
+		case "L":
+			format.literal = true
+		case "T", "t", "U":
+			if format.duration != 0 {
+				return format, fmt.Errorf("multiple duration modes in %q", spec)
 			}
-			return colIdx, nil
+			format.duration = item[0]
+		default:
+			return format, fmt.Errorf("unknown format modifier %q in %q", item, spec)
 		}
 	}
-	return -1, nil
+	// Without a printf format, "%%" follows the number as written by default
+	if format.printf == "" {
+		format.before, format.after = "", format.before
+	}
+	return
 }
 
-// parseCellPosition parses a cell position specification like "@2$3", "$4", "@3", "${Price}"
-// Returns (row, col, err) where -1 means "any" (not specified)
-// currentRow and currentCol are 1-based positions used for relative references
-// headerColMap maps header names to 0-based column indices (for ${header name} syntax)
-func parseCellPosition(pos string, tableLen int, rowLen int, currentRow int, currentCol int, headerColMap map[string]int) (row int, col int, err error) {
-	row = -1
-	col = -1
-
-	if pos == "" {
-		return
+// luaValue converts a field value into a Lua value according to the formula format.
+// Numbers are converted to Lua numbers and other values to strings,
+// unless the N (non-numbers as 0) mode is set. In the duration modes,
+// HH:MM[:SS] fields are converted to numbers of seconds.
+func luaValue(cellValue string, format formulaFormat) lua.LValue {
+	if format.duration != 0 {
+		if seconds, ok := parseDuration(cellValue); ok {
+			return lua.LNumber(seconds)
+		}
 	}
-
-	re := getRegexps()
-	matches := re.cellPos.FindStringSubmatch(pos)
-	if matches == nil {
-		return
+	if num, err := strconv.ParseFloat(cellValue, 64); err == nil {
+		return lua.LNumber(num)
 	}
-
-	rowSpec := matches[re.cellPosRowSpec]
-	colSpec := matches[re.cellPosColSpec]
-
-	// Parse row
-	if rowSpec != "" {
-		switch rowSpec {
-		case "<":
-			row = 0 // First row (header if exists)
-		case "<<":
-			row = 1 // Second row
-		case "<<<":
-			row = 2 // Third row
-		case ">":
-			row = tableLen - 1
-		case ">>":
-			row = tableLen - 2
-		case ">>>":
-			row = tableLen - 3
-		default:
-			rowNum, _ := strconv.Atoi(rowSpec)
-			if rowNum > 0 {
-				row = rowNum - 1 // 1-based to 0-based
-			} else if rowNum < 0 && currentRow > 0 {
-				// Relative reference: @-1 means one row above current
-				row = currentRow - 1 + rowNum
-			}
-		}
+	if format.numeric {
+		return lua.LNumber(0)
 	}
-
-	// Parse column using shared resolver
-	col, err = resolveColSpec(colSpec, rowLen, currentCol, headerColMap)
-
-	return
+	return lua.LString(cellValue)
 }
 
-// Apply performs table calculations using TBLFM formulas on the input 2D array and returns the modified table.
-func Apply(
-	table [][]string, // Input table (modified in place)
-	formulas []string, // TBLFM formula strings
-	opts ...Option, // Functional options
-) (
-	resultTable [][]string, // Updated table (or the same pointer)
-	err error,
-) {
-	cfg := &config{
-		hasHeader: true, // Default: has header
+// formatNumber converts a numeric result into a string.
+// If printf is empty, integers are written without a fractional part
+// and other numbers with the minimum number of digits.
+func formatNumber(num float64, printf string) string {
+	if printf == "" {
+		if num == float64(int64(num)) {
+			return strconv.FormatInt(int64(num), 10)
+		}
+		return strconv.FormatFloat(num, 'f', -1, 64)
 	}
-	for _, opt := range opts {
-		opt(cfg)
+	switch printf[len(printf)-1] {
+	case 'd', 'c', 'o', 'x', 'X', 'b':
+		return fmt.Sprintf(printf, int64(num))
+	case 's', 'q', 'v':
+		return fmt.Sprintf(printf, formatNumber(num, ""))
+	default:
+		return fmt.Sprintf(printf, num)
 	}
+}
 
-	resultTable = table
+// specKind is the kind of a row or column specification.
+type specKind int
 
-	// If formulas are empty, do nothing
-	if len(formulas) == 0 {
-		return
-	}
+const (
+	specNone     specKind = iota // Not specified
+	specAbsolute                 // Absolute position: @2, $3
+	specRelative                 // Relative position: @-1, @+1, $-2
+	specFirst                    // Counted from the first: @<, @<<, @<<<, @<+1
+	specLast                     // Counted from the last: @>, @>>, @>>>, @>-2
+	specHeader                   // Header name: ${Price}, or row label: @{TOTAL}, @{TOTAL}-1
+	specHline                    // Hline: @I, @-I, @+II, @I+1
+)
 
-	// Determine data row start position
-	dataStartRow := 0
-	if cfg.hasHeader {
-		dataStartRow = 1
-	}
+// spec is a parsed row or column specification.
+type spec struct {
+	kind   specKind
+	text   string // Original text without the leading "@" or "$" (e.g., "-1", ">>", "{Price}", "II", ">-2")
+	n      int    // Position, offset, level of "<"/">", or hline count
+	sign   int    // Direction of a relative hline reference: -1 (above), +1 (below), 0 (absolute)
+	name   string // Header name or row label
+	offset int    // Offset from an anchor ("<", ">", hline or row label), e.g., -2 for ">-2"
+}
 
-	// Build header column map for ${header name} references
-	headerColMap := make(map[string]int)
-	if cfg.hasHeader && len(table) > 0 {
-		for colIdx, headerName := range table[0] {
-			headerColMap[headerName] = colIdx
+// parseSpec parses the value part of a row or column specification like "2", "-1", "+1", ">>", "{Price}",
+// "-II", or an anchor with an offset like "<+1", ">-2", "I+1" or "{TOTAL}-1".
+func parseSpec(text string) spec {
+	s := spec{text: text}
+	// Split the offset from the anchor
+	anchor := text
+	if strings.HasPrefix(text, "{") {
+		if i := strings.LastIndex(text, "}"); i >= 0 && i < len(text)-1 {
+			anchor = text[:i+1]
+			s.offset, _ = strconv.Atoi(text[i+1:])
 		}
+	} else if i := strings.LastIndexAny(text, "+-"); i > 0 {
+		anchor = text[:i]
+		s.offset, _ = strconv.Atoi(text[i:])
 	}
-
-	// Create Lua state
-	L := lua.NewState()
-	defer L.Close()
-
-	// Register built-in functions
-	registerBuiltinFunctions(L)
-
-	// Apply each formula in order
-	for _, formula := range formulas {
-		formula = strings.TrimSpace(formula)
-		if formula == "" {
-			continue
+	switch {
+	case text == "":
+		s.kind = specNone
+	case strings.Trim(anchor, "<") == "":
+		s.kind = specFirst
+		s.n = len(anchor)
+	case strings.Trim(anchor, ">") == "":
+		s.kind = specLast
+		s.n = len(anchor)
+	case strings.HasPrefix(anchor, "{") && strings.HasSuffix(anchor, "}"):
+		s.kind = specHeader
+		s.name = anchor[1 : len(anchor)-1]
+	case strings.HasSuffix(anchor, "I"):
+		s.kind = specHline
+		switch anchor[0] {
+		case '-':
+			s.sign = -1
+		case '+':
+			s.sign = 1
 		}
-
-		if formula == "exit" {
-			if cfg.ignoreExit {
-				continue
-			} else {
-				return
-			}
+		s.n = len(strings.TrimLeft(anchor, "-+"))
+	default:
+		s.n, _ = strconv.Atoi(text)
+		s.kind = specAbsolute
+		if text[0] == '-' || text[0] == '+' {
+			s.kind = specRelative
 		}
+	}
+	return s
+}
 
-		// Parse formula
-		re := getRegexps()
-		matches := re.formula.FindStringSubmatch(formula)
-		if matches == nil {
-			return resultTable, fmt.Errorf("invalid formula format: %s", formula)
+// resolveColSpec resolves a column specification to a 0-based column index.
+// colSpec can be: numeric (1-based), relative (-1), special (<, >, etc.), or header name ({name}).
+// Returns (-1, nil) if not specified, or (index, nil) on success, or (-1, error) on failure.
+func resolveColSpec(colSpec spec, rowLen int, currentCol int, headerColMap map[string]int) (int, error) {
+	switch colSpec.kind {
+	case specFirst:
+		return checkColIndex(colSpec, colSpec.n-1+colSpec.offset, rowLen)
+	case specLast:
+		return checkColIndex(colSpec, rowLen-colSpec.n+colSpec.offset, rowLen)
+	case specHeader:
+		// Header name reference: {header name}
+		if colIdx, ok := headerColMap[colSpec.name]; ok {
+			return colIdx, nil
 		}
-
-		// e.g., "@2$>" or "$4" or empty
-		startPosSpec := matches[re.formulaStartPosSpec]
-		endPosSpec := matches[re.formulaEndPosSpec] // e.g., "@>>$>" or empty (if no range)
-		expression := matches[re.formulaExpression]
-
-		// Determine maximum row length for column parsing
-		maxRowLen := 0
-		for _, r := range table {
-			if len(r) > maxRowLen {
-				maxRowLen = len(r)
+		return -1, fmt.Errorf("header column %q not found (hasHeader may be false or header name is incorrect)", colSpec.name)
+	case specAbsolute:
+		// Numeric column reference
+		if colSpec.n > 0 {
+			colIdx := colSpec.n - 1 // 1-based to 0-based
+			if rowLen > 0 && colIdx >= rowLen {
+				return -1, fmt.Errorf("column index $%d is out of range (max columns: %d)", colSpec.n, rowLen)
 			}
+			return colIdx, nil
 		}
+	case specRelative:
+		if currentCol <= 0 {
+			return -1, fmt.Errorf("relative column reference $%s requires a current column", colSpec.text)
+		}
+		// Relative reference: $-1 means one column to the left, $+1 one column to the right
+		colIdx := currentCol - 1 + colSpec.n
+		if colIdx < 0 {
+			return -1, fmt.Errorf("relative column reference $%d results in negative index", colSpec.n)
+		}
+		return checkColIndex(colSpec, colIdx, rowLen)
+	case specHline:
+		return -1, fmt.Errorf("hline reference $%s is not allowed for columns", colSpec.text)
+	}
+	return -1, nil
+}
 
-		// Parse start position (no current position for target specification)
-		targetStartRow, targetStartCol, err := parseCellPosition(startPosSpec, len(table), maxRowLen, 0, 0, headerColMap)
+// checkColIndex checks that the 0-based column index colIdx resolved from colSpec is in a row of rowLen columns.
+// Any index is accepted if rowLen is 0 (unknown).
+func checkColIndex(colSpec spec, colIdx int, rowLen int) (int, error) {
+	if colIdx < 0 {
+		return -1, fmt.Errorf("column reference $%s is before the first column", colSpec.text)
+	}
+	if rowLen > 0 && colIdx >= rowLen {
+		return -1, fmt.Errorf("column reference $%s is out of range (max columns: %d)", colSpec.text, rowLen)
+	}
+	return colIdx, nil
+}
+
+// resolveRowSpec resolves a row specification to a 0-based row index.
+// rowSpec can be: numeric (1-based), relative (-1), special (<, >, etc.), hline (I, -I, +II), or row label ({TOTAL}).
+// currentRow is the 1-based current row used for relative references (0 if there is none).
+// rowLabel resolves a row label of @{label} to a 0-based row.
+// rangeEnd tells whether the specification is the end of a range, in which case
+// an hline reference resolves to the row above the hline instead of the row below it.
+// Returns (-1, nil) if not specified or not resolvable, (index, nil) on success, or (-1, error) on failure.
+func resolveRowSpec(rowSpec spec, tableLen int, currentRow int, hlines []int, rowLabel func(label string) (int, error), rangeEnd bool) (int, error) {
+	switch rowSpec.kind {
+	case specFirst:
+		return checkRowIndex(rowSpec, rowSpec.n-1+rowSpec.offset) // First row (header if exists), second row, ...
+	case specLast:
+		return checkRowIndex(rowSpec, tableLen-rowSpec.n+rowSpec.offset)
+	case specHline:
+		hline, err := resolveHlineSpec(rowSpec, currentRow, hlines)
 		if err != nil {
-			return resultTable, fmt.Errorf("invalid target position %q: %w", startPosSpec, err)
+			return -1, err
 		}
-
-		// Parse end position (if range specified)
-		var targetEndRow, targetEndCol = -1, -1
-		if endPosSpec != "" {
-			targetEndRow, targetEndCol, err = parseCellPosition(endPosSpec, len(table), maxRowLen, 0, 0, headerColMap)
-			if err != nil {
-				return resultTable, fmt.Errorf("invalid target end position %q: %w", endPosSpec, err)
+		// An offset counts rows from the hline: +1 is the first row below it, -1 the first row above it
+		if rowSpec.offset > 0 {
+			return hline + rowSpec.offset - 1, nil
+		} else if rowSpec.offset < 0 {
+			return checkRowIndex(rowSpec, hline+rowSpec.offset)
+		}
+		if rangeEnd {
+			if hline == 0 {
+				return -1, fmt.Errorf("range end @%s is above the first row", rowSpec.text)
 			}
+			return hline - 1, nil
 		}
-
-		// Determine target range
-		var targetRowStart, targetRowEnd int
-		var targetColStart, targetColEnd int
-
-		if endPosSpec == "" {
-			// Single cell or column/row specification
-			targetRowStart = targetStartRow
-			targetRowEnd = targetStartRow
-			targetColStart = targetStartCol
-			targetColEnd = targetStartCol
-		} else {
-			// Range specification
-			targetRowStart = targetStartRow
-			targetRowEnd = targetEndRow
-			targetColStart = targetStartCol
-			targetColEnd = targetEndCol
+		return hline, nil
+	case specAbsolute:
+		if rowSpec.n > 0 {
+			return rowSpec.n - 1, nil // 1-based to 0-based
 		}
+	case specRelative:
+		if currentRow <= 0 {
+			return -1, fmt.Errorf("relative row reference @%s requires a current row", rowSpec.text)
+		}
+		// Relative reference: @-1 means one row above current, @+1 one row below
+		return checkRowIndex(rowSpec, currentRow-1+rowSpec.n)
+	case specHeader:
+		rowIdx, err := rowLabel(rowSpec.name)
+		if err != nil {
+			return -1, err
+		}
+		return checkRowIndex(rowSpec, rowIdx+rowSpec.offset)
+	}
+	return -1, nil
+}
 
-		// Double loop: iterate over all rows and columns
-		for rowIdx := dataStartRow; rowIdx < len(table); rowIdx++ {
-			row := table[rowIdx]
-
-			// Check if this row matches the target range
-			if targetRowStart != -1 && rowIdx < targetRowStart {
-				continue // Skip rows before start
-			}
-			if targetRowEnd != -1 && rowIdx > targetRowEnd {
-				continue // Skip rows after end
-			}
+// checkRowIndex checks that the 0-based row index rowIdx resolved from rowSpec is not above the first row.
+// A row below the last row is accepted; its cells are missing.
+func checkRowIndex(rowSpec spec, rowIdx int) (int, error) {
+	if rowIdx < 0 {
+		return -1, fmt.Errorf("row reference @%s is above the first row", rowSpec.text)
+	}
+	return rowIdx, nil
+}
 
-			for colIdx := 0; colIdx < len(row); colIdx++ {
-				// Check if this column matches the target range
-				if targetColStart != -1 && colIdx < targetColStart {
-					continue // Skip columns before start
-				}
-				if targetColEnd != -1 && colIdx > targetColEnd {
-					continue // Skip columns after end
+// resolveHlineSpec resolves an hline specification like "I", "-II" or "+I" to the
+// position of the hline, i.e. the 0-based index of the row that follows it.
+// Relative hline references (-I, +I) are counted from currentRow (1-based).
+func resolveHlineSpec(hlineSpec spec, currentRow int, hlines []int) (int, error) {
+	var candidates []int
+	switch hlineSpec.sign {
+	case 0:
+		candidates = hlines
+	default:
+		if currentRow <= 0 {
+			return -1, fmt.Errorf("relative hline reference @%s requires a current row", hlineSpec.text)
+		}
+		rowIdx := currentRow - 1
+		if hlineSpec.sign > 0 {
+			for _, hline := range hlines {
+				if hline > rowIdx {
+					candidates = append(candidates, hline)
 				}
-
-				// This cell is a target, evaluate the expression
-				currentRow := rowIdx + 1 // 1-based
-				currentCol := colIdx + 1 // 1-based
-
-				// Evaluate the expression using Lua
-				resultStr, err := evaluateExpression(L, expression, table, currentRow, currentCol, dataStartRow, headerColMap)
-				if err != nil {
-					return resultTable, fmt.Errorf("error evaluating formula %s at @%d$%d: %w", formula, currentRow, currentCol, err)
+			}
+		} else {
+			// Nearest hline above the current row comes first
+			for i := len(hlines) - 1; i >= 0; i-- {
+				if hlines[i] <= rowIdx {
+					candidates = append(candidates, hlines[i])
 				}
-
-				// Set result to target cell
-				table[rowIdx][colIdx] = resultStr
 			}
 		}
 	}
 
-	return resultTable, nil
+	if hlineSpec.n > len(candidates) {
+		return -1, fmt.Errorf("hline reference @%s not found (%d hline(s) available)", hlineSpec.text, len(candidates))
+	}
+	return candidates[hlineSpec.n-1], nil
 }
 
-// evaluateExpression evaluates a Lua expression with cell references replaced by actual values
-func evaluateExpression(L *lua.LState, expression string, table [][]string, currentRow int, currentCol int, dataStartRow int, headerColMap map[string]int) (string, error) {
-	// Replace cell and row references with Lua code
-	evaluableExpr := expression
+// cellSpec is a parsed cell specification like "@2$3", "$4", "@3" or "${Price}".
+type cellSpec struct {
+	row spec
+	col spec
+}
 
-	// First, replace range references with Lua table literals
+// parseCellSpec parses a cell specification like "@2$3", "$4", "@3", "${Price}".
+// An empty string or a string that is not a cell specification yields an unspecified cell.
+func parseCellSpec(pos string) (cs cellSpec) {
 	re := getRegexps()
-	var replaceErr error
-	evaluableExpr = re.rangeRef.ReplaceAllStringFunc(evaluableExpr, func(rangeRef string) string {
-		if replaceErr != nil {
-			return rangeRef // Skip processing if error already occurred
-		}
-
-		matches := re.rangeRef.FindStringSubmatch(rangeRef)
-		if matches == nil {
-			return rangeRef
-		}
+	matches := re.cellPos.FindStringSubmatch(pos)
+	if matches == nil {
+		return
+	}
+	cs.row = parseSpec(matches[re.cellPosRowSpec])
+	cs.col = parseSpec(matches[re.cellPosColSpec])
+	return
+}
 
-		startPos := matches[re.rangeRefStartPos]
-		endPos := matches[re.rangeRefEndPos]
+// refKind is the kind of a reference in an expression.
+type refKind int
 
-		if startPos == "" || endPos == "" {
-			return rangeRef
-		}
+const (
+	refCell   refKind = iota // Cell reference: @2$3, $2, ${Price}
+	refRow                   // Row reference: @2 (the current column of the row)
+	refRange                 // Range reference: @2$3..@5$3, @<..@>>, ${Q1}..${Q4}, ${Amount}..
+	refRemote                // Remote reference: remote("rates.csv", @2$3)
+)
 
-		// Expand the range into a Lua table
-		values, err := expandRange(startPos, endPos, table, currentRow, currentCol, dataStartRow, headerColMap)
-		if err != nil {
-			replaceErr = err
-			return rangeRef
-		}
+// reference is a parsed reference to cells in an expression.
+type reference struct {
+	kind  refKind
+	text  string   // Original text of the reference
+	start cellSpec // The cell, or the start of the range
+	end   cellSpec // The end of the range (refRange only)
 
-		// Convert to Lua table literal string
-		var parts []string
-		for _, v := range values {
-			switch val := v.(type) {
-			case float64:
-				parts = append(parts, strconv.FormatFloat(val, 'f', -1, 64))
-			case string:
-				// Skip empty strings in numeric contexts
-				if val != "" {
-					// Quote strings
-					parts = append(parts, fmt.Sprintf("%q", val))
-				}
-			default:
-				parts = append(parts, fmt.Sprintf("%v", val))
-			}
-		}
+	remote string     // Name of the remote table (refRemote only)
+	target *reference // Reference in the remote table (refRemote only)
+}
 
-		return "{" + strings.Join(parts, ",") + "}"
-	})
-	if replaceErr != nil {
-		return "", replaceErr
+// parseRemoteTarget parses the reference in a remote table of remote(name, ref).
+// A column without a row (e.g., $3 or ${Rate}..) stands for the whole column.
+func parseRemoteTarget(text, startPos string, isRange bool, endPos string) *reference {
+	start := parseCellSpec(startPos)
+	if isRange && endPos != "" {
+		return &reference{kind: refRange, text: text, start: start, end: parseCellSpec(endPos)}
+	}
+	switch {
+	case start.row.kind == specNone:
+		return &reference{kind: refRange, text: text, start: start, end: start}
+	case start.col.kind == specNone:
+		return &reference{kind: refRow, text: text, start: start}
+	default:
+		return &reference{kind: refCell, text: text, start: start}
 	}
+}
 
-	// Then, replace cell references (with optional row) like @2$3, $2, ${Price}
-	evaluableExpr = re.cellRef.ReplaceAllStringFunc(evaluableExpr, func(ref string) string {
-		if replaceErr != nil {
-			return ref // Skip processing if error already occurred
-		}
+// expression is a Lua expression parsed into text pieces and references.
+// The references come between the text pieces: texts[0], refs[0], texts[1], refs[1], ..., texts[len(refs)].
+type expression struct {
+	texts []string
+	refs  []*reference
+}
 
-		matches := re.cellRef.FindStringSubmatch(ref)
-		if matches == nil {
-			return ref
-		}
+// refPlaceholder marks the position of a reference while an expression is parsed.
+const refPlaceholder = "\x00"
 
-		rowSpec := matches[re.cellRefRowSpec]
-		colSpec := matches[re.cellRefColSpec]
+// stringMarker marks the position of a string literal while an expression is parsed.
+const stringMarker = "\x01"
 
-		// Determine source row
-		var sourceRow int
-		if rowSpec == "" {
-			sourceRow = currentRow - 1 // 1-based to 0-based
-		} else {
-			switch rowSpec {
-			case "<":
-				sourceRow = 0
-			case "<<":
-				sourceRow = 1
-			case "<<<":
-				sourceRow = 2
-			case ">":
-				sourceRow = len(table) - 1
-			case ">>":
-				sourceRow = len(table) - 2
-			case ">>>":
-				sourceRow = len(table) - 3
-			default:
-				rowNum, _ := strconv.Atoi(rowSpec)
-				if rowNum < 0 {
-					sourceRow = currentRow - 1 + rowNum
-				} else {
-					sourceRow = rowNum - 1
-				}
-			}
-		}
+// parseExpression parses references in a Lua expression.
+// References are found in this order: ranges, cell references, then row references.
+func parseExpression(expr string) *expression {
+	re := getRegexps()
+	var refs []*reference
+	placeholder := func(ref *reference) string {
+		refs = append(refs, ref)
+		return refPlaceholder + strconv.Itoa(len(refs)-1) + refPlaceholder
+	}
 
-		// Determine source column using shared resolver
-		rowLen := 0
-		if sourceRow >= 0 && sourceRow < len(table) {
-			rowLen = len(table[sourceRow])
-		}
-		sourceCol, err := resolveColSpec(colSpec, rowLen, currentCol, headerColMap)
-		if err != nil {
-			replaceErr = err
-			return ref
+	// First, replace remote references, whose references point into other tables
+	expr = re.remoteRef.ReplaceAllStringFunc(expr, func(text string) string {
+		matches := re.remoteRef.FindStringSubmatch(text)
+		startPos := matches[re.remoteRefStartPos]
+		if startPos == "" {
+			return text
 		}
+		name := matches[re.remoteRefQuotedName] + matches[re.remoteRefName]
+		target := parseRemoteTarget(text, startPos, matches[re.remoteRefRange] != "", matches[re.remoteRefEndPos])
+		return placeholder(&reference{kind: refRemote, text: text, remote: name, target: target})
+	})
 
-		// Get the cell value
-		if sourceRow >= 0 && sourceRow < len(table) &&
-			sourceCol >= 0 && sourceCol < len(table[sourceRow]) {
-			cellValue := table[sourceRow][sourceCol]
-
-			// Try to parse as number
-			if num, err := strconv.ParseFloat(cellValue, 64); err == nil {
-				return strconv.FormatFloat(num, 'f', -1, 64)
-			}
-
-			// Return as quoted string
-			return fmt.Sprintf("%q", cellValue)
-		}
-		return "0"
+	// Then, set aside string literals so that text like "$1" in them is kept as is
+	var literals []string
+	expr = re.stringLiteral.ReplaceAllStringFunc(expr, func(text string) string {
+		literals = append(literals, text)
+		return stringMarker + strconv.Itoa(len(literals)-1) + stringMarker
 	})
-	if replaceErr != nil {
-		return "", replaceErr
-	}
 
-	// Then, replace standalone row references like @<, @<<, @> (for row copy operations)
-	evaluableExpr = re.rowRef.ReplaceAllStringFunc(evaluableExpr, func(ref string) string {
-		matches := re.rowRef.FindStringSubmatch(ref)
-		if matches == nil {
-			return ref
+	// Then, replace whole-column references like ${Amount}.. that are followed by "," or ")",
+	// where ".." cannot be the Lua concatenation operator
+	expr = re.columnRef.ReplaceAllStringFunc(expr, func(text string) string {
+		matches := re.columnRef.FindStringSubmatch(text)
+		if matches[re.columnRefRowSpec] != "" {
+			return text
 		}
+		trailer := matches[re.columnRefTrailer]
+		col := cellSpec{col: parseSpec(matches[re.columnRefColSpec])}
+		refText := strings.TrimSuffix(text, trailer)
+		return placeholder(&reference{kind: refRange, text: refText, start: col, end: col}) + trailer
+	})
 
-		rowSpec := matches[re.rowRefRowSpec]
-		var sourceRow int
-
-		switch rowSpec {
-		case "<":
-			sourceRow = 0
-		case "<<":
-			sourceRow = 1
-		case "<<<":
-			sourceRow = 2
-		case ">":
-			sourceRow = len(table) - 1
-		case ">>":
-			sourceRow = len(table) - 2
-		case ">>>":
-			sourceRow = len(table) - 3
-		default:
-			rowNum, _ := strconv.Atoi(rowSpec)
-			if rowNum < 0 {
-				sourceRow = currentRow - 1 + rowNum
-			} else {
-				sourceRow = rowNum - 1
-			}
+	// Then, replace range references
+	expr = re.rangeRef.ReplaceAllStringFunc(expr, func(text string) string {
+		matches := re.rangeRef.FindStringSubmatch(text)
+		startPos := matches[re.rangeRefStartPos]
+		endPos := matches[re.rangeRefEndPos]
+		// ".." alone is the Lua concatenation operator
+		if startPos == "" || endPos == "" {
+			return text
 		}
+		return placeholder(&reference{kind: refRange, text: text, start: parseCellSpec(startPos), end: parseCellSpec(endPos)})
+	})
 
-		// For row copy operations, return the value from the same column in the source row
-		if sourceRow >= 0 && sourceRow < len(table) &&
-			currentCol-1 >= 0 && currentCol-1 < len(table[sourceRow]) {
-			cellValue := table[sourceRow][currentCol-1]
-
-			// Try to parse as number
-			if num, err := strconv.ParseFloat(cellValue, 64); err == nil {
-				return strconv.FormatFloat(num, 'f', -1, 64)
-			}
-
-			// Return as quoted string
-			return fmt.Sprintf("%q", cellValue)
-		}
-		return "0"
+	// Then, replace cell references (with optional row) like @2$3, $2, ${Price}
+	expr = re.cellRef.ReplaceAllStringFunc(expr, func(text string) string {
+		matches := re.cellRef.FindStringSubmatch(text)
+		return placeholder(&reference{kind: refCell, text: text, start: cellSpec{
+			row: parseSpec(matches[re.cellRefRowSpec]),
+			col: parseSpec(matches[re.cellRefColSpec]),
+		}})
 	})
 
-	// Execute Lua code to get result
-	if err := L.DoString("return " + evaluableExpr); err != nil {
-		return "", err
-	}
+	// Then, replace standalone row references like @<, @<<, @> (for row copy operations)
+	expr = re.rowRef.ReplaceAllStringFunc(expr, func(text string) string {
+		matches := re.rowRef.FindStringSubmatch(text)
+		return placeholder(&reference{kind: refRow, text: text, start: cellSpec{
+			row: parseSpec(matches[re.rowRefRowSpec]),
+		}})
+	})
 
-	// Get the result from Lua stack
-	ret := L.Get(-1)
-	L.Pop(1)
+	// Restore string literals
+	expr = re.stringMarker.ReplaceAllStringFunc(expr, func(text string) string {
+		i, _ := strconv.Atoi(strings.Trim(text, stringMarker))
+		return literals[i]
+	})
 
-	// Convert result to string
-	switch v := ret.(type) {
-	case *lua.LNumber:
-		num := float64(*v)
-		if num == float64(int64(num)) {
-			return strconv.FormatInt(int64(num), 10), nil
-		}
-		return strconv.FormatFloat(num, 'f', -1, 64), nil
-	case lua.LString:
-		return string(v), nil
-	case lua.LBool:
-		if v {
-			return "true", nil
+	parts := strings.Split(expr, refPlaceholder)
+	e := &expression{}
+	for i, part := range parts {
+		if i%2 == 0 {
+			e.texts = append(e.texts, part)
+		} else {
+			refIdx, _ := strconv.Atoi(part)
+			e.refs = append(e.refs, refs[refIdx])
 		}
-		return "false", nil
-	default:
-		return fmt.Sprintf("%v", ret), nil
 	}
+	return e
 }
 
-// expandRange expands a range reference like "@<..@>>" into an array of values
-func expandRange(startPos, endPos string, table [][]string, currentRow, currentCol, dataStartRow int, headerColMap map[string]int) ([]any, error) {
-	maxRowLen := 0
-	for _, r := range table {
-		if len(r) > maxRowLen {
-			maxRowLen = len(r)
+// source builds Lua source code from the expression, replacing each reference with refSource(i).
+func (e *expression) source(refSource func(i int) string) string {
+	var sb strings.Builder
+	for i, text := range e.texts {
+		sb.WriteString(text)
+		if i < len(e.refs) {
+			sb.WriteString(refSource(i))
 		}
 	}
+	return sb.String()
+}
 
-	startRow, startCol, err := parseCellPosition(startPos, len(table), maxRowLen, currentRow, currentCol, headerColMap)
-	if err != nil {
-		return nil, fmt.Errorf("invalid range start %q: %w", startPos, err)
-	}
-	endRow, endCol, err := parseCellPosition(endPos, len(table), maxRowLen, currentRow, currentCol, headerColMap)
-	if err != nil {
-		return nil, fmt.Errorf("invalid range end %q: %w", endPos, err)
-	}
-
-	var values []any
+// Apply performs table calculations using TBLFM formulas on the input 2D array and returns the modified table.
+// By default, formulas are evaluated in dependency order: a formula that references cells
+// computed by another formula runs after it. When several formulas target the same cell,
+// the last one written wins. Use WithAsWrittenOrder to evaluate formulas strictly in the given order.
+// Apply is a shorthand for Compile followed by Program.Run.
+func Apply(
+	table [][]string, // Input table (modified in place)
+	formulas []string, // TBLFM formula strings
+	opts ...Option, // Functional options
+) (
+	resultTable [][]string, // Updated table (or the same pointer)
+	err error,
+) {
+	return ApplyContext(context.Background(), table, formulas, opts...)
+}
 
-	// If only row is specified (no column), assume current column
-	if startCol == -1 && endCol == -1 {
-		startCol = currentCol - 1
-		endCol = currentCol - 1
-	}
+// ApplyContext is like Apply but stops the evaluation when ctx is done.
+// See Program.RunContext.
+func ApplyContext(
+	ctx context.Context, // Context to cancel the evaluation
+	table [][]string, // Input table (modified in place)
+	formulas []string, // TBLFM formula strings
+	opts ...Option, // Functional options
+) (
+	resultTable [][]string, // Updated table (or the same pointer)
+	err error,
+) {
+	resultTable = table
 
-	// If only column is specified (no row):
-	// - If columns differ (horizontal range like $1..$4), use current row only
-	// - If columns are same (vertical range like $1..$1), iterate through all data rows
-	if startRow == -1 && endRow == -1 {
-		if startCol != endCol {
-			// Horizontal range: use current row
-			startRow = currentRow - 1
-			endRow = currentRow - 1
-		} else {
-			// Vertical range: iterate through all data rows
-			startRow = dataStartRow
-			endRow = len(table) - 1
-		}
+	// If formulas are empty, do nothing
+	if len(formulas) == 0 {
+		return
 	}
 
-	// Expand the range
-	for r := startRow; r >= 0 && r <= endRow && r < len(table); r++ {
-		for c := startCol; c >= 0 && c <= endCol && c < len(table[r]); c++ {
-			val := table[r][c]
-			// Try to parse as number
-			if num, err := strconv.ParseFloat(val, 64); err == nil {
-				values = append(values, num)
-			} else {
-				values = append(values, val)
-			}
-		}
+	program, err := Compile(formulas, opts...)
+	if err != nil {
+		return
 	}
-
-	return values, nil
+	return program.RunContext(ctx, table)
 }
@@ -1,9 +1,20 @@
 package tblfm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
 	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 func TestApply_EmptyFormula(t *testing.T) {
@@ -1009,6 +1020,66 @@ func TestApply_BuiltinFunctions(t *testing.T) {
 				{"", "98", "24.5", "24", "8", "42"},
 			},
 		},
+		{
+			name: "extended statistics summary row",
+			input: [][]string{
+				{"Value", "Count", "Prod", "Var", "Sdev", "P25", "P90", "Mode"},
+				{"2", "", "", "", "", "", "", ""},
+				{"4", "", "", "", "", "", "", ""},
+				{"4", "", "", "", "", "", "", ""},
+				{"4", "", "", "", "", "", "", ""},
+				{"5", "", "", "", "", "", "", ""},
+				{"5", "", "", "", "", "", "", ""},
+				{"7", "", "", "", "", "", "", ""},
+				{"9", "", "", "", "", "", "", ""},
+				{"", "", "", "", "", "", "", ""},
+			},
+			formulas: []string{
+				"@>$2=vcount(@<$1..@>>$1)",
+				"@>$3=vprod(@<$1..@>>$1)",
+				"@>$4=vvar(@<$1..@>>$1)",
+				"@>$5=vsdev(@<$1..@>>$1)",
+				"@>$6=vpercentile(@<$1..@>>$1, 0.25)",
+				"@>$7=vpercentile(@<$1..@>>$1, 0.9)",
+				"@>$8=vmode(@<$1..@>>$1)",
+			},
+			expected: [][]string{
+				{"Value", "Count", "Prod", "Var", "Sdev", "P25", "P90", "Mode"},
+				{"2", "", "", "", "", "", "", ""},
+				{"4", "", "", "", "", "", "", ""},
+				{"4", "", "", "", "", "", "", ""},
+				{"4", "", "", "", "", "", "", ""},
+				{"5", "", "", "", "", "", "", ""},
+				{"5", "", "", "", "", "", "", ""},
+				{"7", "", "", "", "", "", "", ""},
+				{"9", "", "", "", "", "", "", ""},
+				{"", "8", "201600", "4.571428571428571", "2.138089935299395", "4", "7.6", "4"},
+			},
+		},
+		{
+			name: "counts with empty and non-numeric fields",
+			input: [][]string{
+				{"Value", "Count", "CountA", "Mode"},
+				{"3", "", "", ""},
+				{"", "", "", ""},
+				{"n/a", "", "", ""},
+				{"5", "", "", ""},
+				{"total", "", "", ""},
+			},
+			formulas: []string{
+				"@>$2=vcount(@2$1..@>>$1)",
+				"@>$3=vcounta(@2$1..@>>$1)",
+				"@>$4=vmode(@2$1..@>>$1)",
+			},
+			expected: [][]string{
+				{"Value", "Count", "CountA", "Mode"},
+				{"3", "", "", ""},
+				{"", "", "", ""},
+				{"n/a", "", "", ""},
+				{"5", "", "", ""},
+				{"total", "2", "3", "3"},
+			},
+		},
 		{
 			name: "exp function with integer",
 			input: [][]string{
@@ -1311,3 +1382,2891 @@ func TestApply_HeaderNameErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestApply_Hlines(t *testing.T) {
+	// Sections: income (rows 2-3), expenses (rows 4-5), totals (rows 6-7)
+	input := func() [][]string {
+		return [][]string{
+			{"Item", "Amount"},
+			{"Salary", "300"},
+			{"Bonus", "50"},
+			{"Rent", "-100"},
+			{"Food", "-40"},
+			{"Subtotal", ""},
+			{"Net", ""},
+		}
+	}
+	hlines := []int{1, 3, 5}
+
+	tests := []struct {
+		name        string
+		formulas    []string
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:     "sum between hlines",
+			formulas: []string{"@>$2=vsum(@I..@II)"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"Salary", "300"},
+				{"Bonus", "50"},
+				{"Rent", "-100"},
+				{"Food", "-40"},
+				{"Subtotal", ""},
+				{"Net", "350"},
+			},
+		},
+		{
+			name:     "hline as target row",
+			formulas: []string{"@III$2=vsum(@II..@III)"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"Salary", "300"},
+				{"Bonus", "50"},
+				{"Rent", "-100"},
+				{"Food", "-40"},
+				{"Subtotal", "-140"},
+				{"Net", ""},
+			},
+		},
+		{
+			name:     "hline range as target",
+			formulas: []string{"@I$2..@II$2=$2*2"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"Salary", "600"},
+				{"Bonus", "100"},
+				{"Rent", "-100"},
+				{"Food", "-40"},
+				{"Subtotal", ""},
+				{"Net", ""},
+			},
+		},
+		{
+			name:     "relative hline references",
+			formulas: []string{"@>$2=vsum(@-II..@-I)"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"Salary", "300"},
+				{"Bonus", "50"},
+				{"Rent", "-100"},
+				{"Food", "-40"},
+				{"Subtotal", ""},
+				{"Net", "-140"},
+			},
+		},
+		{
+			name:     "relative hline below",
+			formulas: []string{"@2$2..@3$2=vsum(@-I..@+I)"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"Salary", "350"},
+				{"Bonus", "400"},
+				{"Rent", "-100"},
+				{"Food", "-40"},
+				{"Subtotal", ""},
+				{"Net", ""},
+			},
+		},
+		{
+			name:     "cell reference after hline",
+			formulas: []string{"@>$2=@II$2"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"Salary", "300"},
+				{"Bonus", "50"},
+				{"Rent", "-100"},
+				{"Food", "-40"},
+				{"Subtotal", ""},
+				{"Net", "-100"},
+			},
+		},
+		{
+			name:        "missing hline",
+			formulas:    []string{"@>$2=vsum(@I..@IIII)"},
+			errorSubstr: "hline reference @IIII not found",
+		},
+		{
+			name:        "relative hline in target",
+			formulas:    []string{"@-I$2=1"},
+			errorSubstr: "requires a current row",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(input(), tt.formulas, WithHlines(hlines))
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_FormatModifiers(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "printf float format",
+			input: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "11.1", "3", ""},
+				{"Orange", "2", "5", ""},
+			},
+			formulas: []string{"$4=$2*$3;%.2f"},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "11.1", "3", "33.30"},
+				{"Orange", "2", "5", "10.00"},
+			},
+		},
+		{
+			name: "printf format with spaces before semicolon",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{"$2 = $1 / 3 ; %.3f"},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", "0.333"},
+			},
+		},
+		{
+			name: "printf integer format",
+			input: [][]string{
+				{"A", "B"},
+				{"7.9", ""},
+			},
+			formulas: []string{"$2=$1;%03d"},
+			expected: [][]string{
+				{"A", "B"},
+				{"7.9", "007"},
+			},
+		},
+		{
+			name: "printf format on numeric string result",
+			input: [][]string{
+				{"A", "B"},
+				{"1.5", ""},
+			},
+			formulas: []string{`$2="" .. $1;%.2f`},
+			expected: [][]string{
+				{"A", "B"},
+				{"1.5", "1.50"},
+			},
+		},
+		{
+			name: "printf format with a percent sign",
+			input: [][]string{
+				{"Done", "Total", "Rate"},
+				{"1", "8", ""},
+			},
+			formulas: []string{"$3=$1/$2*100;%.1f%%"},
+			expected: [][]string{
+				{"Done", "Total", "Rate"},
+				{"1", "8", "12.5%"},
+			},
+		},
+		{
+			name: "percent sign without printf format",
+			input: [][]string{
+				{"A", "B"},
+				{"0.25", ""},
+			},
+			formulas: []string{"$2=$1*100;N%%"},
+			expected: [][]string{
+				{"A", "B"},
+				{"0.25", "25%"},
+			},
+		},
+		{
+			name: "N treats non-numbers as zero",
+			input: [][]string{
+				{"A", "B", "Sum"},
+				{"10", "n/a", ""},
+				{"", "5", ""},
+			},
+			formulas: []string{"$3=$1+$2;N"},
+			expected: [][]string{
+				{"A", "B", "Sum"},
+				{"10", "n/a", "10"},
+				{"", "5", "5"},
+			},
+		},
+		{
+			name: "E keeps empty fields in ranges",
+			input: [][]string{
+				{"A", "B", "C", "Count"},
+				{"1", "", "3", ""},
+			},
+			formulas: []string{"$4=#($1..$3);E"},
+			expected: [][]string{
+				{"A", "B", "C", "Count"},
+				{"1", "", "3", "3"},
+			},
+		},
+		{
+			name: "empty fields are dropped from ranges without E",
+			input: [][]string{
+				{"A", "B", "C", "Count"},
+				{"1", "", "3", ""},
+			},
+			formulas: []string{"$4=#($1..$3)"},
+			expected: [][]string{
+				{"A", "B", "C", "Count"},
+				{"1", "", "3", "2"},
+			},
+		},
+		{
+			name: "combined modes",
+			input: [][]string{
+				{"A", "B", "C", "Mean"},
+				{"1", "", "x", ""},
+			},
+			formulas: []string{"$4=vmean($1..$3);%.2fNE"},
+			expected: [][]string{
+				{"A", "B", "C", "Mean"},
+				{"1", "", "x", "0.33"},
+			},
+		},
+		{
+			name: "L substitutes literally",
+			input: [][]string{
+				{"Expr", "Result"},
+				{"1 + 2 * 3", ""},
+			},
+			formulas: []string{"$2=$1;L"},
+			expected: [][]string{
+				{"Expr", "Result"},
+				{"1 + 2 * 3", "7"},
+			},
+		},
+		{
+			name: "unknown modifier",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{"$2=$1;Q"},
+			errorSubstr: "unknown format modifier",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_DependencyOrder(t *testing.T) {
+	input := func() [][]string {
+		return [][]string{
+			{"Item", "Price", "Qty", "Total"},
+			{"Apple", "100", "5", ""},
+			{"Orange", "150", "3", ""},
+			{"TOTAL", "", "", ""},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "total written before the cells it depends on",
+			formulas: []string{
+				"@>$4=vsum(@2..@>>)",
+				"@2$4..@>>$4=$2*$3",
+			},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "500"},
+				{"Orange", "150", "3", "450"},
+				{"TOTAL", "", "", "950"},
+			},
+		},
+		{
+			name: "chain written in reverse",
+			formulas: []string{
+				"@>$2=@>$3*2",
+				"@>$3=@>$4+1",
+				"@>$4=10",
+			},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", ""},
+				{"Orange", "150", "3", ""},
+				{"TOTAL", "22", "11", "10"},
+			},
+		},
+		{
+			name: "last written formula owns the cell",
+			formulas: []string{
+				"@>$4=vsum(@2..@>>)",
+				"$4=$2*$3;N",
+			},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "500"},
+				{"Orange", "150", "3", "450"},
+				{"TOTAL", "", "", "0"},
+			},
+		},
+		{
+			name: "field formula reading the cell it overrides",
+			formulas: []string{
+				"@>$2=vsum(@2..@>>)",
+				"$4=$2*$3;N",
+				"@2$4=@2$4+1",
+				"@3$4=@2$4+@3$4",
+			},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "501"},
+				{"Orange", "150", "3", "951"},
+				{"TOTAL", "250", "", "0"},
+			},
+		},
+		{
+			name: "override of an override reading the cell",
+			formulas: []string{
+				"$4=$2*$3;N",
+				"@2$4=1",
+				"@2$4=@2$4*10",
+			},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "10"},
+				{"Orange", "150", "3", "450"},
+				{"TOTAL", "", "", "0"},
+			},
+		},
+		{
+			name: "as written order",
+			formulas: []string{
+				"@>$4=vsum(@2..@>>)",
+				"@2$4..@>>$4=$2*$3",
+			},
+			opts: []Option{WithAsWrittenOrder(true)},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "500"},
+				{"Orange", "150", "3", "450"},
+				{"TOTAL", "", "", "0"},
+			},
+		},
+		{
+			name: "reference cycle",
+			formulas: []string{
+				"@2$4=@3$4+1",
+				"@3$4=@>$4+1",
+				"@>$4=@2$4+1",
+			},
+			errorSubstr: `reference cycle between formulas: "@2$4=@3$4+1" -> "@>$4=@2$4+1" -> "@3$4=@>$4+1" -> "@2$4=@3$4+1"`,
+		},
+		{
+			name: "self reference is not a cycle",
+			formulas: []string{
+				"@3$2..@>$2=@-1$2+1",
+			},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", ""},
+				{"Orange", "101", "3", ""},
+				{"TOTAL", "102", "", ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(input(), tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_Iterate(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "as written order converges on second pass",
+			input: [][]string{
+				{"Item", "Amount", "Base"},
+				{"A", "", "1"},
+				{"B", "", "2"},
+				{"TOTAL", "", ""},
+			},
+			formulas: []string{
+				"@>$2=vsum(@2..@>>)",
+				"@2$2..@>>$2=$3*2",
+			},
+			opts: []Option{WithAsWrittenOrder(true), WithIterate(10)},
+			expected: [][]string{
+				{"Item", "Amount", "Base"},
+				{"A", "2", "1"},
+				{"B", "4", "2"},
+				{"TOTAL", "6", ""},
+			},
+		},
+		{
+			name: "reference cycle reaches a fixed point",
+			input: [][]string{
+				{"Name", "Value"},
+				{"x", "0"},
+				{"y", "0"},
+			},
+			formulas: []string{
+				"@2$2=@3$2/2;%.2f",
+				"@3$2=10-@2$2;%.2f",
+			},
+			opts: []Option{WithIterate(20)},
+			expected: [][]string{
+				{"Name", "Value"},
+				{"x", "3.33"},
+				{"y", "6.67"},
+			},
+		},
+		{
+			name: "reference cycle without iteration",
+			input: [][]string{
+				{"Name", "Value"},
+				{"x", "0"},
+				{"y", "0"},
+			},
+			formulas: []string{
+				"@2$2=@3$2/2;%.2f",
+				"@3$2=10-@2$2;%.2f",
+			},
+			errorSubstr: "reference cycle",
+		},
+		{
+			name: "does not converge",
+			input: [][]string{
+				{"Name", "Value"},
+				{"x", "0"},
+			},
+			formulas:    []string{"$2=$2+1"},
+			opts:        []Option{WithIterate(5)},
+			errorSubstr: "table did not converge after 5 iterations",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_Decimal(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "float sum has rounding artifacts",
+			input: [][]string{
+				{"Item", "Amount"},
+				{"A", "0.1"},
+				{"B", "0.2"},
+				{"Total", ""},
+			},
+			formulas: []string{"@>$2=vsum(@2..@>>)"},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"A", "0.1"},
+				{"B", "0.2"},
+				{"Total", "0.30000000000000004"},
+			},
+		},
+		{
+			name: "decimal integer power",
+			input: [][]string{
+				{"X", "Y"},
+				{"1.1", ""},
+				{"-0.5", ""},
+				{"1", ""},
+			},
+			formulas: []string{"$2=$1^3", "@4$2=$1^100000000"},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"X", "Y"},
+				{"1.1", "1.331"},
+				{"-0.5", "-0.125"},
+				{"1", "1"},
+			},
+		},
+		{
+			name: "decimal power too large",
+			input: [][]string{
+				{"X", "Y"},
+				{"1.1", ""},
+			},
+			formulas:    []string{"$2=$1^100000000"},
+			opts:        []Option{WithDecimal(true), WithTimeout(200 * time.Millisecond)},
+			errorSubstr: "power with exponent 100000000 is too large to calculate exactly",
+		},
+		{
+			name: "decimal round digits too large",
+			input: [][]string{
+				{"X", "Y"},
+				{"1.1", ""},
+			},
+			formulas:    []string{"$2=round($1, 1e9)"},
+			opts:        []Option{WithDecimal(true), WithTimeout(200 * time.Millisecond)},
+			errorSubstr: "bad argument #2 to round (number of digits must be between -314572 and 314572)",
+		},
+		{
+			name: "decimal math functions",
+			input: [][]string{
+				{"X", "Y", "Floor", "Ceil", "Abs", "Max", "Min", "Fmod"},
+				{"-2.5", "0.1", "", "", "", "", "", ""},
+				{"7.3", "2", "", "", "", "", "", ""},
+			},
+			formulas: []string{
+				"$3=math.floor($1)", "$4=math.ceil($1)", "$5=math.abs($1)",
+				"$6=math.max($1, $2, 0.2)", "$7=math.min($1, $2)", "$8=math.fmod($1, $2)",
+			},
+			opts: []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"X", "Y", "Floor", "Ceil", "Abs", "Max", "Min", "Fmod"},
+				{"-2.5", "0.1", "-3", "-2", "2.5", "0.2", "-2.5", "0"},
+				{"7.3", "2", "7", "8", "7.3", "7.3", "2", "1.3"},
+			},
+		},
+		{
+			name: "decimal math functions with numbers",
+			input: [][]string{
+				{"X", "Y"},
+				{"1", ""},
+			},
+			formulas: []string{"$2=math.floor(2.5) + math.max(1, 3)"},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"X", "Y"},
+				{"1", "5"},
+			},
+		},
+		{
+			name: "decimal string.format",
+			input: [][]string{
+				{"X", "Y"},
+				{"2.675", ""},
+				{"0.1", ""},
+			},
+			formulas: []string{`$2=string.format("%.2f|%s|%5.1f|%d", $1, $1, $1, 3)`},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"X", "Y"},
+				{"2.675", "2.68|2.675|  2.7|3"},
+				{"0.1", "0.10|0.1|  0.1|3"},
+			},
+		},
+		{
+			name: "decimal string.format with an invalid value",
+			input: [][]string{
+				{"X", "Y"},
+				{"2.5", ""},
+			},
+			formulas:    []string{`$2=("%d %d"):format($1, "abc")`},
+			opts:        []Option{WithDecimal(true)},
+			errorSubstr: "bad argument #3 to format (number expected, got string)",
+		},
+		{
+			name: "decimal math.floor in a Lua chunk",
+			input: [][]string{
+				{"X", "Y"},
+				{"2.5", ""},
+			},
+			formulas: []string{"$2=half_up($1)"},
+			opts:     []Option{WithDecimal(true), WithLuaChunk("chunk.lua", "function half_up(x) return math.floor(x + 0.5) end")},
+			expected: [][]string{
+				{"X", "Y"},
+				{"2.5", "3"},
+			},
+		},
+		{
+			name: "decimal sum is exact",
+			input: [][]string{
+				{"Item", "Amount"},
+				{"A", "0.1"},
+				{"B", "0.2"},
+				{"Total", ""},
+			},
+			formulas: []string{"@>$2=vsum(@2..@>>)"},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"A", "0.1"},
+				{"B", "0.2"},
+				{"Total", "0.3"},
+			},
+		},
+		{
+			name: "decimal arithmetic with number literals",
+			input: [][]string{
+				{"Price", "Qty", "Total"},
+				{"19.99", "3", ""},
+				{"1.10", "0.1", ""},
+			},
+			formulas: []string{"$3=$1*$2*1.1-0.01"},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Price", "Qty", "Total"},
+				{"19.99", "3", "65.957"},
+				{"1.10", "0.1", "0.111"},
+			},
+		},
+		{
+			name: "decimal vector functions",
+			input: [][]string{
+				{"Value", "Sum", "Mean", "Max", "Min", "Median"},
+				{"0.1", "", "", "", "", ""},
+				{"0.7", "", "", "", "", ""},
+				{"0.2", "", "", "", "", ""},
+				{"", "", "", "", "", ""},
+			},
+			formulas: []string{
+				"@>$2=vsum(@2$1..@>>$1)",
+				"@>$3=vmean(@2$1..@>>$1)",
+				"@>$4=vmax(@2$1..@>>$1)",
+				"@>$5=vmin(@2$1..@>>$1)",
+				"@>$6=vmedian(@2$1..@>>$1)",
+			},
+			opts: []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Value", "Sum", "Mean", "Max", "Min", "Median"},
+				{"0.1", "", "", "", "", ""},
+				{"0.7", "", "", "", "", ""},
+				{"0.2", "", "", "", "", ""},
+				{"", "1", "0.33333333333333333333", "0.7", "0.1", "0.2"},
+			},
+		},
+		{
+			name: "decimal extended statistics",
+			input: [][]string{
+				{"Value", "Prod", "Var", "P30", "Mode"},
+				{"0.1", "", "", "", ""},
+				{"0.2", "", "", "", ""},
+				{"0.2", "", "", "", ""},
+				{"0.3", "", "", "", ""},
+				{"", "", "", "", ""},
+			},
+			formulas: []string{
+				"@>$2=vprod(@2$1..@>>$1)",
+				"@>$3=vvar(@2$1..@>>$1)",
+				"@>$4=vpercentile(@2$1..@>>$1, 0.3)",
+				"@>$5=vmode(@2$1..@>>$1)",
+			},
+			opts: []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Value", "Prod", "Var", "P30", "Mode"},
+				{"0.1", "", "", "", ""},
+				{"0.2", "", "", "", ""},
+				{"0.2", "", "", "", ""},
+				{"0.3", "", "", "", ""},
+				{"", "0.0012", "0.00666666666666666667", "0.19", "0.2"},
+			},
+		},
+		{
+			name: "decimal comparisons with numbers",
+			input: [][]string{
+				{"A", "B", "Result"},
+				{"0.3", "0.1", ""},
+				{"0.5", "0.2", ""},
+			},
+			formulas: []string{`$3=($1 == $2 + 0.2) and "eq" or ($1 > 0.4 and "big" or "small")`},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"A", "B", "Result"},
+				{"0.3", "0.1", "eq"},
+				{"0.5", "0.2", "big"},
+			},
+		},
+		{
+			name: "round half-even and half-up",
+			input: [][]string{
+				{"Value", "Even", "Up", "Tens"},
+				{"2.345", "", "", ""},
+				{"2.355", "", "", ""},
+				{"-0.125", "", "", ""},
+			},
+			formulas: []string{
+				"$2=round($1, 2)",
+				`$3=round($1, 2, "half-up")`,
+				"$4=round($1*1000, -1)",
+			},
+			opts: []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Value", "Even", "Up", "Tens"},
+				{"2.345", "2.34", "2.35", "2340"},
+				{"2.355", "2.36", "2.36", "2360"},
+				{"-0.125", "-0.12", "-0.13", "-120"},
+			},
+		},
+		{
+			name: "round in float mode",
+			input: [][]string{
+				{"Value", "Rounded"},
+				{"2.675", ""},
+			},
+			formulas: []string{`$2=round($1, 2, "half-up")`},
+			expected: [][]string{
+				{"Value", "Rounded"},
+				{"2.675", "2.68"},
+			},
+		},
+		{
+			name: "decimal printf format",
+			input: [][]string{
+				{"Value", "Fixed", "Int"},
+				{"1.005", "", ""},
+			},
+			formulas: []string{"$2=$1;%.2f", "$3=$1*10;%d"},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Value", "Fixed", "Int"},
+				{"1.005", "1.01", "10"},
+			},
+		},
+		{
+			name: "decimal literal mode",
+			input: [][]string{
+				{"A", "B", "Sum"},
+				{"0.1", "0.2", ""},
+			},
+			formulas: []string{"$3=$1+$2;L"},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"A", "B", "Sum"},
+				{"0.1", "0.2", "0.3"},
+			},
+		},
+		{
+			name: "decimal to number and string concatenation",
+			input: [][]string{
+				{"Value", "Sqrt", "Label"},
+				{"0.25", "", ""},
+			},
+			formulas: []string{"$2=math.sqrt(tonumber($1))", `$3="v=" .. $1`},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Value", "Sqrt", "Label"},
+				{"0.25", "0.5", "v=0.25"},
+			},
+		},
+		{
+			name: "decimal division by zero",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{"$2=$1/0"},
+			opts:        []Option{WithDecimal(true)},
+			errorSubstr: "division by zero",
+		},
+		{
+			name: "unknown rounding mode",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{`$2=round($1, 2, "down")`},
+			errorSubstr: "unknown rounding mode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_Lookup(t *testing.T) {
+	input := func() [][]string {
+		return [][]string{
+			{"Product", "Price", "Order", "Qty", "Amount"},
+			{"Apple", "120", "Banana", "2", ""},
+			{"Banana", "80", "Cherry", "1", ""},
+			{"Cherry", "300", "Apple", "3", ""},
+		}
+	}
+	amounts := func(amounts ...string) [][]string {
+		table := input()
+		for i, amount := range amounts {
+			table[i+1][4] = amount
+		}
+		return table
+	}
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:     "vlookup",
+			input:    input(),
+			formulas: []string{"$5=vlookup($3, @2$1..@>$2, 2)*$4"},
+			expected: amounts("160", "300", "360"),
+		},
+		{
+			name:     "xlookup",
+			input:    input(),
+			formulas: []string{"$5=xlookup($3, @2$1..@>$1, @2$2..@>$2)*$4"},
+			expected: amounts("160", "300", "360"),
+		},
+		{
+			name:     "xlookup default",
+			input:    input(),
+			formulas: []string{`$5=xlookup("Durian", @2$1..@>$1, @2$2..@>$2, "n/a")`},
+			expected: amounts("n/a", "n/a", "n/a"),
+		},
+		{
+			name:     "index and xmatch",
+			input:    input(),
+			formulas: []string{"$5=index(@2$2..@>$2, xmatch($3, @2$1..@>$1))*$4"},
+			expected: amounts("160", "300", "360"),
+		},
+		{
+			name:     "index in two dimensions",
+			input:    input(),
+			formulas: []string{"$5=index(@2$1..@>$2, xmatch($3, @2$1..@>$1), 1) .. index(@2$1..@>$2, 2, 2)"},
+			expected: amounts("Banana80", "Cherry80", "Apple80"),
+		},
+		{
+			name:     "index in a single row",
+			input:    input(),
+			formulas: []string{"$5=index($1..$3, 3)"},
+			expected: amounts("Banana", "Cherry", "Apple"),
+		},
+		{
+			name:     "shape of a range",
+			input:    input(),
+			formulas: []string{`$5=nrows(@2$1..@>$2) .. "x" .. ncols(@2$1..@>$2)`},
+			expected: amounts("3x2", "3x2", "3x2"),
+		},
+		{
+			name: "grid keeps empty fields",
+			input: [][]string{
+				{"Key", "Value", "Result"},
+				{"a", "", ""},
+				{"", "2", ""},
+				{"c", "3", ""},
+			},
+			formulas: []string{"@2$3=vsum(@2$1..@>$2)", `@3$3=vlookup("c", @2$1..@>$2, 2)`, "@4$3=#(@2$1..@>$2)"},
+			expected: [][]string{
+				{"Key", "Value", "Result"},
+				{"a", "", "5"},
+				{"", "2", "3"},
+				{"c", "3", "4"},
+			},
+		},
+		{
+			name: "numeric keys",
+			input: [][]string{
+				{"Code", "Name", "Lookup", "Result"},
+				{"10", "ten", "20", ""},
+				{"20", "twenty", "10.0", ""},
+			},
+			formulas: []string{"$4=vlookup($3, @2$1..@>$2, 2)"},
+			expected: [][]string{
+				{"Code", "Name", "Lookup", "Result"},
+				{"10", "ten", "20", "twenty"},
+				{"20", "twenty", "10.0", "ten"},
+			},
+		},
+		{
+			name:        "vlookup key not found",
+			input:       input(),
+			formulas:    []string{`$5=vlookup("Durian", @2$1..@>$2, 2)`},
+			errorSubstr: "vlookup: key Durian not found",
+		},
+		{
+			name:        "index out of range",
+			input:       input(),
+			formulas:    []string{"$5=index(@2$1..@>$2, 4, 1)"},
+			errorSubstr: "outside the range of 3 row(s) and 2 column(s)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_Remote(t *testing.T) {
+	remoteTables := map[string][][]string{
+		"rates.csv": {
+			{"Currency", "Rate"},
+			{"USD", "150"},
+			{"EUR", "160"},
+		},
+	}
+	remote := WithRemote(func(name string) ([][]string, error) {
+		if table, ok := remoteTables[name]; ok {
+			return table, nil
+		}
+		return nil, fmt.Errorf("no such table")
+	})
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "remote cell",
+			input: [][]string{
+				{"Amount", "Yen"},
+				{"2", ""},
+			},
+			formulas: []string{`$2=$1*remote("rates.csv", @3$2)`},
+			opts:     []Option{remote},
+			expected: [][]string{
+				{"Amount", "Yen"},
+				{"2", "320"},
+			},
+		},
+		{
+			name: "remote column by header name",
+			input: [][]string{
+				{"Currency", "Amount", "Yen"},
+				{"EUR", "2", ""},
+				{"USD", "3", ""},
+			},
+			formulas: []string{`$3=$2*xlookup($1, remote(rates.csv, $1), remote("rates.csv", ${Rate}..))`},
+			opts:     []Option{remote},
+			expected: [][]string{
+				{"Currency", "Amount", "Yen"},
+				{"EUR", "2", "320"},
+				{"USD", "3", "450"},
+			},
+		},
+		{
+			name: "remote range",
+			input: [][]string{
+				{"Total"},
+				{""},
+			},
+			formulas: []string{`$1=vsum(remote("rates.csv", @2$2..@>$2))`},
+			opts:     []Option{remote},
+			expected: [][]string{
+				{"Total"},
+				{"310"},
+			},
+		},
+		{
+			name: "remote table not found",
+			input: [][]string{
+				{"Total"},
+				{""},
+			},
+			formulas:    []string{`$1=remote("missing.csv", @2$1)`},
+			opts:        []Option{remote},
+			errorSubstr: `remote table "missing.csv": no such table`,
+		},
+		{
+			name: "remote table with its own header rows and hlines",
+			input: [][]string{
+				{"2", ""},
+			},
+			formulas: []string{`$2=$1*remote("rates.csv", @I${Rate})`},
+			opts: []Option{
+				WithHeaderRows(0),
+				WithRemoteTable(func(name string) (*RemoteTable, error) {
+					return &RemoteTable{Rows: remoteTables[name], HeaderRows: 1, Hlines: []int{2}}, nil
+				}),
+			},
+			expected: [][]string{
+				{"2", "320"},
+			},
+		},
+		{
+			name: "remote references not enabled",
+			input: [][]string{
+				{"Total"},
+				{""},
+			},
+			formulas:    []string{`$1=remote("rates.csv", @2$2)`},
+			errorSubstr: "remote references are not enabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_DateTime(t *testing.T) {
+	fixedNow := WithNow(func() time.Time {
+		return time.Date(2025, 3, 14, 9, 26, 53, 0, time.UTC)
+	})
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "date arithmetic",
+			input: [][]string{
+				{"Date", "Next week", "Next month", "Next year"},
+				{"2024-01-31", "", "", ""},
+				{"2024-12-28 10:30", "", "", ""},
+			},
+			formulas: []string{"$2=adddays($1, 7)", "$3=addmonths($1, 1)", "$4=addyears($1, 1)"},
+			expected: [][]string{
+				{"Date", "Next week", "Next month", "Next year"},
+				{"2024-01-31", "2024-02-07", "2024-02-29", "2025-01-31"},
+				{"2024-12-28 10:30", "2025-01-04 10:30", "2025-01-28 10:30", "2025-12-28 10:30"},
+			},
+		},
+		{
+			name: "differences",
+			input: [][]string{
+				{"From", "To", "Days", "Months"},
+				{"2024-01-31", "2024-03-30", "", ""},
+				{"2024-03-01 12:00", "2024-03-03", "", ""},
+				{"2025-06-15", "2025-01-15", "", ""},
+			},
+			formulas: []string{"$3=daysdiff($1, $2)", "$4=monthsdiff($1, $2)"},
+			expected: [][]string{
+				{"From", "To", "Days", "Months"},
+				{"2024-01-31", "2024-03-30", "59", "1"},
+				{"2024-03-01 12:00", "2024-03-03", "1.5", "0"},
+				{"2025-06-15", "2025-01-15", "-151", "-5"},
+			},
+		},
+		{
+			name: "parts",
+			input: [][]string{
+				{"Date", "Parts"},
+				{"<2025-02-16 Sun 08:05>", ""},
+			},
+			formulas: []string{`$2=year($1) .. "/" .. month($1) .. "/" .. day($1) .. " " .. weekday($1) .. " " .. hour($1) .. ":" .. minute($1)`},
+			expected: [][]string{
+				{"Date", "Parts"},
+				{"<2025-02-16 Sun 08:05>", "2025/2/16 7 8:5"},
+			},
+		},
+		{
+			name: "custom layouts",
+			input: [][]string{
+				{"Date", "ISO", "Formatted"},
+				{"03/14/2025", "", ""},
+			},
+			formulas: []string{`$2=date($1, "01/02/2006")`, `$3=formatdate($2, "Mon, Jan 2 2006")`},
+			expected: [][]string{
+				{"Date", "ISO", "Formatted"},
+				{"03/14/2025", "2025-03-14", "Fri, Mar 14 2025"},
+			},
+		},
+		{
+			name: "today and now",
+			input: [][]string{
+				{"Today", "Now", "Due in"},
+				{"", "", ""},
+			},
+			formulas: []string{"$1=today()", "$2=now()", `$3=daysdiff(today(), "2025-04-01")`},
+			opts:     []Option{fixedNow},
+			expected: [][]string{
+				{"Today", "Now", "Due in"},
+				{"2025-03-14", "2025-03-14 09:26:53", "18"},
+			},
+		},
+		{
+			name: "durations",
+			input: [][]string{
+				{"Start", "Break", "T", "t", "U"},
+				{"2:12", "1:47", "", "", ""},
+				{"3:02:20", "-2:07:00", "", "", ""},
+			},
+			formulas: []string{"$3=$1+$2;T", "$4=$1+$2;t", "$5=$1+$2;U"},
+			expected: [][]string{
+				{"Start", "Break", "T", "t", "U"},
+				{"2:12", "1:47", "03:59:00", "3.98", "03:59"},
+				{"3:02:20", "-2:07:00", "00:55:20", "0.92", "00:55"},
+			},
+		},
+		{
+			name: "duration sum with printf",
+			input: [][]string{
+				{"Task", "Time"},
+				{"A", "0:45"},
+				{"B", "1:30"},
+				{"Total", ""},
+			},
+			formulas: []string{"@>$2=vsum(@2..@>>);t%.1f"},
+			expected: [][]string{
+				{"Task", "Time"},
+				{"A", "0:45"},
+				{"B", "1:30"},
+				{"Total", "2.2"},
+			},
+		},
+		{
+			name: "invalid date",
+			input: [][]string{
+				{"Date", "Next"},
+				{"tomorrow", ""},
+			},
+			formulas:    []string{"$2=adddays($1, 1)"},
+			errorSubstr: `invalid date "tomorrow"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_ConditionalAggregation(t *testing.T) {
+	input := func() [][]string {
+		return [][]string{
+			{"Category", "Amount", "Summary"},
+			{"Food", "12.5", ""},
+			{"Rent", "800", ""},
+			{"Food", "7.5", ""},
+			{"", "3", ""},
+			{"Food", "", ""},
+		}
+	}
+	summary := func(values ...string) [][]string {
+		table := input()
+		for i, value := range values {
+			table[i+1][2] = value
+		}
+		return table
+	}
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:     "vsumif with a value",
+			input:    input(),
+			formulas: []string{`@2$3=vsumif(${Category}.., "Food", ${Amount}..)`},
+			expected: summary("20"),
+		},
+		{
+			name:     "vcountif counts matching fields including empty ones",
+			input:    input(),
+			formulas: []string{`@2$3=vcountif(${Category}.., "Food")`, `@3$3=vcountif(${Category}.., "")`},
+			expected: summary("3", "1"),
+		},
+		{
+			name:     "vmeanif skips empty values",
+			input:    input(),
+			formulas: []string{`@2$3=vmeanif(@2$1..@>$1, "Food", @2$2..@>$2)`},
+			expected: summary("10"),
+		},
+		{
+			name:     "function predicate",
+			input:    input(),
+			formulas: []string{`@2$3=vsumif(${Amount}.., function(v) return type(v) == "number" and v < 100 end)`},
+			expected: summary("23"),
+		},
+		{
+			name:     "predicate on the current row",
+			input:    input(),
+			formulas: []string{`@2$3..@4$3=vsumif(${Category}.., $1, ${Amount}..)`},
+			expected: summary("20", "800", "20"),
+		},
+		{
+			name:     "decimal mode",
+			input:    [][]string{{"Category", "Amount", "Summary"}, {"A", "0.1", ""}, {"A", "0.2", ""}, {"B", "0.4", ""}},
+			formulas: []string{`@2$3=vsumif(${Category}.., "A", ${Amount}..)`, `@3$3=vsumif(${Amount}.., function(v) return v > 0.15 end)`},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{{"Category", "Amount", "Summary"}, {"A", "0.1", "0.3"}, {"A", "0.2", "0.6"}, {"B", "0.4", ""}},
+		},
+		{
+			name:        "ranges of different sizes",
+			input:       input(),
+			formulas:    []string{`@2$3=vsumif(@2$1..@>$1, "Food", @2$2..@3$2)`},
+			errorSubstr: "vsumif: criteria range has 5 field(s) but value range has 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_StringFunctions(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "split, trim, upper and lower",
+			input: [][]string{
+				{"SKU", "Category", "Number", "Name", "Upper"},
+				{"food-0012-rice", "", "", "  Rice Bag ", ""},
+			},
+			formulas: []string{
+				`$2=upper(split($1, "-", 1))`,
+				`$3=#split($1, "-") .. ":" .. split($1, "-", 2)`,
+				`$4=lower(trim($4))`,
+				`$5=upper(trim("--x--", "-"))`,
+			},
+			expected: [][]string{
+				{"SKU", "Category", "Number", "Name", "Upper"},
+				{"food-0012-rice", "FOOD", "3:0012", "rice bag", "X"},
+			},
+		},
+		{
+			name: "pad",
+			input: [][]string{
+				{"Code", "Left", "Right"},
+				{"42", "", ""},
+				{"日本", "", ""},
+			},
+			formulas: []string{`$2=pad($1, 5, "0")`, `$3=pad($1, -4) .. "|"`},
+			expected: [][]string{
+				{"Code", "Left", "Right"},
+				{"42", "00042", "42  |"},
+				{"日本", "000日本", "日本  |"},
+			},
+		},
+		{
+			name: "regex match and replace",
+			input: [][]string{
+				{"Description", "Invoice", "Year", "Clean"},
+				{"Paid INV-2024-0031 (late)", "", "", ""},
+				{"no invoice", "", "", ""},
+			},
+			formulas: []string{
+				`$2=match($1, "INV-\\d+-\\d+") or "-"`,
+				`$3=match($1, "INV-(\\d{4})", 1) or ""`,
+				`$4=replace($1, "\\s*\\(.*\\)$", "")`,
+			},
+			expected: [][]string{
+				{"Description", "Invoice", "Year", "Clean"},
+				{"Paid INV-2024-0031 (late)", "INV-2024-0031", "2024", "Paid INV-2024-0031"},
+				{"no invoice", "-", "", "no invoice"},
+			},
+		},
+		{
+			name: "replace with capture groups",
+			input: [][]string{
+				{"Name", "Swapped"},
+				{"Doe, John", ""},
+			},
+			formulas: []string{`$2=replace($1, "^(\\w+), (\\w+)$", "$2 $1")`},
+			expected: [][]string{
+				{"Name", "Swapped"},
+				{"Doe, John", "John Doe"},
+			},
+		},
+		{
+			name: "sprintf",
+			input: [][]string{
+				{"Item", "Qty", "Price", "Label"},
+				{"apple", "3", "1.5", ""},
+			},
+			formulas: []string{`$4=sprintf("%-6s|%03d|%.2f|%s|100%%", $1, $2, $3, $3)`},
+			expected: [][]string{
+				{"Item", "Qty", "Price", "Label"},
+				{"apple", "3", "1.5", "apple |003|1.50|1.5|100%"},
+			},
+		},
+		{
+			name: "sprintf with decimals",
+			input: [][]string{
+				{"Price", "Label"},
+				{"1.005", ""},
+			},
+			formulas: []string{`$2=sprintf("%.2f %s", $1, $1*3)`},
+			opts:     []Option{WithDecimal(true)},
+			expected: [][]string{
+				{"Price", "Label"},
+				{"1.005", "1.01 3.015"},
+			},
+		},
+		{
+			name: "vjoin and vunique",
+			input: [][]string{
+				{"Tag", "Joined"},
+				{"b", ""},
+				{"a", ""},
+				{"", ""},
+				{"b", ""},
+				{"10", ""},
+			},
+			formulas: []string{
+				`@2$2=vjoin(@2$1..@>$1)`,
+				`@3$2=vjoin(vunique(@2$1..@>$1), "/")`,
+				`@4$2=#vunique(@2$1..@>$1)`,
+			},
+			expected: [][]string{
+				{"Tag", "Joined"},
+				{"b", "b, a, b, 10"},
+				{"a", "b/a/10"},
+				{"", "3"},
+				{"b", ""},
+				{"10", ""},
+			},
+		},
+		{
+			name: "invalid regex",
+			input: [][]string{
+				{"A", "B"},
+				{"x", ""},
+			},
+			formulas:    []string{`$2=match($1, "(")`},
+			errorSubstr: "missing closing )",
+		},
+		{
+			name: "sprintf missing argument",
+			input: [][]string{
+				{"A", "B"},
+				{"x", ""},
+			},
+			formulas:    []string{`$2=sprintf("%s %s", $1)`},
+			errorSubstr: "sprintf: missing argument for %s",
+		},
+		{
+			name: "sprintf numeric verb with a string",
+			input: [][]string{
+				{"A", "B"},
+				{"abc", ""},
+			},
+			formulas:    []string{`$2=sprintf("%d", $1)`},
+			errorSubstr: "bad argument #2 to sprintf (number expected for %d, got string)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_Sandbox(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "safe libraries are available",
+			input: [][]string{
+				{"Name", "Result"},
+				{"abc", ""},
+			},
+			formulas: []string{`$2=string.upper($1) .. table.concat({math.floor(2.5), tostring(type(pcall))}, ",")`},
+			expected: [][]string{
+				{"Name", "Result"},
+				{"abc", "ABC2,function"},
+			},
+		},
+		{
+			name: "os is not available by default",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{`$2=os.time()`},
+			errorSubstr: "attempt to index a non-table object(nil) with key 'time'",
+		},
+		{
+			name: "io is not available by default",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{`$2=io.open("/etc/passwd")`},
+			errorSubstr: "attempt to index a non-table object(nil) with key 'open'",
+		},
+		{
+			name: "code loading functions are removed",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{`$2=tostring(dofile) .. tostring(loadstring) .. tostring(load) .. tostring(require)`},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", "nilnilnilnil"},
+			},
+		},
+		{
+			name: "all libraries with unsafe Lua",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{`$2=type(os.time) .. type(io.open) .. type(loadstring("return 1"))`},
+			opts:     []Option{WithUnsafeLua(true)},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", "functionfunctionfunction"},
+			},
+		},
+		{
+			name: "infinite loop is aborted",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{`$2=(function() while true do end end)()`},
+			opts:        []Option{WithTimeout(50 * time.Millisecond)},
+			errorSubstr: "formula evaluation stopped: time limit of 50ms exceeded",
+		},
+		{
+			name: "time limit is not reached",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{`$2=$1+1`},
+			opts:     []Option{WithTimeout(time.Minute)},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", "2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyContext(t *testing.T) {
+	input := func() [][]string {
+		return [][]string{
+			{"A", "B"},
+			{"1", ""},
+		}
+	}
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := ApplyContext(ctx, input(), []string{"$2=$1+1"})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("ApplyContext() error = %v, want context.Canceled", err)
+		}
+	})
+	t.Run("deadline in infinite loop", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := ApplyContext(ctx, input(), []string{"$2=(function() while true do end end)()"})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("ApplyContext() error = %v, want context.DeadlineExceeded", err)
+		}
+	})
+	t.Run("not canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		result, err := ApplyContext(ctx, input(), []string{"$2=$1+1"})
+		if err != nil {
+			t.Fatalf("ApplyContext() returned error: %v", err)
+		}
+		if expected := [][]string{{"A", "B"}, {"1", "2"}}; !reflect.DeepEqual(result, expected) {
+			t.Errorf("ApplyContext() returned unexpected result\nGot:  %v\nWant: %v", result, expected)
+		}
+	})
+}
+
+func TestApply_FormulaError(t *testing.T) {
+	tests := []struct {
+		name     string
+		formulas []string
+		expected FormulaError
+	}{
+		{
+			name:     "evaluation error",
+			formulas: []string{"", "$2=$1+1", "$3=$1 .. $2 .. nil"},
+			expected: FormulaError{Index: 2, Formula: "$3=$1 .. $2 .. nil", Row: 2, Col: 3, Code: "1 .. 2 .. nil"},
+		},
+		{
+			name:     "evaluation error in literal mode",
+			formulas: []string{"$3=$1 + nil;L"},
+			expected: FormulaError{Index: 0, Formula: "$3=$1 + nil;L", Row: 2, Col: 3, Code: "1 + nil"},
+		},
+		{
+			name:     "compile error",
+			formulas: []string{"$2=1", "$3=$1 +* 2"},
+			expected: FormulaError{Index: 1, Formula: "$3=$1 +* 2"},
+		},
+		{
+			name:     "invalid target",
+			formulas: []string{"${Missing}=1"},
+			expected: FormulaError{Index: 0, Formula: "${Missing}=1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := [][]string{
+				{"A", "B", "C"},
+				{"1", "", ""},
+			}
+			_, err := Apply(input, tt.formulas)
+			var formulaErr *FormulaError
+			if !errors.As(err, &formulaErr) {
+				t.Fatalf("Apply() error = %v, want *FormulaError", err)
+			}
+			got := *formulaErr
+			got.Err, got.op = nil, ""
+			if got != tt.expected {
+				t.Errorf("Apply() returned unexpected FormulaError\nGot:  %+v\nWant: %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_EmptySemantics(t *testing.T) {
+	modes := []EmptyMode{EmptyAsString, EmptyAsNil, EmptyAsZero}
+	tests := []struct {
+		name     string
+		formula  string
+		expected map[EmptyMode]string
+	}{
+		{
+			name:     "scalar",
+			formula:  `$4=type($2) .. ":" .. tostring($2)`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:", EmptyAsNil: "nil:nil", EmptyAsZero: "number:0"},
+		},
+		{
+			name:     "missing cell",
+			formula:  `$4=type(@9) .. ":" .. tostring(@+5)`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:", EmptyAsNil: "nil:nil", EmptyAsZero: "number:0"},
+		},
+		{
+			name:     "range",
+			formula:  `$4=#($1..$3) .. ":" .. vsum($1..$3) .. ":" .. vcounta($1..$3)`,
+			expected: map[EmptyMode]string{EmptyAsString: "2:1:2", EmptyAsNil: "2:1:2", EmptyAsZero: "2:1:2"},
+		},
+		{
+			name:     "range with E",
+			formula:  `$4=#($1..$3) .. ":" .. vsum($1..$3) .. ":" .. vmean($1..$3);E`,
+			expected: map[EmptyMode]string{EmptyAsString: "3:1:1", EmptyAsNil: "2:1:1", EmptyAsZero: "3:1:0.5"},
+		},
+		{
+			name:     "range grid",
+			formula:  `$4=type(index($1..$3, 2)) .. ":" .. ncols($1..$3)`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:3", EmptyAsNil: "nil:3", EmptyAsZero: "number:3"},
+		},
+		{
+			name:     "N mode",
+			formula:  `$4=type($2) .. ":" .. $2;N`,
+			expected: map[EmptyMode]string{EmptyAsString: "number:0", EmptyAsNil: "number:0", EmptyAsZero: "number:0"},
+		},
+		{
+			name:     "L mode",
+			formula:  `$4=type($2) .. ":" .. type(@9);L`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:string", EmptyAsNil: "nil:nil", EmptyAsZero: "number:number"},
+		},
+		{
+			name:     "L mode range with E",
+			formula:  `$4=#($1..$2);EL`,
+			expected: map[EmptyMode]string{EmptyAsString: "2", EmptyAsNil: "1", EmptyAsZero: "2"},
+		},
+	}
+	for _, tt := range tests {
+		for _, mode := range modes {
+			t.Run(tt.name+"/"+mode.String(), func(t *testing.T) {
+				input := [][]string{
+					{"A", "B", "C", "R"},
+					{"1", "", "x", "old"},
+				}
+				result, err := Apply(input, []string{tt.formula}, WithEmpty(mode))
+				if err != nil {
+					t.Fatalf("Apply() returned error: %v", err)
+				}
+				if got := result[1][3]; got != tt.expected[mode] {
+					t.Errorf("Apply() = %q, want %q", got, tt.expected[mode])
+				}
+			})
+		}
+	}
+
+	// A cell beyond the end of a short row is an empty field like a cell outside the table
+	shortRowTests := []struct {
+		name     string
+		formula  string
+		expected map[EmptyMode]string
+	}{
+		{
+			name:     "beyond a short row",
+			formula:  `@3$1=type(@2$4) .. ":" .. tostring(@2$4)`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:", EmptyAsNil: "nil:nil", EmptyAsZero: "number:0"},
+		},
+		{
+			name:     "outside the table",
+			formula:  `@3$1=type(@9$1) .. ":" .. tostring(@9$1)`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:", EmptyAsNil: "nil:nil", EmptyAsZero: "number:0"},
+		},
+		{
+			// Before the empty option, a cell outside the table was always 0
+			name:     "copy from outside the table",
+			formula:  `@3$1=@9$2`,
+			expected: map[EmptyMode]string{EmptyAsString: "", EmptyAsNil: "", EmptyAsZero: "0"},
+		},
+		{
+			name:     "range over a short row",
+			formula:  `@3$1=#(@2$1..@2$4) .. ":" .. vsum(@2$1..@2$4)`,
+			expected: map[EmptyMode]string{EmptyAsString: "2:3", EmptyAsNil: "2:3", EmptyAsZero: "2:3"},
+		},
+		{
+			name:     "range over a short row with E",
+			formula:  `@3$1=#(@2$1..@2$4) .. ":" .. vmean(@2$1..@2$4);E`,
+			expected: map[EmptyMode]string{EmptyAsString: "4:1.5", EmptyAsNil: "2:1.5", EmptyAsZero: "4:0.75"},
+		},
+		{
+			name:     "L mode beyond a short row",
+			formula:  `@3$1=type(@2$4) .. ":" .. #(@2$1..@2$4);EL`,
+			expected: map[EmptyMode]string{EmptyAsString: "string:4", EmptyAsNil: "nil:2", EmptyAsZero: "number:4"},
+		},
+	}
+	for _, tt := range shortRowTests {
+		for _, mode := range modes {
+			t.Run(tt.name+"/"+mode.String(), func(t *testing.T) {
+				input := [][]string{
+					{"a", "b", "c", "d"},
+					{"1", "2"},
+					{"3", "4", "5", "6"},
+				}
+				result, err := Apply(input, []string{tt.formula}, WithEmpty(mode))
+				if err != nil {
+					t.Fatalf("Apply() returned error: %v", err)
+				}
+				if got := result[2][0]; got != tt.expected[mode] {
+					t.Errorf("Apply() = %q, want %q", got, tt.expected[mode])
+				}
+			})
+		}
+	}
+
+	nilTests := []struct {
+		name     string
+		formula  string
+		expected map[NilResultMode]map[EmptyMode]string
+	}{
+		{
+			name:    "nil result",
+			formula: `$4=nil`,
+			expected: map[NilResultMode]map[EmptyMode]string{
+				NilResultClear: {EmptyAsString: "", EmptyAsNil: "", EmptyAsZero: ""},
+				NilResultKeep:  {EmptyAsString: "old", EmptyAsNil: "old", EmptyAsZero: "old"},
+			},
+		},
+		{
+			name:    "copy of empty field",
+			formula: `$4=$2`,
+			expected: map[NilResultMode]map[EmptyMode]string{
+				NilResultClear: {EmptyAsString: "", EmptyAsNil: "", EmptyAsZero: "0"},
+				NilResultKeep:  {EmptyAsString: "", EmptyAsNil: "old", EmptyAsZero: "0"},
+			},
+		},
+	}
+	for _, tt := range nilTests {
+		for _, nilMode := range []NilResultMode{NilResultClear, NilResultKeep} {
+			for _, mode := range modes {
+				t.Run(tt.name+"/"+nilMode.String()+"/"+mode.String(), func(t *testing.T) {
+					input := [][]string{
+						{"A", "B", "C", "R"},
+						{"1", "", "x", "old"},
+					}
+					result, err := Apply(input, []string{tt.formula}, WithEmpty(mode), WithNilResult(nilMode))
+					if err != nil {
+						t.Fatalf("Apply() returned error: %v", err)
+					}
+					if got, want := result[1][3], tt.expected[nilMode][mode]; got != want {
+						t.Errorf("Apply() = %q, want %q", got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestParseEmptyMode(t *testing.T) {
+	for _, mode := range []EmptyMode{EmptyAsString, EmptyAsNil, EmptyAsZero} {
+		if got, err := ParseEmptyMode(mode.String()); err != nil || got != mode {
+			t.Errorf("ParseEmptyMode(%q) = %v, %v", mode.String(), got, err)
+		}
+	}
+	for _, mode := range []NilResultMode{NilResultClear, NilResultKeep} {
+		if got, err := ParseNilResultMode(mode.String()); err != nil || got != mode {
+			t.Errorf("ParseNilResultMode(%q) = %v, %v", mode.String(), got, err)
+		}
+	}
+	if _, err := ParseEmptyMode("blank"); err == nil {
+		t.Error("ParseEmptyMode(\"blank\") expected error but got none")
+	}
+	if _, err := ParseNilResultMode("skip"); err == nil {
+		t.Error("ParseNilResultMode(\"skip\") expected error but got none")
+	}
+}
+
+func TestApply_Offsets(t *testing.T) {
+	table := func() [][]string {
+		return [][]string{
+			{"Item", "Q1", "Q2", "Q3", "Total"},
+			{"A", "1", "2", "3", ""},
+			{"B", "10", "20", "30", ""},
+			{"C", "100", "200", "300", ""},
+			{"Sum", "", "", "", ""},
+		}
+	}
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:     "last row with offset in target and range",
+			input:    table(),
+			formulas: []string{"@>$2..@>$4=vsum(@<+1..@>-1)"},
+			expected: [][]string{
+				{"Item", "Q1", "Q2", "Q3", "Total"},
+				{"A", "1", "2", "3", ""},
+				{"B", "10", "20", "30", ""},
+				{"C", "100", "200", "300", ""},
+				{"Sum", "111", "222", "333", ""},
+			},
+		},
+		{
+			name:     "column anchors with offsets",
+			input:    table(),
+			formulas: []string{"@<+1$>..@>-1$>=vsum($<+1..$>-1)"},
+			expected: [][]string{
+				{"Item", "Q1", "Q2", "Q3", "Total"},
+				{"A", "1", "2", "3", "6"},
+				{"B", "10", "20", "30", "60"},
+				{"C", "100", "200", "300", "600"},
+				{"Sum", "", "", "", ""},
+			},
+		},
+		{
+			name:     "relative references with plus sign",
+			input:    table(),
+			formulas: []string{"@2$3..@4$3=@+1$2 .. $+1"},
+			expected: [][]string{
+				{"Item", "Q1", "Q2", "Q3", "Total"},
+				{"A", "1", "103", "3", ""},
+				{"B", "10", "10030", "30", ""},
+				{"C", "100", "300", "300", ""},
+				{"Sum", "", "", "", ""},
+			},
+		},
+		{
+			name:     "row references with offsets",
+			input:    table(),
+			formulas: []string{"@>$3=@>-1", "@>$4=@<<+1"},
+			expected: [][]string{
+				{"Item", "Q1", "Q2", "Q3", "Total"},
+				{"A", "1", "2", "3", ""},
+				{"B", "10", "20", "30", ""},
+				{"C", "100", "200", "300", ""},
+				{"Sum", "", "200", "30", ""},
+			},
+		},
+		{
+			name: "hline offsets",
+			input: [][]string{
+				{"Item", "Amount"},
+				{"A", "1"},
+				{"B", "2"},
+				{"C", "3"},
+				{"Total", ""},
+			},
+			formulas: []string{"@>$2=@I+1$2 .. @II-1$2 .. vsum(@I+2..@II-1)"},
+			opts:     []Option{WithHlines([]int{1, 4})},
+			expected: [][]string{
+				{"Item", "Amount"},
+				{"A", "1"},
+				{"B", "2"},
+				{"C", "3"},
+				{"Total", "135"},
+			},
+		},
+		{
+			name:        "offset above the first row",
+			input:       table(),
+			formulas:    []string{"@>$5=@<-1$2"},
+			errorSubstr: "row reference @<-1 is above the first row",
+		},
+		{
+			name:        "offset beyond the last column",
+			input:       table(),
+			formulas:    []string{"@>$5=$>+1"},
+			errorSubstr: "column reference $>+1 is out of range (max columns: 5)",
+		},
+		{
+			name:        "relative reference in target",
+			input:       table(),
+			formulas:    []string{"@+1$5=1"},
+			errorSubstr: "relative row reference @+1 requires a current row",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_RowLabels(t *testing.T) {
+	table := func() [][]string {
+		return [][]string{
+			{"Item", "Amount", "Code"},
+			{"Apple", "10", "a"},
+			{"Banana", "20", "b"},
+			{"Cherry", "30", "c"},
+			{"TOTAL", "", "t"},
+		}
+	}
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:     "label in target and range end",
+			input:    table(),
+			formulas: []string{"@{TOTAL}$2=vsum(@2..@{TOTAL}-1)"},
+			expected: [][]string{
+				{"Item", "Amount", "Code"},
+				{"Apple", "10", "a"},
+				{"Banana", "20", "b"},
+				{"Cherry", "30", "c"},
+				{"TOTAL", "60", "t"},
+			},
+		},
+		{
+			name:     "label in field reference",
+			input:    table(),
+			formulas: []string{"@{TOTAL}$2=@{Banana}$2 + @{Cherry}-1$2"},
+			expected: [][]string{
+				{"Item", "Amount", "Code"},
+				{"Apple", "10", "a"},
+				{"Banana", "20", "b"},
+				{"Cherry", "30", "c"},
+				{"TOTAL", "40", "t"},
+			},
+		},
+		{
+			name:     "label in another key column",
+			input:    table(),
+			formulas: []string{"@{t}$2=@{a}$2 * 2"},
+			opts:     []Option{WithLabelColumn(3)},
+			expected: [][]string{
+				{"Item", "Amount", "Code"},
+				{"Apple", "10", "a"},
+				{"Banana", "20", "b"},
+				{"Cherry", "30", "c"},
+				{"TOTAL", "20", "t"},
+			},
+		},
+		{
+			name:        "missing label",
+			input:       table(),
+			formulas:    []string{"@{TOTAL}$2=@{Durian}$2"},
+			errorSubstr: "row label @{Durian} not found in column $1",
+		},
+		{
+			name: "duplicated label",
+			input: [][]string{
+				{"Item", "Amount"},
+				{"Apple", "10"},
+				{"Apple", "20"},
+				{"TOTAL", ""},
+			},
+			formulas:    []string{"@{TOTAL}$2=@{Apple}$2"},
+			errorSubstr: "row label @{Apple} is ambiguous: found in rows @2 and @3 of column $1",
+		},
+		{
+			name:        "label offset above the first row",
+			input:       table(),
+			formulas:    []string{"@{TOTAL}$2=@{Apple}-2$2"},
+			errorSubstr: "row reference @{Apple}-2 is above the first row",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_Trace(t *testing.T) {
+	table := func() [][]string {
+		return [][]string{
+			{"A", "B", "C", "D"},
+			{"3", "4", "", ""},
+			{"5", "x", "", ""},
+		}
+	}
+	tests := []struct {
+		name     string
+		formulas []string
+		filter   func(index, row, col int) bool
+		expected []string
+	}{
+		{
+			name:     "all evaluations",
+			formulas: []string{"@2$3=$1*$2", "@2$4=$3 .. 'k'"},
+			expected: []string{
+				`@2$3=$1*$2 at @2$3: 3*4 => "12"`,
+				`@2$4=$3 .. 'k' at @2$4: 12 .. 'k' => "12k"`,
+			},
+		},
+		{
+			name:     "error",
+			formulas: []string{"$3=$1*$2"},
+			expected: []string{
+				`$3=$1*$2 at @2$3: 3*4 => "12"`,
+				`$3=$1*$2 at @3$3: 5*x => error: <string>:1: cannot perform mul operation between number and string`,
+			},
+		},
+		{
+			name:     "filter by formula index",
+			formulas: []string{"$3=$1", "$4=$1+1"},
+			filter:   func(index, row, col int) bool { return index == 1 },
+			expected: []string{
+				`$4=$1+1 at @2$4: 3+1 => "4"`,
+				`$4=$1+1 at @3$4: 5+1 => "6"`,
+			},
+		},
+		{
+			name:     "filter by target cell",
+			formulas: []string{"$3=$1", "$4=$1+1"},
+			filter:   func(index, row, col int) bool { return row == 3 && col == 3 },
+			expected: []string{
+				`$3=$1 at @3$3: 5 => "5"`,
+			},
+		},
+	}
+
+	// Elapsed times vary, so they are removed before comparison
+	elapsedPat := regexp.MustCompile(` \([^()]+\)$`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trace bytes.Buffer
+			_, _ = Apply(table(), tt.formulas, WithTrace(&trace), WithTraceFilter(tt.filter))
+			lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+			if len(lines) != len(tt.expected) {
+				t.Fatalf("trace has %d lines, want %d:\n%s", len(lines), len(tt.expected), trace.String())
+			}
+			for i, line := range lines {
+				if !elapsedPat.MatchString(line) {
+					t.Errorf("trace line %q has no elapsed time", line)
+				}
+				line = elapsedPat.ReplaceAllString(line, "")
+				if !strings.HasPrefix(line, tt.expected[i]) {
+					t.Errorf("trace line %d = %q, want prefix %q", i+1, line, tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApply_LuaChunks(t *testing.T) {
+	table := func() [][]string {
+		return [][]string{
+			{"Item", "Price", "Tax"},
+			{"A", "100", ""},
+			{"B", "250", ""},
+		}
+	}
+	tests := []struct {
+		name        string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:     "function defined in a chunk",
+			formulas: []string{"$3=tax($2)"},
+			opts:     []Option{WithLuaChunk("tax.lua", "function tax(x) return x * rate end\nrate = 0.1")},
+			expected: [][]string{
+				{"Item", "Price", "Tax"},
+				{"A", "100", "10"},
+				{"B", "250", "25"},
+			},
+		},
+		{
+			name:     "later chunks can use and override earlier ones",
+			formulas: []string{"$3=tax($2)"},
+			opts: []Option{
+				WithLuaChunk("lib.lua", "function half_up(x) return math.floor(x + 0.5) end\nfunction tax(x) return x end"),
+				WithLuaChunk("local.lua", "function tax(x) return half_up(x * 0.08) end"),
+			},
+			expected: [][]string{
+				{"Item", "Price", "Tax"},
+				{"A", "100", "8"},
+				{"B", "250", "20"},
+			},
+		},
+		{
+			name:     "chunks can replace built-in functions",
+			formulas: []string{"$3=round($2 / 3)"},
+			opts:     []Option{WithLuaChunk("lib.lua", "function round(x) return -1 end")},
+			expected: [][]string{
+				{"Item", "Price", "Tax"},
+				{"A", "100", "-1"},
+				{"B", "250", "-1"},
+			},
+		},
+		{
+			name:     "comparisons in a chunk in decimal mode",
+			formulas: []string{"$3=tax($2)"},
+			opts: []Option{
+				WithDecimal(true),
+				WithLuaChunk("tax.lua", "function tax(x)\n  if x > 200 and x ~= 0.5 then return x * 0.1 end\n  return 0\nend"),
+			},
+			expected: [][]string{
+				{"Item", "Price", "Tax"},
+				{"A", "100", "0"},
+				{"B", "250", "25"},
+			},
+		},
+		{
+			name:        "line numbers of a chunk in decimal mode",
+			formulas:    []string{"$3=1"},
+			opts:        []Option{WithDecimal(true), WithLuaChunk("bad.lua", "x = 1\ny = x .. nil")},
+			errorSubstr: "bad.lua:2:",
+		},
+		{
+			name:        "chunks run in the sandbox",
+			formulas:    []string{"$3=1"},
+			opts:        []Option{WithLuaChunk("io.lua", "f = io.open('/etc/passwd')")},
+			errorSubstr: "error loading Lua chunk io.lua: io.lua:1: attempt to index a non-table object(nil) with key 'open'",
+		},
+		{
+			name:        "syntax error",
+			formulas:    []string{"$3=1"},
+			opts:        []Option{WithLuaChunk("bad.lua", "function tax(x) return x")},
+			errorSubstr: "error loading Lua chunk bad.lua: bad.lua",
+		},
+		{
+			name:        "columns of syntax errors are those of the chunk",
+			formulas:    []string{"$3=1"},
+			opts:        []Option{WithLuaChunk("bad.lua", "x = = 1")},
+			errorSubstr: "error loading Lua chunk bad.lua: bad.lua line:1(column:5) near '='",
+		},
+		{
+			name:        "timeout",
+			formulas:    []string{"$3=1"},
+			opts:        []Option{WithLuaChunk("loop.lua", "while true do end"), WithTimeout(50 * time.Millisecond)},
+			errorSubstr: "time limit of 50ms exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(table(), tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_GoFunctions(t *testing.T) {
+	rates := map[string]float64{"USD": 150, "EUR": 160}
+	convert := WithFunction("convert", func(args []Value) (Value, error) {
+		amount, ok := args[0].(float64)
+		if !ok {
+			return nil, fmt.Errorf("amount must be a number, got %v", args[0])
+		}
+		rate, ok := rates[args[1].(string)]
+		if !ok {
+			return nil, fmt.Errorf("unknown currency %q", args[1])
+		}
+		return amount * rate, nil
+	})
+	describe := WithFunction("describe", func(args []Value) (Value, error) {
+		return fmt.Sprintf("%#v", args), nil
+	})
+	errUnknown := errors.New("unknown SKU")
+	validSKU := WithFunction("validsku", func(args []Value) (Value, error) {
+		if args[0] != "A-1" {
+			return nil, errUnknown
+		}
+		return true, nil
+	})
+
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+		errorIs     error
+	}{
+		{
+			name: "scalar arguments and result",
+			input: [][]string{
+				{"Amount", "Currency", "JPY"},
+				{"10", "USD", ""},
+				{"2", "EUR", ""},
+			},
+			formulas: []string{"$3=convert($1, $2)"},
+			opts:     []Option{convert},
+			expected: [][]string{
+				{"Amount", "Currency", "JPY"},
+				{"10", "USD", "1500"},
+				{"2", "EUR", "320"},
+			},
+		},
+		{
+			name: "range and other values",
+			input: [][]string{
+				{"A", "B"},
+				{"1", "x"},
+				{"2", ""},
+			},
+			formulas: []string{"@2$2=describe(@2$1..@3$1, true, nil)"},
+			opts:     []Option{describe},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", `[]tblfm.Value{[]tblfm.Value{1, 2}, true, tblfm.Value(nil)}`},
+				{"2", ""},
+			},
+		},
+		{
+			name: "array result",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{"$2=vsum(pair($1))"},
+			opts: []Option{WithFunction("pair", func(args []Value) (Value, error) {
+				return []Value{args[0], 10}, nil
+			})},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", "11"},
+			},
+		},
+		{
+			name: "array result with nil",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{"$2=sparse()[3]"},
+			opts: []Option{WithFunction("sparse", func(args []Value) (Value, error) {
+				return []Value{1, nil, 3}, nil
+			})},
+			expected: [][]string{
+				{"A", "B"},
+				{"1", "3"},
+			},
+		},
+		{
+			name: "decimal mode",
+			input: [][]string{
+				{"A", "B"},
+				{"0.1", ""},
+			},
+			formulas: []string{"$2=half($1) + 0.2"},
+			opts: []Option{WithDecimal(true), WithFunction("half", func(args []Value) (Value, error) {
+				return new(big.Rat).Quo(args[0].(*big.Rat), big.NewRat(2, 1)), nil
+			})},
+			expected: [][]string{
+				{"A", "B"},
+				{"0.1", "0.25"},
+			},
+		},
+		{
+			name: "error returned by the function",
+			input: [][]string{
+				{"SKU", "Valid"},
+				{"B-2", ""},
+			},
+			formulas:    []string{"$2=validsku($1)"},
+			opts:        []Option{validSKU},
+			errorSubstr: "error evaluating formula $2=validsku($1) at @2$2: error in function validsku: unknown SKU",
+			errorIs:     errUnknown,
+		},
+		{
+			name: "unsupported argument",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas:    []string{"$2=describe({x = 1})"},
+			opts:        []Option{describe},
+			errorSubstr: "bad argument #1 to describe (table with the key x is not an array)",
+		},
+		{
+			name: "unsupported result",
+			input: [][]string{
+				{"A", "B"},
+				{"1", ""},
+			},
+			formulas: []string{"$2=bad()"},
+			opts: []Option{WithFunction("bad", func(args []Value) (Value, error) {
+				return struct{}{}, nil
+			})},
+			errorSubstr: "error in function bad: cannot convert a value of type struct {}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				if tt.errorIs != nil && !errors.Is(err, tt.errorIs) {
+					t.Errorf("Apply() error %q does not wrap %q", err.Error(), tt.errorIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply_CreateColumns(t *testing.T) {
+	table := func() [][]string {
+		return [][]string{
+			{"Item", "Total", "Note"},
+			{"A", "100", "x"},
+			{"B", "250"},
+		}
+	}
+	tests := []struct {
+		name        string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name:        "missing column without the option",
+			formulas:    []string{"${Tax}=${Total}*0.1"},
+			errorSubstr: `header column "Tax" not found`,
+		},
+		{
+			name:     "appended column",
+			formulas: []string{"${Tax}=${Total}*0.1", "${Gross}=${Total}+${Tax}"},
+			opts:     []Option{WithCreateColumns(true)},
+			expected: [][]string{
+				{"Item", "Total", "Note", "Tax", "Gross"},
+				{"A", "100", "x", "10", "110"},
+				{"B", "250", "", "25", "275"},
+			},
+		},
+		{
+			name:     "inserted after a column",
+			formulas: []string{"${Tax}@after(${Total})=${Total}*0.1"},
+			expected: [][]string{
+				{"Item", "Total", "Tax", "Note"},
+				{"A", "100", "10", "x"},
+				{"B", "250", "25"},
+			},
+		},
+		{
+			name:     "inserted after a numbered column with a row range",
+			formulas: []string{"@3${Tax}@after($1)=${Total}*0.1"},
+			expected: [][]string{
+				{"Item", "Tax", "Total", "Note"},
+				{"A", "", "100", "x"},
+				{"B", "25", "250"},
+			},
+		},
+		{
+			name:     "existing column is not moved",
+			formulas: []string{"${Note}@after(${Item})=${Total}*2"},
+			expected: [][]string{
+				{"Item", "Total", "Note"},
+				{"A", "100", "200"},
+				{"B", "250"},
+			},
+		},
+		{
+			name:        "invalid position",
+			formulas:    []string{"${Tax}@after(${Net})=${Total}*0.1"},
+			errorSubstr: `formula ${Tax}@after(${Net})=${Total}*0.1: invalid position of column "Tax": header column "Net" not found`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(table(), tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil {
+					t.Fatalf("Apply() expected error but got none")
+				}
+				if !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Errorf("Apply() error %q does not contain %q", err.Error(), tt.errorSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompile_RunOnMultipleTables(t *testing.T) {
+	program, err := Compile([]string{
+		"$4=$2*$3",
+		"@>$4=vsum(@I..@II)",
+	})
+	if err != nil {
+		t.Fatalf("Compile() returned error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    [][]string
+		opts     []Option
+		expected [][]string
+	}{
+		{
+			name: "first table",
+			input: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", ""},
+				{"Orange", "150", "3", ""},
+				{"TOTAL", "", "", ""},
+			},
+			opts: []Option{WithHlines([]int{1, 3})},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "500"},
+				{"Orange", "150", "3", "450"},
+				{"TOTAL", "", "", "950"},
+			},
+		},
+		{
+			name: "second table with different hlines",
+			input: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Pen", "2", "10", ""},
+				{"TOTAL", "", "", ""},
+			},
+			opts: []Option{WithHlines([]int{1, 2})},
+			expected: [][]string{
+				{"Item", "Price", "Qty", "Total"},
+				{"Pen", "2", "10", "20"},
+				{"TOTAL", "", "", "20"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := program.Run(tt.input, tt.opts...)
+			if err != nil {
+				t.Fatalf("Run() returned error: %v", err)
+			}
+
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Run() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		formulas    []string
+		errorSubstr string
+	}{
+		{
+			name:        "invalid formula format",
+			formulas:    []string{"not a formula"},
+			errorSubstr: "invalid formula format",
+		},
+		{
+			name:        "Lua syntax error",
+			formulas:    []string{"$2=$1 +* 2"},
+			errorSubstr: "error compiling formula $2=$1 +* 2: <string> line:1 near '*': syntax error",
+		},
+		{
+			name:        "formulas after exit are not compiled",
+			formulas:    []string{"$2=$1", "exit", "not a formula"},
+			errorSubstr: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.formulas)
+			if tt.errorSubstr == "" {
+				if err != nil {
+					t.Fatalf("Compile() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Compile() expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.errorSubstr) {
+				t.Errorf("Compile() error %q does not contain %q", err.Error(), tt.errorSubstr)
+			}
+		})
+	}
+}
+
+func BenchmarkRun_LargeTable(b *testing.B) {
+	const rows = 20000
+	program, err := Compile([]string{
+		"@2$4..@>>$4=$2*$3",
+		"@>$4=vsum(@2..@>>)",
+	})
+	if err != nil {
+		b.Fatalf("Compile() returned error: %v", err)
+	}
+	for b.Loop() {
+		b.StopTimer()
+		table := [][]string{{"Item", "Price", "Qty", "Total"}}
+		for i := range rows {
+			table = append(table, []string{"Item", strconv.Itoa(i), "3", ""})
+		}
+		table = append(table, []string{"TOTAL", "", "", ""})
+		b.StartTimer()
+		if _, err := program.Run(table); err != nil {
+			b.Fatalf("Run() returned error: %v", err)
+		}
+	}
+}
+
+func TestApply_HeaderRows(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       [][]string
+		formulas    []string
+		opts        []Option
+		expected    [][]string
+		errorSubstr string
+	}{
+		{
+			name: "no header rows",
+			input: [][]string{
+				{"Apple", "100", "5", ""},
+				{"Orange", "150", "3", ""},
+			},
+			formulas: []string{"$4=$2*$3", "@2$1=@<$1"},
+			opts:     []Option{WithHeaderRows(0)},
+			expected: [][]string{
+				{"Apple", "100", "5", "500"},
+				{"Apple", "150", "3", "450"},
+			},
+		},
+		{
+			name: "joined header name",
+			input: [][]string{
+				{"", "Q1", "", "Q2", ""},
+				{"Item", "Sales", "Cost", "Sales", "Cost"},
+				{"Apple", "100", "60", "120", "70"},
+				{"Total", "", "", "", ""},
+			},
+			formulas: []string{"@>${Q1 Sales}=vsum(@3..@>>)", "@>${Q2 Sales}=vsum(@3..@>>)"},
+			opts:     []Option{WithHeaderRows(2)},
+			expected: [][]string{
+				{"", "Q1", "", "Q2", ""},
+				{"Item", "Sales", "Cost", "Sales", "Cost"},
+				{"Apple", "100", "60", "120", "70"},
+				{"Total", "100", "", "120", ""},
+			},
+		},
+		{
+			name: "name in the last header row",
+			input: [][]string{
+				{"Fruits", "", ""},
+				{"Item", "Price", "Qty"},
+				{"Apple", "100", ""},
+			},
+			formulas: []string{"${Qty}=${Price}/20"},
+			opts:     []Option{WithHeaderRows(2)},
+			expected: [][]string{
+				{"Fruits", "", ""},
+				{"Item", "Price", "Qty"},
+				{"Apple", "100", "5"},
+			},
+		},
+		{
+			name: "header rows are not data rows",
+			input: [][]string{
+				{"Fruits", "", "", ""},
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", ""},
+				{"Orange", "150", "3", ""},
+			},
+			formulas: []string{"${Total}=${Price}*${Qty}"},
+			opts:     []Option{WithHeaderRows(2)},
+			expected: [][]string{
+				{"Fruits", "", "", ""},
+				{"Item", "Price", "Qty", "Total"},
+				{"Apple", "100", "5", "500"},
+				{"Orange", "150", "3", "450"},
+			},
+		},
+		{
+			name: "created column in the last header row",
+			input: [][]string{
+				{"Fruits", ""},
+				{"Item", "Price"},
+				{"Apple", "100"},
+			},
+			formulas: []string{"${Tax}=${Price}*0.1"},
+			opts:     []Option{WithHeaderRows(2), WithCreateColumns(true)},
+			expected: [][]string{
+				{"Fruits", "", ""},
+				{"Item", "Price", "Tax"},
+				{"Apple", "100", "10"},
+			},
+		},
+		{
+			name: "header name without header rows",
+			input: [][]string{
+				{"Item", "Price"},
+				{"Apple", "100"},
+			},
+			formulas:    []string{"${Price}=1"},
+			opts:        []Option{WithHeaderRows(0)},
+			errorSubstr: `header column "Price" not found`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Apply(tt.input, tt.formulas, tt.opts...)
+			if tt.errorSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errorSubstr) {
+					t.Fatalf("expected error containing %q, got %v", tt.errorSubstr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply() returned error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply() returned unexpected result\nGot:  %v\nWant: %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompile_DecimalComparisons(t *testing.T) {
+	program, err := Compile([]string{`$2=$1 > 0.25 and "big" or "small"`})
+	if err != nil {
+		t.Fatalf("Compile() returned error: %v", err)
+	}
+	// Only the decimal version calls the comparator, which receives the operator as a constant
+	hasOperator := func(proto *lua.FunctionProto) bool {
+		return slices.Contains(proto.Constants, lua.LValue(lua.LString(">")))
+	}
+	f := program.formulas[0]
+	if hasOperator(f.proto) || !hasOperator(f.decimalProto) {
+		t.Errorf("comparisons are rewritten in float mode, or not in decimal mode")
+	}
+
+	// Decimal mode given when running uses the decimal version
+	for _, opts := range [][]Option{nil, {WithDecimal(true)}} {
+		table := [][]string{{"X", "Size"}, {"0.3", ""}, {"0.2", ""}}
+		result, err := program.Run(table, opts...)
+		if err != nil {
+			t.Fatalf("Run() returned error: %v", err)
+		}
+		expected := [][]string{{"X", "Size"}, {"0.3", "big"}, {"0.2", "small"}}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Run() returned unexpected result\nGot:  %v\nWant: %v", result, expected)
+		}
+	}
+}
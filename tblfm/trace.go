@@ -0,0 +1,28 @@
+package tblfm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tracing reports whether the evaluation of the current formula at cell is to be traced.
+func (rs *runState) tracing(cell cellPos) bool {
+	if rs.cfg.trace == nil {
+		return false
+	}
+	return rs.cfg.traceFilter == nil || rs.cfg.traceFilter(rs.formula.index, cell.row+1, cell.col+1)
+}
+
+// writeTrace logs the evaluation of the current formula at the current cell to the trace writer.
+// Only the first line of an error is logged, without the Lua stack traceback.
+// Errors in writing the trace are ignored, since they should not affect the evaluation.
+func (rs *runState) writeTrace(result string, err error, elapsed time.Duration) {
+	outcome := fmt.Sprintf("%q", result)
+	if err != nil {
+		msg, _, _ := strings.Cut(err.Error(), "\n")
+		outcome = "error: " + msg
+	}
+	_, _ = fmt.Fprintf(rs.cfg.trace, "%s at @%d$%d: %s => %s (%s)\n",
+		rs.formula.text, rs.current.row+1, rs.current.col+1, rs.substitutedCode(), outcome, elapsed)
+}
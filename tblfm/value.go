@@ -0,0 +1,125 @@
+package tblfm
+
+import (
+	"fmt"
+	"math/big"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Value is a value passed between formulas and the Go functions registered with WithFunction.
+// The arguments of a function are one of:
+//   - nil
+//   - bool
+//   - float64 (a number)
+//   - *big.Rat (a number in decimal mode)
+//   - string (including the fields that are not numbers)
+//   - []Value (a Lua array, such as a range)
+//
+// A function may also return an int or an int64, which is converted into a number.
+type Value any
+
+// goFunction is a Go function registered with WithFunction.
+type goFunction struct {
+	name string
+	fn   func(args []Value) (Value, error)
+}
+
+// registerGoFunctions registers the Go functions given by WithFunction as Lua globals.
+// They are registered after the built-in functions, so they can replace them.
+// An error returned by a function stops the evaluation, and the FormulaError wraps it.
+func (rs *runState) registerGoFunctions() {
+	for _, f := range rs.cfg.functions {
+		rs.L.SetGlobal(f.name, rs.L.NewFunction(func(L *lua.LState) int {
+			args := make([]Value, L.GetTop())
+			for i := range args {
+				arg, err := toValue(L.Get(i + 1))
+				if err != nil {
+					L.ArgError(i+1, err.Error())
+				}
+				args[i] = arg
+			}
+			ret, err := f.fn(args)
+			if err == nil {
+				var lv lua.LValue
+				if lv, err = fromValue(L, ret); err == nil {
+					L.Push(lv)
+					return 1
+				}
+			}
+			rs.accessErr = fmt.Errorf("error in function %s: %w", f.name, err)
+			L.RaiseError("%s", rs.accessErr.Error())
+			return 0
+		}))
+	}
+}
+
+// toValue converts a Lua value into a Value.
+// Tables are converted into []Value and must be arrays.
+func toValue(lv lua.LValue) (Value, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		n := v.Len()
+		values := make([]Value, n)
+		var err error
+		v.ForEach(func(key, elem lua.LValue) {
+			if err != nil {
+				return
+			}
+			i, ok := key.(lua.LNumber)
+			if !ok || float64(i) != float64(int(i)) || int(i) < 1 || int(i) > n {
+				err = fmt.Errorf("table with the key %s is not an array", key.String())
+				return
+			}
+			values[int(i)-1], err = toValue(elem)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	if x, ok := decimalValue(lv); ok {
+		return new(big.Rat).Set(x), nil
+	}
+	return nil, fmt.Errorf("cannot convert a %s value", lv.Type())
+}
+
+// fromValue converts a Value into a Lua value.
+func fromValue(L *lua.LState, value Value) (lua.LValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil, nil
+	case bool:
+		return lua.LBool(v), nil
+	case float64:
+		return lua.LNumber(v), nil
+	case int:
+		return lua.LNumber(v), nil
+	case int64:
+		return lua.LNumber(v), nil
+	case string:
+		return lua.LString(v), nil
+	case *big.Rat:
+		return newDecimal(L, new(big.Rat).Set(v)), nil
+	case []Value:
+		tbl := L.CreateTable(len(v), 0)
+		for i, elem := range v {
+			lv, err := fromValue(L, elem)
+			if err != nil {
+				return nil, err
+			}
+			// Append would skip nil, shifting the elements after it
+			tbl.RawSetInt(i+1, lv)
+		}
+		return tbl, nil
+	}
+	return nil, fmt.Errorf("cannot convert a value of type %T", value)
+}
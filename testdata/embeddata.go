@@ -28,3 +28,9 @@ var Test3ExitedCSV string
 
 //go:embed test3-not-exited.csv
 var Test3NotExitedCSV string
+
+//go:embed test4.csv
+var Test4CSV string
+
+//go:embed test4-result.csv
+var Test4ResultCSV string